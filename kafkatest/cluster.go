@@ -0,0 +1,96 @@
+package kafkatest
+
+import "net"
+
+// Cluster is a group of mock brokers backed by a single Server, so that all
+// brokers share the same topics, messages and committed offsets. Every
+// broker advertises all brokers of the cluster in metadata responses and
+// leadership of partitions is spread over them by partition ID: partition p
+// is led by the broker at index p % n. Produce, fetch and offset requests
+// sent to a broker that is not the partition leader fail with
+// ErrNotLeaderForPartition.
+type Cluster struct {
+	srv *Server
+	lns []net.Listener
+}
+
+// NewCluster spawns a cluster of n brokers listening on random ports. Brokers
+// get node IDs 100 to 100+n-1. Middlewares are used by all brokers, as with
+// NewServer. It panics if any of the brokers cannot be spawned.
+// Use Close method to stop the cluster.
+func NewCluster(n int, middlewares ...Middleware) *Cluster {
+	if n < 1 {
+		panic("cluster must have at least one broker")
+	}
+
+	srv := NewServer(middlewares...)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	c := &Cluster{srv: srv}
+	for i := 0; i < n; i++ {
+		srv.nodes = append(srv.nodes, srv.nodeID+int32(i))
+	}
+	for _, nodeID := range srv.nodes {
+		c.lns = append(c.lns, srv.spawnNode(nodeID))
+	}
+	srv.ln = c.lns[0]
+	srv.started = true
+	return c
+}
+
+// Server returns the server holding the state of the cluster, which can be
+// used to add messages or configure behaviour of all brokers at once.
+func (c *Cluster) Server() *Server {
+	return c.srv
+}
+
+// NodeIDs returns node IDs of all brokers of the cluster.
+func (c *Cluster) NodeIDs() []int32 {
+	return append([]int32(nil), c.srv.nodes...)
+}
+
+// BootstrapAddrs returns addresses of all brokers of the cluster, which can
+// be used to bootstrap clients.
+func (c *Cluster) BootstrapAddrs() []string {
+	addrs := make([]string, len(c.lns))
+	for i, ln := range c.lns {
+		addrs[i] = ln.Addr().String()
+	}
+	return addrs
+}
+
+// Close stops all brokers of the cluster. It is safe to call it more than
+// once.
+func (c *Cluster) Close() error {
+	err := c.srv.Close()
+	for _, ln := range c.lns[1:] {
+		// listeners are closed more than once if Close is repeated
+		_ = ln.Close()
+	}
+	return err
+}
+
+// Isolate simulates network partition separating given broker from the rest
+// of the cluster, while clients can still reach it. The isolated broker keeps
+// considering itself the leader of all partitions with all replicas in sync,
+// but produce requests that need acknowledgement of all replicas fail with
+// ErrRequestTimeout and it is no longer a group coordinator. The rest of the
+// cluster drops the broker from ISR and moves leadership of its partitions to
+// the next broker, so that clients can see two leaders of the same partition.
+func (c *Cluster) Isolate(nodeID int32) {
+	c.srv.mu.Lock()
+	defer c.srv.mu.Unlock()
+
+	c.srv.isolated[nodeID] = true
+	c.srv.fetchCond.Broadcast()
+}
+
+// Rejoin heals the network partition created by Isolate, so that the broker
+// is part of the cluster again.
+func (c *Cluster) Rejoin(nodeID int32) {
+	c.srv.mu.Lock()
+	defer c.srv.mu.Unlock()
+
+	delete(c.srv.isolated, nodeID)
+}
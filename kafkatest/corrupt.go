@@ -0,0 +1,47 @@
+package kafkatest
+
+import "github.com/dropbox/kafka/proto"
+
+// MarkCorrupt makes fetch responses carry the message stored at given offset
+// with invalid CRC. All other messages, including the ones following the
+// corrupted one, are returned unchanged.
+func (s *Server) MarkCorrupt(topic string, partition int32, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.corrupt[topic]; !ok {
+		s.corrupt[topic] = make(map[int32]map[int64]bool)
+	}
+	if _, ok := s.corrupt[topic][partition]; !ok {
+		s.corrupt[topic][partition] = make(map[int64]bool)
+	}
+	s.corrupt[topic][partition][offset] = true
+}
+
+// corruptedResponse returns given response with messages marked as corrupt
+// replaced by copies that are serialized with invalid CRC. Stored messages are
+// not modified. It must be called with the lock held.
+func (s *Server) corruptedResponse(resp *proto.FetchResp) response {
+	for ti := range resp.Topics {
+		topic := &resp.Topics[ti]
+		for pi := range topic.Partitions {
+			part := &topic.Partitions[pi]
+			offsets := s.corrupt[topic.Name][part.ID]
+			if len(offsets) == 0 {
+				continue
+			}
+			// fetched messages share the backing array with the partition log
+			messages := make([]*proto.Message, len(part.Messages))
+			for i, msg := range part.Messages {
+				if offsets[msg.Offset] {
+					m := *msg
+					m.InvalidCrc = true
+					msg = &m
+				}
+				messages[i] = msg
+			}
+			part.Messages = messages
+		}
+	}
+	return resp
+}
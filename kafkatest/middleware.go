@@ -0,0 +1,264 @@
+package kafkatest
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/dropbox/kafka/proto"
+)
+
+// ChaosConfig configures ChaosMiddleware.
+type ChaosConfig struct {
+	// Rate is the fraction of affected requests, from 0 to 1, that are
+	// answered with an error.
+	Rate float64
+
+	// Kinds limits the middleware to given request kinds. If empty, all
+	// requests are affected.
+	Kinds []int16
+
+	// Err is the kafka error returned for affected requests.
+	Err error
+
+	// Seed initializes the random source that decides which requests fail.
+	// If zero, current time is used.
+	Seed int64
+}
+
+// ChaosMiddleware returns middleware that answers a random fraction of
+// requests with an error response, as configured by cfg. All other requests
+// are passed through to the next middleware or the default handler.
+func ChaosMiddleware(cfg ChaosConfig) Middleware {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	rnd := rand.New(rand.NewSource(seed))
+	mu := &sync.Mutex{}
+
+	kinds := make(map[int16]bool)
+	for _, kind := range cfg.Kinds {
+		kinds[kind] = true
+	}
+
+	return func(nodeID int32, requestKind int16, content []byte) Response {
+		if len(kinds) != 0 && !kinds[requestKind] {
+			return nil
+		}
+
+		mu.Lock()
+		hit := rnd.Float64() < cfg.Rate
+		mu.Unlock()
+		if !hit {
+			return nil
+		}
+
+		resp, err := errorResponse(requestKind, content, cfg.Err)
+		if err != nil {
+			log.Errorf("cannot build %d error response: %s", requestKind, err)
+			return nil
+		}
+		return resp
+	}
+}
+
+// errorResponse returns response to given request that has the error set for
+// every topic and partition it refers to.
+func errorResponse(kind int16, b []byte, kerr error) (Response, error) {
+	switch kind {
+	case proto.ProduceReqKind:
+		req, err := proto.ReadProduceReq(bytes.NewBuffer(b))
+		if err != nil {
+			return nil, err
+		}
+		resp := &proto.ProduceResp{
+			Version:       req.Version,
+			CorrelationID: req.CorrelationID,
+			Topics:        make([]proto.ProduceRespTopic, len(req.Topics)),
+		}
+		for ti, topic := range req.Topics {
+			resp.Topics[ti].Name = topic.Name
+			resp.Topics[ti].Partitions = make([]proto.ProduceRespPartition, len(topic.Partitions))
+			for pi, part := range topic.Partitions {
+				resp.Topics[ti].Partitions[pi] = proto.ProduceRespPartition{
+					ID:     part.ID,
+					Err:    kerr,
+					Offset: -1,
+				}
+			}
+		}
+		return resp, nil
+	case proto.FetchReqKind:
+		req, err := proto.ReadFetchReq(bytes.NewBuffer(b))
+		if err != nil {
+			return nil, err
+		}
+		resp := &proto.FetchResp{
+			Version:       req.Version,
+			CorrelationID: req.CorrelationID,
+			Topics:        make([]proto.FetchRespTopic, len(req.Topics)),
+		}
+		for ti, topic := range req.Topics {
+			resp.Topics[ti].Name = topic.Name
+			resp.Topics[ti].Partitions = make([]proto.FetchRespPartition, len(topic.Partitions))
+			for pi, part := range topic.Partitions {
+				resp.Topics[ti].Partitions[pi] = proto.FetchRespPartition{
+					ID:                   part.ID,
+					Err:                  kerr,
+					TipOffset:            -1,
+					LastStableOffset:     -1,
+					LogStartOffset:       -1,
+					PreferredReadReplica: -1,
+				}
+			}
+		}
+		return resp, nil
+	case proto.OffsetReqKind:
+		req, err := proto.ReadOffsetReq(bytes.NewBuffer(b))
+		if err != nil {
+			return nil, err
+		}
+		resp := &proto.OffsetResp{
+			Version:       req.Version,
+			CorrelationID: req.CorrelationID,
+			Topics:        make([]proto.OffsetRespTopic, len(req.Topics)),
+		}
+		for ti, topic := range req.Topics {
+			resp.Topics[ti].Name = topic.Name
+			resp.Topics[ti].Partitions = make([]proto.OffsetRespPartition, len(topic.Partitions))
+			for pi, part := range topic.Partitions {
+				resp.Topics[ti].Partitions[pi] = proto.OffsetRespPartition{
+					ID:     part.ID,
+					Err:    kerr,
+					TimeMs: -1,
+				}
+			}
+		}
+		return resp, nil
+	case proto.MetadataReqKind:
+		req, err := proto.ReadMetadataReq(bytes.NewBuffer(b))
+		if err != nil {
+			return nil, err
+		}
+		resp := &proto.MetadataResp{
+			Version:       req.Version,
+			CorrelationID: req.CorrelationID,
+			Topics:        make([]proto.MetadataRespTopic, len(req.Topics)),
+		}
+		for ti, name := range req.Topics {
+			resp.Topics[ti] = proto.MetadataRespTopic{
+				Name: name,
+				Err:  kerr,
+			}
+		}
+		return resp, nil
+	case proto.OffsetCommitReqKind:
+		req, err := proto.ReadOffsetCommitReq(bytes.NewBuffer(b))
+		if err != nil {
+			return nil, err
+		}
+		resp := &proto.OffsetCommitResp{
+			Version:       req.Version,
+			CorrelationID: req.CorrelationID,
+			Topics:        make([]proto.OffsetCommitRespTopic, len(req.Topics)),
+		}
+		for ti, topic := range req.Topics {
+			resp.Topics[ti].Name = topic.Name
+			resp.Topics[ti].Partitions = make([]proto.OffsetCommitRespPartition, len(topic.Partitions))
+			for pi, part := range topic.Partitions {
+				resp.Topics[ti].Partitions[pi] = proto.OffsetCommitRespPartition{
+					ID:  part.ID,
+					Err: kerr,
+				}
+			}
+		}
+		return resp, nil
+	case proto.OffsetFetchReqKind:
+		req, err := proto.ReadOffsetFetchReq(bytes.NewBuffer(b))
+		if err != nil {
+			return nil, err
+		}
+		resp := &proto.OffsetFetchResp{
+			Version:       req.Version,
+			CorrelationID: req.CorrelationID,
+			Topics:        make([]proto.OffsetFetchRespTopic, len(req.Topics)),
+		}
+		for ti, topic := range req.Topics {
+			resp.Topics[ti].Name = topic.Name
+			resp.Topics[ti].Partitions = make([]proto.OffsetFetchRespPartition, len(topic.Partitions))
+			for pi, part := range topic.Partitions {
+				resp.Topics[ti].Partitions[pi] = proto.OffsetFetchRespPartition{
+					ID:     part,
+					Offset: -1,
+					Err:    kerr,
+				}
+			}
+		}
+		return resp, nil
+	case proto.GroupCoordinatorReqKind:
+		req, err := proto.ReadGroupCoordinatorReq(bytes.NewBuffer(b))
+		if err != nil {
+			return nil, err
+		}
+		return &proto.GroupCoordinatorResp{
+			Version:       req.Version,
+			CorrelationID: req.CorrelationID,
+			Err:           kerr,
+		}, nil
+	case proto.DescribeConfigsReqKind:
+		req, err := proto.ReadDescribeConfigsReq(bytes.NewBuffer(b))
+		if err != nil {
+			return nil, err
+		}
+		resp := &proto.DescribeConfigsResp{
+			CorrelationID: req.CorrelationID,
+			Resources:     make([]proto.DescribeConfigsRespResource, len(req.Resources)),
+		}
+		for ri, res := range req.Resources {
+			resp.Resources[ri] = proto.DescribeConfigsRespResource{
+				Err:  kerr,
+				Type: res.Type,
+				Name: res.Name,
+			}
+		}
+		return resp, nil
+	case proto.AlterConfigsReqKind:
+		req, err := proto.ReadAlterConfigsReq(bytes.NewBuffer(b))
+		if err != nil {
+			return nil, err
+		}
+		resp := &proto.AlterConfigsResp{
+			CorrelationID: req.CorrelationID,
+			Resources:     make([]proto.AlterConfigsRespResource, len(req.Resources)),
+		}
+		for ri, res := range req.Resources {
+			resp.Resources[ri] = proto.AlterConfigsRespResource{
+				Err:  kerr,
+				Type: res.Type,
+				Name: res.Name,
+			}
+		}
+		return resp, nil
+	case proto.DeleteGroupsReqKind:
+		req, err := proto.ReadDeleteGroupsReq(bytes.NewBuffer(b))
+		if err != nil {
+			return nil, err
+		}
+		resp := &proto.DeleteGroupsResp{
+			CorrelationID: req.CorrelationID,
+			Groups:        make([]proto.DeleteGroupsRespGroup, len(req.Groups)),
+		}
+		for gi, group := range req.Groups {
+			resp.Groups[gi] = proto.DeleteGroupsRespGroup{
+				Name: group,
+				Err:  kerr,
+			}
+		}
+		return resp, nil
+	default:
+		return nil, fmt.Errorf("unknown request kind %d", kind)
+	}
+}
@@ -0,0 +1,90 @@
+package kafkatest
+
+import (
+	"github.com/dropbox/kafka/proto"
+)
+
+// offsetsTopic is the internal topic kafka stores committed offsets in.
+const offsetsTopic = "__consumer_offsets"
+
+// offsetRecord is committed offset decoded from message stored in the
+// __consumer_offsets topic.
+type offsetRecord struct {
+	group     string
+	topic     string
+	partition int32
+	offset    int64
+	metadata  string
+	// deleted is set for a tombstone, which removes the committed offset
+	deleted bool
+}
+
+// decodeOffsetRecord decodes message produced to the __consumer_offsets topic.
+// Returns false if the message is not an offset commit, for example a group
+// metadata record, or if it cannot be decoded.
+func decodeOffsetRecord(msg *proto.Message) (offsetRecord, bool) {
+	var rec offsetRecord
+
+	key := &byteReader{b: msg.Key}
+	// key versions 0 and 1 are offset commits, 2 is group metadata
+	if version := key.int16(); version != 0 && version != 1 {
+		return rec, false
+	}
+	rec.group = key.string()
+	rec.topic = key.string()
+	rec.partition = key.int32()
+	if key.err != nil {
+		return rec, false
+	}
+
+	if msg.Value == nil {
+		rec.deleted = true
+		return rec, true
+	}
+	value := &byteReader{b: msg.Value}
+	version := value.int16()
+	rec.offset = value.int64()
+	if version >= 3 {
+		// leader epoch
+		value.int32()
+	}
+	rec.metadata = value.string()
+	// commit and expire timestamps are ignored
+	if value.err != nil {
+		return rec, false
+	}
+	return rec, true
+}
+
+// applyOffsetRecords stores offsets committed by producing directly to the
+// __consumer_offsets topic, so that offset fetch requests return them, and
+// returns the stored offsets. It must be called with the lock held.
+func (s *Server) applyOffsetRecords(messages []*proto.Message) []commitEvent {
+	var committed []commitEvent
+	for _, msg := range messages {
+		rec, ok := decodeOffsetRecord(msg)
+		if !ok {
+			continue
+		}
+		if rec.deleted {
+			delete(s.offsets[rec.topic][rec.partition], rec.group)
+			s.logger().Infof("deleted offset for group %s from %s:%d via %s",
+				rec.group, rec.topic, rec.partition, offsetsTopic)
+			continue
+		}
+		toffset := s.getTopicOffset(rec.group, rec.topic, rec.partition)
+		toffset.offset = rec.offset
+		toffset.metadata = rec.metadata
+		committed = append(committed, commitEvent{
+			group:     rec.group,
+			topic:     rec.topic,
+			partition: rec.partition,
+			offset:    rec.offset,
+			metadata:  rec.metadata,
+		})
+		s.logger().Infof("committed offset for group %s from %s:%d via %s, saved %d",
+			rec.group, rec.topic, rec.partition, offsetsTopic, rec.offset)
+	}
+	s.commitCond.Broadcast()
+	return committed
+}
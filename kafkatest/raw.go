@@ -0,0 +1,107 @@
+package kafkatest
+
+import (
+	"github.com/dropbox/kafka/proto"
+)
+
+// rawProduced maps messages of a decoded produce request to their wire bytes,
+// see SetRetainRawMessages.
+type rawProduced map[*proto.Message][]byte
+
+// rawProducedMessages returns wire bytes of messages of raw produce request b,
+// which was decoded into req. Messages of a compressed set share the bytes of
+// the wrapper message holding them. Partitions whose message set cannot be
+// matched with the decoded messages, for example because of a message with
+// invalid CRC, are skipped.
+func rawProducedMessages(b []byte, req *proto.ProduceReq) rawProduced {
+	raw := make(rawProduced)
+
+	r := &byteReader{b: b}
+	r.next(4 + 2 + 2 + 4) // size, api key, version, correlation ID
+	r.string()            // client ID
+	r.next(2 + 4)         // required acks, timeout
+	ntopics := int(r.int32())
+	for ti := 0; ti < ntopics && ti < len(req.Topics) && r.err == nil; ti++ {
+		topic := req.Topics[ti]
+		r.string()
+		nparts := int(r.int32())
+		for pi := 0; pi < nparts && pi < len(topic.Partitions) && r.err == nil; pi++ {
+			r.int32()
+			set := r.next(int(r.int32()))
+			if r.err != nil {
+				break
+			}
+			entries := splitMessageSet(set)
+			messages := topic.Partitions[pi].Messages
+			switch {
+			case len(entries) == len(messages):
+				for i, msg := range messages {
+					raw[msg] = entries[i]
+				}
+			case len(entries) == 1:
+				for _, msg := range messages {
+					raw[msg] = entries[0]
+				}
+			}
+		}
+	}
+	return raw
+}
+
+// splitMessageSet returns bytes of every message of given message set,
+// starting with the CRC, without the offset and size that precede it. A
+// partial message at the end of the set is ignored.
+func splitMessageSet(set []byte) [][]byte {
+	var entries [][]byte
+	r := &byteReader{b: set}
+	for len(r.b) >= 12 {
+		r.int64() // offset
+		msg := r.next(int(r.int32()))
+		if r.err != nil {
+			break
+		}
+		entries = append(entries, append([]byte(nil), msg...))
+	}
+	return entries
+}
+
+// setRaw retains wire bytes of the message stored at given offset. They are
+// dropped together with the message when the log is trimmed.
+func (p *partitionLog) setRaw(offset int64, b []byte) {
+	if p.raw == nil {
+		p.raw = make(map[int64][]byte)
+	}
+	p.raw[offset] = b
+}
+
+// SetRetainRawMessages controls whether the wire bytes of every produced
+// message are retained, so that they can be compared byte for byte with the
+// encoding expected of a producer, see RawMessageBytes. Only messages
+// produced while enabled are retained.
+func (s *Server) SetRetainRawMessages(retain bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.retainRaw = retain
+}
+
+// RawMessageBytes returns the wire bytes of the message stored at given
+// offset, as sent by the producer, starting with the CRC. Messages of a
+// compressed set return the bytes of the wrapper message holding them. It
+// returns nil if the bytes were not retained, see SetRetainRawMessages, or if
+// the message is no longer stored.
+func (s *Server) RawMessageBytes(topic string, partition int32, offset int64) []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	plog, ok := s.topics[topic][partition]
+	if !ok {
+		return nil
+	}
+	b, ok := plog.raw[offset]
+	if !ok {
+		return nil
+	}
+	// copy, so that the retained bytes cannot be modified by the caller
+	return append([]byte(nil), b...)
+}
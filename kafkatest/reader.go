@@ -0,0 +1,57 @@
+package kafkatest
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errShortRead = errors.New("unexpected end of data")
+
+// byteReader reads big endian fields of a wire format structure, such as an
+// offset record or a raw request, remembering the first error.
+type byteReader struct {
+	b   []byte
+	err error
+}
+
+func (r *byteReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.b) < n {
+		r.err = errShortRead
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *byteReader) int16() int16 {
+	if b := r.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *byteReader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *byteReader) int64() int64 {
+	if b := r.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (r *byteReader) string() string {
+	size := int(r.int16())
+	if size == -1 {
+		return ""
+	}
+	return string(r.next(size))
+}
@@ -0,0 +1,59 @@
+package kafkatest
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// ScriptedResponse is a response recorded from a broker, see ReplayServer.
+type ScriptedResponse struct {
+	// Kind is the kind of request the response was sent for.
+	Kind int16
+
+	// Response is the raw response, starting with the message size.
+	// Correlation ID is replaced with the one of the request it answers.
+	Response []byte
+}
+
+// replayScript holds scripted responses not yet sent, by request kind.
+type replayScript struct {
+	mu        sync.Mutex
+	responses map[int16][][]byte
+}
+
+// next returns the next scripted response to request of given kind, with the
+// correlation ID of the request, or false if the script is exhausted.
+func (r *replayScript) next(kind int16, req []byte) (RawResponse, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	queue := r.responses[kind]
+	if len(queue) == 0 {
+		return nil, false
+	}
+	r.responses[kind] = queue[1:]
+
+	resp := append(RawResponse{}, queue[0]...)
+	if len(resp) >= 8 {
+		binary.BigEndian.PutUint32(resp[4:], uint32(correlationID(req)))
+	}
+	return resp, true
+}
+
+// ReplayServer returns a server that answers requests with responses from
+// given script instead of handling them. The n-th request of a kind is
+// answered with the n-th scripted response of that kind, no matter what the
+// request contains or which connection it was sent over. Once responses of a
+// kind are used up, connections sending requests of that kind are closed.
+// This allows reproducing a session with a real broker exactly, including
+// malformed responses. The server has to be started as any other.
+func ReplayServer(script []ScriptedResponse) *Server {
+	replay := &replayScript{responses: make(map[int16][][]byte)}
+	for _, r := range script {
+		replay.responses[r.Kind] = append(replay.responses[r.Kind], r.Response)
+	}
+
+	s := NewServer()
+	s.replay = replay
+	return s
+}
@@ -0,0 +1,114 @@
+package kafkatest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/dropbox/kafka/proto"
+)
+
+// requestLogEntry describes single request handled by the server, together
+// with the response that was written back.
+type requestLogEntry struct {
+	Time          time.Time `json:"time"`
+	NodeID        int32     `json:"node_id"`
+	Kind          int16     `json:"kind"`
+	CorrelationID int32     `json:"correlation_id"`
+	ClientID      string    `json:"client_id"`
+	Request       string    `json:"request"`
+	Response      []byte    `json:"response"`
+}
+
+// requestLog is a record of all requests handled by the server, see
+// EnableRequestLog.
+type requestLog struct {
+	mu      sync.Mutex
+	entries []requestLogEntry
+}
+
+func (l *requestLog) add(nodeID int32, kind int16, req, resp []byte) {
+	entry := requestLogEntry{
+		Time:          time.Now(),
+		NodeID:        nodeID,
+		Kind:          kind,
+		CorrelationID: correlationID(req),
+		ClientID:      clientID(req),
+		Request:       requestSummary(kind, req),
+		Response:      resp,
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, entry)
+}
+
+// requestSummary returns human readable description of the request.
+func requestSummary(kind int16, b []byte) string {
+	var req interface{}
+	var err error
+
+	buf := bytes.NewBuffer(b)
+	switch kind {
+	case proto.ProduceReqKind:
+		req, err = proto.ReadProduceReq(buf)
+	case proto.FetchReqKind:
+		req, err = proto.ReadFetchReq(buf)
+	case proto.OffsetReqKind:
+		req, err = proto.ReadOffsetReq(buf)
+	case proto.MetadataReqKind:
+		req, err = proto.ReadMetadataReq(buf)
+	case proto.OffsetCommitReqKind:
+		req, err = proto.ReadOffsetCommitReq(buf)
+	case proto.OffsetFetchReqKind:
+		req, err = proto.ReadOffsetFetchReq(buf)
+	case proto.GroupCoordinatorReqKind:
+		req, err = proto.ReadGroupCoordinatorReq(buf)
+	case proto.DescribeConfigsReqKind:
+		req, err = proto.ReadDescribeConfigsReq(buf)
+	case proto.AlterConfigsReqKind:
+		req, err = proto.ReadAlterConfigsReq(buf)
+	case proto.DeleteGroupsReqKind:
+		req, err = proto.ReadDeleteGroupsReq(buf)
+	default:
+		return fmt.Sprintf("unknown request kind %d", kind)
+	}
+	if err != nil {
+		return fmt.Sprintf("malformed request: %s", err)
+	}
+	return fmt.Sprintf("%+v", req)
+}
+
+// EnableRequestLog makes the server record every handled request together
+// with the response, so that the traffic can be inspected with DumpRequestLog
+// after a test failure. Recording is disabled by default, as all requests and
+// responses are kept in memory.
+func (s *Server) EnableRequestLog() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.requestLog == nil {
+		s.requestLog = &requestLog{}
+	}
+}
+
+// DumpRequestLog writes all recorded requests to given writer as JSON list.
+// Each entry contains the request kind, correlation ID, client ID, decoded
+// request description and raw bytes of the response. Nothing is recorded
+// unless EnableRequestLog was called.
+func (s *Server) DumpRequestLog(w io.Writer) error {
+	s.mu.RLock()
+	rlog := s.requestLog
+	s.mu.RUnlock()
+
+	entries := []requestLogEntry{}
+	if rlog != nil {
+		rlog.mu.Lock()
+		entries = append(entries, rlog.entries...)
+		rlog.mu.Unlock()
+	}
+	return json.NewEncoder(w).Encode(entries)
+}
@@ -1,15 +1,24 @@
 package kafkatest
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dropbox/kafka/proto"
 )
@@ -19,16 +28,329 @@ type topicOffset struct {
 	metadata string
 }
 
+// commitEvent describes offset stored by an offset commit request or by an
+// offset record produced to __consumer_offsets.
+type commitEvent struct {
+	group     string
+	topic     string
+	partition int32
+	offset    int64
+	metadata  string
+}
+
+// partitionLog holds messages of a single partition. Offset of the first
+// stored message is the log start offset, so that messages that were trimmed
+// or never loaded are no longer available for fetching.
+type partitionLog struct {
+	startOffset int64
+	messages    []*proto.Message
+
+	// wire bytes of produced messages by offset, see SetRetainRawMessages
+	raw map[int64][]byte
+}
+
+// nextOffset returns offset that the next appended message will get.
+func (p *partitionLog) nextOffset() int64 {
+	return p.startOffset + int64(len(p.messages))
+}
+
+// trim removes the oldest messages so that at most limit messages are kept,
+// advancing the log start offset. Zero limit means no limit.
+func (p *partitionLog) trim(limit int) {
+	if limit <= 0 || len(p.messages) <= limit {
+		return
+	}
+	drop := len(p.messages) - limit
+	for offset := p.startOffset; offset < p.startOffset+int64(drop); offset++ {
+		delete(p.raw, offset)
+	}
+	p.startOffset += int64(drop)
+	// Reslice in place. The backing array is compacted once append runs out
+	// of its capacity and copies only the kept messages, releasing the
+	// dropped ones. Dropped entries are not cleared, because fetch responses
+	// being sent may still refer to them.
+	p.messages = p.messages[drop:]
+}
+
 // Server is container for fake kafka server data.
 type Server struct {
 	mu          *sync.RWMutex
+	nodeID      int32
 	brokers     []proto.MetadataRespBroker
-	topics      map[string]map[int32][]*proto.Message
+	topics      map[string]map[int32]*partitionLog
+	configs     map[string]map[string]string
+	configKeys  map[string]bool
+	corrupt     map[string]map[int32]map[int64]bool
 	offsets     map[string]map[int32]map[string]*topicOffset
 	ln          net.Listener
+	conns       map[net.Conn]struct{}
 	middlewares []Middleware
 	started     bool
 	stopped     bool
+
+	// done is closed by Close, to interrupt injected delays
+	done chan struct{}
+
+	// fetchCond is signaled whenever new messages are stored or the state is
+	// reset, to wake up long polling fetch requests
+	fetchCond *sync.Cond
+	resetGen  int
+
+	// parkedFetches is the number of fetch requests waiting for data,
+	// updated atomically as it changes with the read lock held
+	parkedFetches int32
+
+	// commitCond is signaled whenever offsets are committed
+	commitCond *sync.Cond
+
+	// metadata versioning, see SetMetadataVersion
+	versionedMetadata bool
+	metadataVersion   int
+	topicVersions     map[string]int
+
+	// topics that can be auto created, see SetAutoCreatePattern
+	autoCreate *regexp.Regexp
+
+	// keyValidator checks produced messages, see SetKeyPartitionValidator
+	keyValidator func(key []byte, partition int32) error
+
+	// paused topics, see PauseTopic
+	paused      map[string]bool
+	pauseBlocks bool
+
+	// fetch requests never get a response, see SetFetchHang
+	fetchHang bool
+
+	// operations denied on topics, see DenyTopic
+	denied map[string]map[Operation]bool
+
+	// errors returned by the next offset commit of a group, see
+	// FailNextCommit
+	commitFailures map[string]error
+
+	// maxOffsetMetadata is the maximum size of committed offset metadata,
+	// zero means no limit, see SetMaxOffsetMetadataBytes
+	maxOffsetMetadata int
+
+	// validateCommits, see SetValidateCommitTargets
+	validateCommits bool
+
+	// replicationDelay, see SetReplicationDelay
+	replicationDelay time.Duration
+
+	// denyInternalWrites, see SetAllowInternalTopicWrites
+	denyInternalWrites bool
+
+	// strictTopicNames, see SetTopicNameValidation
+	strictTopicNames bool
+
+	// notLeader, see SetNotLeaderForAll
+	notLeader bool
+
+	// deduplication of produced messages by topic, see SetDedupByKey
+	dedup map[string]*dedupWindow
+
+	// partitions whose next produce is not acknowledged, see
+	// DropNextProduceAck
+	dropAcks map[string]map[int32]bool
+
+	// errors returned by produce requests, see FailProduceWith
+	produceFailures map[string]map[int32]produceFailure
+
+	// coordinatorID is the node ID of the group coordinator, -1 means that
+	// every node is the coordinator, see SetCoordinator
+	coordinatorID int32
+
+	// no coordinator is available yet, see SetCoordinatorElection
+	coordinatorElection bool
+
+	// retentionLimit is the maximum number of messages kept in a partition,
+	// see SetRetentionLimit
+	retentionLimit int
+
+	// maxRecordsPerFetch, see SetMaxRecordsPerFetch
+	maxRecordsPerFetch int
+
+	// maxRequestBytes, see SetMaxRequestBytes
+	maxRequestBytes int
+
+	// idle server shutdown, see SetIdleTimeout
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+
+	// acceptDelay, see SetAcceptDelay
+	acceptDelay time.Duration
+
+	// end of the simulated restart window, see SetUnavailable
+	unavailableUntil time.Time
+
+	// messageFormat is used to encode fetched messages
+	messageFormat int8
+
+	// hideBrokers, see SetAdvertiseBrokers
+	hideBrokers bool
+
+	// clusterID is advertised in metadata responses since v2
+	clusterID string
+
+	// nodes are IDs of all brokers if the server is serving a cluster, see
+	// NewCluster. Empty for a single broker.
+	nodes []int32
+
+	// brokers cut off from the rest of the cluster, see Cluster.Isolate
+	isolated map[int32]bool
+
+	// response delays by request kind, see SetLatencyDistribution
+	latencies map[int16]latency
+	rnd       *rand.Rand
+
+	// connection specific metadata, see SetMetadataForConnection
+	connMetadata []connMetadata
+
+	// replicas removed from the in sync replica set, see ShrinkISR
+	outOfSync map[string]map[int32]map[int32]bool
+
+	// partitions without leader, see SetPartitionOffline
+	offline map[string]map[int32]bool
+
+	// reported high water marks, see SetHighWaterMark
+	highWaterMarks map[string]map[int32]int64
+
+	// follower replicas clients should fetch from, see
+	// SetPreferredReadReplica
+	readReplicas map[string]map[int32]int32
+
+	// aborted transactions reported by fetch, see SetAbortedTransactions
+	abortedTxns map[string]map[int32][]AbortedTxn
+
+	// retain wire bytes of produced messages, see SetRetainRawMessages
+	retainRaw bool
+
+	// partition leader epochs, see BumpLeaderEpoch
+	leaderEpochs map[string]map[int32]int32
+
+	// replicas per partition reported by metadata, see SetReplicationFactor
+	replicationFactors map[string]int
+
+	// metadata partition errors, see SetMetadataPartitionError
+	metadataErrors map[string]map[int32]error
+
+	// offset fetch errors, see SetOffsetFetchError and SetOffsetsLoading
+	offsetFetchErrors map[string]map[int32]error
+	offsetsLoading    bool
+
+	onHandlerPanic func(kind int16, b []byte, recovered interface{})
+
+	// onCommit is called for every committed offset, see OnCommit
+	onCommit func(group, topic string, partition int32, offset int64, metadata string)
+
+	// rejectDuplicateCorrelation, see SetRejectDuplicateCorrelation
+	rejectDuplicateCorrelation bool
+
+	// supportedAPIs are request kinds handled by the server, nil means all,
+	// see SetSupportedAPIs
+	supportedAPIs map[int16]bool
+
+	// expected request kinds, nil means all, and kinds of unexpected
+	// requests received, see ExpectOnly
+	expected   map[int16]bool
+	violations []int16
+
+	// requestLog is nil unless enabled by EnableRequestLog
+	requestLog *requestLog
+
+	// stats counts received requests, see Stats
+	stats *requestStats
+
+	// trace is nil unless enabled by SetTraceWriter
+	trace *tracer
+
+	// correlationMode, see SetCorrelationEcho
+	correlationMode CorrelationMode
+
+	// replay is the script answering all requests, see ReplayServer
+	replay *replayScript
+
+	logMu *sync.Mutex
+	log   Logger
+}
+
+// produceFailure is an error returned for produce requests to a partition.
+type produceFailure struct {
+	err    *proto.KafkaError
+	sticky bool
+}
+
+// dedupWindow remembers when messages with given key were stored, so that
+// duplicates produced within the window can be dropped.
+type dedupWindow struct {
+	window time.Duration
+	stored map[string]time.Time
+}
+
+// filter returns messages that are not duplicates of a message stored within
+// the window, remembering the keys of returned messages.
+func (d *dedupWindow) filter(messages []*proto.Message, now time.Time) []*proto.Message {
+	kept := make([]*proto.Message, 0, len(messages))
+	for _, msg := range messages {
+		if msg.Key != nil {
+			if t, ok := d.stored[string(msg.Key)]; ok && now.Sub(t) < d.window {
+				continue
+			}
+			d.stored[string(msg.Key)] = now
+		}
+		kept = append(kept, msg)
+	}
+	return kept
+}
+
+// latency is normal distribution of response delays.
+type latency struct {
+	mean   time.Duration
+	stddev time.Duration
+}
+
+// CorrelationMode selects correlation IDs of responses sent by the server,
+// see SetCorrelationEcho.
+type CorrelationMode struct {
+	kind  int
+	fixed int32
+}
+
+const (
+	correlationEcho = iota
+	correlationIncrement
+	correlationFixed
+)
+
+var (
+	// CorrelationEcho makes responses carry correlation ID of the request
+	// they answer, as a broker does.
+	CorrelationEcho = CorrelationMode{kind: correlationEcho}
+
+	// CorrelationIncrement makes responses carry increasing correlation IDs
+	// assigned by the server, starting with 1 for every connection.
+	CorrelationIncrement = CorrelationMode{kind: correlationIncrement}
+)
+
+// CorrelationFixed returns mode that makes all responses carry given
+// correlation ID.
+func CorrelationFixed(id int32) CorrelationMode {
+	return CorrelationMode{kind: correlationFixed, fixed: id}
+}
+
+// connMetadata is metadata response served to connections accepted by the
+// matcher.
+type connMetadata struct {
+	match func(conn net.Conn) bool
+	resp  *proto.MetadataResp
+}
+
+// Logger is the interface used by Server for logging. It is satisfied by
+// *logging.Logger used by the rest of the package.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
 }
 
 // Middleware is function that is called for every incomming kafka message,
@@ -41,6 +363,17 @@ type Response interface {
 	Bytes() ([]byte, error)
 }
 
+// RawResponse is a Response that is written to the client verbatim. The
+// bytes must include the message size and correlation ID, but nothing is
+// validated, which allows a middleware to send malformed data, such as a
+// response with wrong size prefix, to test the client decoder.
+type RawResponse []byte
+
+// Bytes returns the response bytes as they are.
+func (r RawResponse) Bytes() ([]byte, error) {
+	return r, nil
+}
+
 // NewServer return new mock server instance. Any number of middlewares can be
 // passed to customize request handling. For every incomming request, all
 // middlewares are called one after another in order they were passed. If any
@@ -49,13 +382,1219 @@ type Response interface {
 // other middleware is called nor the default handler is executed.
 func NewServer(middlewares ...Middleware) *Server {
 	s := &Server{
-		brokers:     make([]proto.MetadataRespBroker, 0),
-		topics:      make(map[string]map[int32][]*proto.Message),
-		offsets:     make(map[string]map[int32]map[string]*topicOffset),
-		middlewares: middlewares,
-		mu:          &sync.RWMutex{},
+		brokers:            make([]proto.MetadataRespBroker, 0),
+		topics:             make(map[string]map[int32]*partitionLog),
+		configs:            make(map[string]map[string]string),
+		corrupt:            make(map[string]map[int32]map[int64]bool),
+		offsets:            make(map[string]map[int32]map[string]*topicOffset),
+		topicVersions:      make(map[string]int),
+		conns:              make(map[net.Conn]struct{}),
+		done:               make(chan struct{}),
+		paused:             make(map[string]bool),
+		denied:             make(map[string]map[Operation]bool),
+		commitFailures:     make(map[string]error),
+		dropAcks:           make(map[string]map[int32]bool),
+		produceFailures:    make(map[string]map[int32]produceFailure),
+		dedup:              make(map[string]*dedupWindow),
+		metadataErrors:     make(map[string]map[int32]error),
+		replicationFactors: make(map[string]int),
+		leaderEpochs:       make(map[string]map[int32]int32),
+		outOfSync:          make(map[string]map[int32]map[int32]bool),
+		offline:            make(map[string]map[int32]bool),
+		highWaterMarks:     make(map[string]map[int32]int64),
+		readReplicas:       make(map[string]map[int32]int32),
+		abortedTxns:        make(map[string]map[int32][]AbortedTxn),
+		isolated:           make(map[int32]bool),
+		latencies:          make(map[int16]latency),
+		rnd:                rand.New(rand.NewSource(time.Now().UnixNano())),
+		offsetFetchErrors:  make(map[string]map[int32]error),
+		stats:              newRequestStats(),
+		middlewares:        middlewares,
+		mu:                 &sync.RWMutex{},
+		logMu:              &sync.Mutex{},
+		nodeID:             100,
+		coordinatorID:      -1,
+	}
+	s.fetchCond = sync.NewCond(s.mu.RLocker())
+	s.commitCond = sync.NewCond(s.mu.RLocker())
+	return s
+}
+
+// SetLogger sets the logger used by the server instance, which allows
+// capturing or silencing logs of a single server. By default the package
+// logger is used.
+func (s *Server) SetLogger(l Logger) {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+
+	s.log = l
+}
+
+// logger returns the logger the server should use. Logging has its own lock,
+// so it is safe to log whether the server lock is held or not.
+func (s *Server) logger() Logger {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+
+	if s.log != nil {
+		return s.log
+	}
+	return log
+}
+
+// SetNodeID sets the node ID the server advertises in metadata and
+// coordinator responses. By default node ID 100 is used. It must be called
+// before the server is started.
+func (s *Server) SetNodeID(nodeID int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.started {
+		panic("cannot change node ID of a started server")
+	}
+	s.nodeID = nodeID
+}
+
+// OnHandlerPanic sets a callback that is called whenever handling a request
+// panics, which usually means the request was malformed. The connection that
+// sent the request is closed after the callback returns.
+func (s *Server) OnHandlerPanic(fn func(kind int16, b []byte, recovered interface{})) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.onHandlerPanic = fn
+}
+
+// OnCommit sets a callback that is called for every partition offset
+// successfully committed by an offset commit request, in the order of the
+// request, or by producing an offset record to __consumer_offsets. Deleted
+// offsets are not reported. It is called after the offsets are stored and
+// without the server lock held, so it can use the server, but before the
+// response is sent.
+func (s *Server) OnCommit(fn func(group, topic string, partition int32, offset int64, metadata string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.onCommit = fn
+}
+
+// notifyCommitted calls the OnCommit callback, if set, for every given stored
+// offset. It must be called without the lock held.
+func (s *Server) notifyCommitted(committed []commitEvent) {
+	s.mu.RLock()
+	onCommit := s.onCommit
+	s.mu.RUnlock()
+	if onCommit == nil {
+		return
+	}
+	for _, e := range committed {
+		onCommit(e.group, e.topic, e.partition, e.offset, e.metadata)
+	}
+}
+
+// SetMetadataVersion sets the version of metadata served by the server.
+// Once called, topics created afterwards are stamped with the next version
+// and are not visible in metadata responses until the served version is
+// bumped to at least that value. This models the delay between creating a
+// topic and propagating its metadata through a real cluster.
+func (s *Server) SetMetadataVersion(v int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.versionedMetadata = true
+	s.metadataVersion = v
+}
+
+// PauseTopic makes the topic unavailable for producing and fetching until
+// ResumeTopic is called. By default requests for a paused topic fail with
+// ErrLeaderNotAvailable, which models a partition leader election in
+// progress. See SetPauseBlocking to hold the requests instead.
+func (s *Server) PauseTopic(topic string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.paused[topic] = true
+	s.fetchCond.Broadcast()
+}
+
+// ResumeTopic makes paused topic available again. Requests blocked on the
+// topic are resumed.
+func (s *Server) ResumeTopic(topic string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.paused, topic)
+	s.fetchCond.Broadcast()
+}
+
+// Operation is a kind of access to a topic, see DenyTopic.
+type Operation int
+
+const (
+	// OperationRead is fetching messages from a topic.
+	OperationRead Operation = iota + 1
+	// OperationWrite is producing messages to a topic.
+	OperationWrite
+)
+
+// DenyTopic denies given operations on the topic, as if ACLs did not allow
+// the client to access it. Denied produce and fetch requests fail with
+// ErrAuthorizationFailed (topic authorization failed), while metadata still
+// lists the topic. Without operations, both reading and writing is denied.
+func (s *Server) DenyTopic(topic string, ops ...Operation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(ops) == 0 {
+		ops = []Operation{OperationRead, OperationWrite}
+	}
+	if _, ok := s.denied[topic]; !ok {
+		s.denied[topic] = make(map[Operation]bool)
+	}
+	for _, op := range ops {
+		s.denied[topic][op] = true
+	}
+	s.fetchCond.Broadcast()
+}
+
+// AllowTopic removes all operations on the topic denied by DenyTopic.
+func (s *Server) AllowTopic(topic string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.denied, topic)
+}
+
+// SetPauseBlocking configures how requests for paused topics are handled. If
+// block is true, produce and fetch requests wait until all topics they refer
+// to are resumed instead of failing with ErrLeaderNotAvailable.
+func (s *Server) SetPauseBlocking(block bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pauseBlocks = block
+	s.fetchCond.Broadcast()
+}
+
+// SetFetchHang makes fetch requests block without ever getting a response,
+// simulating a stuck broker, so that clients relying on request timeouts can
+// be tested. Blocked requests are released when hanging is disabled, or when
+// the server is closed, in which case their connections are closed without a
+// response.
+func (s *Server) SetFetchHang(hang bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fetchHang = hang
+	s.fetchCond.Broadcast()
+}
+
+// waitUnhung blocks while fetch requests are configured to hang. It returns
+// false if the server was closed in the meantime. It must be called without
+// the lock held.
+func (s *Server) waitUnhung() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for s.fetchHang && !s.stopped {
+		s.fetchCond.Wait()
+	}
+	return !s.stopped
+}
+
+// waitUnpaused blocks until none of given topics is paused, if the server is
+// configured to block on paused topics. It returns false if the server was
+// closed in the meantime. It must be called without the lock held.
+func (s *Server) waitUnpaused(topics []string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for s.pauseBlocks && s.anyPaused(topics) && !s.stopped {
+		s.fetchCond.Wait()
+	}
+	return !s.stopped
+}
+
+// anyPaused returns true if any of given topics is paused. It must be called
+// with the lock held.
+func (s *Server) anyPaused(topics []string) bool {
+	for _, name := range topics {
+		if s.paused[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// FailNextCommit makes the next offset commit request of given consumer group
+// fail with given error for every partition. Offsets of the failed request are
+// not stored. Only the next request fails, any following commit is handled as
+// usual.
+func (s *Server) FailNextCommit(group string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.commitFailures[group] = err
+}
+
+// SetMaxOffsetMetadataBytes limits the size of metadata that can be committed
+// together with an offset, like offset.metadata.max.bytes broker setting.
+// Commits of partitions with bigger metadata fail with
+// ErrOffsetMetadataTooLarge and are not stored. Zero means no limit, which is
+// the default.
+func (s *Server) SetMaxOffsetMetadataBytes(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxOffsetMetadata = n
+}
+
+// SetReplicationDelay delays responses to produce requests that require
+// acknowledgement of all replicas by given duration, which models the time it
+// takes to replicate messages to all in sync replicas. Messages are stored,
+// and can be fetched, right away. If the delay exceeds the timeout of the
+// request, the response is sent when the timeout passes, with
+// ErrRequestTimeout. Zero disables the delay, which is the default.
+func (s *Server) SetReplicationDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.replicationDelay = d
+}
+
+// SetDedupByKey makes produce requests to given topic store only the first of
+// messages with the same key produced within the window. Duplicates are
+// dropped, but the produce request still succeeds. Messages without key are
+// always stored. Zero window disables the deduplication, which is the
+// default.
+func (s *Server) SetDedupByKey(topic string, window time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if window <= 0 {
+		delete(s.dedup, topic)
+		return
+	}
+	s.dedup[topic] = &dedupWindow{window: window, stored: make(map[string]time.Time)}
+}
+
+// SetValidateCommitTargets controls whether offset commits to topics or
+// partitions that do not exist are rejected with ErrUnknownTopicOrPartition,
+// as a broker does. By default offsets of any partition are accepted.
+func (s *Server) SetValidateCommitTargets(validate bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.validateCommits = validate
+}
+
+// FailProduceWith makes produce requests to given topic/partition fail with
+// given Kafka error, such as ErrKafkaStorageError, without storing the
+// messages. If sticky is false, only the next request fails, otherwise all
+// requests fail until the failure is removed by passing nil error.
+func (s *Server) FailProduceWith(topic string, partition int32, err *proto.KafkaError, sticky bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err == nil {
+		delete(s.produceFailures[topic], partition)
+		return
+	}
+	if _, ok := s.produceFailures[topic]; !ok {
+		s.produceFailures[topic] = make(map[int32]produceFailure)
+	}
+	s.produceFailures[topic][partition] = produceFailure{err: err, sticky: sticky}
+}
+
+// DropNextProduceAck makes the next produce request that stores messages in
+// given topic/partition lose its acknowledgement: messages are stored, but no
+// response is sent and the connection is closed instead. A client retrying the
+// request stores the messages again, which is the canonical way of getting
+// duplicates with at least once delivery. Only the next request is affected.
+func (s *Server) DropNextProduceAck(topic string, partition int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.dropAcks[topic]; !ok {
+		s.dropAcks[topic] = make(map[int32]bool)
+	}
+	s.dropAcks[topic][partition] = true
+}
+
+// SetMetadataPartitionError sets the error reported for given partition in
+// metadata responses. The partition is described as usual, including its
+// leader, so this is mostly useful for non fatal errors such as
+// ErrReplicaNotAvailable. Pass nil error to remove the override.
+func (s *Server) SetMetadataPartitionError(topic string, partition int32, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err == nil {
+		delete(s.metadataErrors[topic], partition)
+		return
+	}
+	if _, ok := s.metadataErrors[topic]; !ok {
+		s.metadataErrors[topic] = make(map[int32]error)
+	}
+	s.metadataErrors[topic][partition] = err
+}
+
+// SetReplicationFactor makes metadata responses list given number of replicas
+// for every partition of given topic, chosen by cycling through the registered
+// brokers, including those added with AddBroker. The leader is always the
+// first replica. The factor is limited to the number of registered brokers.
+// Zero restores the default of replicating partitions to all cluster nodes, or
+// to the serving broker only.
+func (s *Server) SetReplicationFactor(topic string, rf int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rf <= 0 {
+		delete(s.replicationFactors, topic)
+		return
+	}
+	s.replicationFactors[topic] = rf
+}
+
+// replicas returns replicas of given partition led by given leader, as seen
+// by given node. It must be called with the lock held.
+func (s *Server) replicas(topic string, partition int32, leader int32, nodeID int32) []int32 {
+	rf, ok := s.replicationFactors[topic]
+	if !ok || len(s.brokers) == 0 {
+		if len(s.nodes) != 0 {
+			return s.nodes
+		}
+		return []int32{nodeID}
+	}
+
+	ids := make([]int32, 0, len(s.brokers))
+	for _, broker := range s.brokers {
+		ids = append(ids, broker.NodeID)
+	}
+	if rf > len(ids) {
+		rf = len(ids)
+	}
+
+	// start with the leader, or spread partitions without one over brokers
+	start := int(partition) % len(ids)
+	if start < 0 {
+		start += len(ids)
+	}
+	for i, id := range ids {
+		if id == leader {
+			start = i
+			break
+		}
+	}
+	replicas := make([]int32, 0, rf)
+	for i := 0; i < rf; i++ {
+		replicas = append(replicas, ids[(start+i)%len(ids)])
+	}
+	return replicas
+}
+
+// BumpLeaderEpoch increments the leader epoch of given partition, as if a new
+// leader was elected, and returns the new epoch. Epochs start at zero. The
+// current epoch is reported by metadata responses since version 7, while
+// fetch requests since version 9 carrying an older epoch fail with
+// ErrFencedLeaderEpoch and those carrying a newer one with
+// ErrUnknownLeaderEpoch.
+func (s *Server) BumpLeaderEpoch(topic string, partition int32) int32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.leaderEpochs[topic]; !ok {
+		s.leaderEpochs[topic] = make(map[int32]int32)
+	}
+	s.leaderEpochs[topic][partition]++
+	epoch := s.leaderEpochs[topic][partition]
+	s.logger().Infof("leader epoch of %s:%d bumped to %d", topic, partition, epoch)
+	return epoch
+}
+
+// SetCoordinator sets the node ID returned as group and transaction
+// coordinator. Offset commit and offset fetch requests sent to any other node
+// fail with ErrNotCoordinator, which allows simulating coordinator moving
+// between brokers. By default every node considers itself the coordinator.
+func (s *Server) SetCoordinator(nodeID int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.coordinatorID = nodeID
+}
+
+// SetNotLeaderForAll makes a single server behave as a stale broker that
+// leads no partition. Produce, fetch and offset requests fail with
+// ErrNotLeaderForPartition, while metadata reports the first other broker
+// registered with AddBroker as the leader of all partitions, or no leader if
+// there is none. It has no effect on a cluster, see NewCluster.
+func (s *Server) SetNotLeaderForAll(notLeader bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.notLeader = notLeader
+}
+
+// leader returns the node ID of the leader of given partition, as seen by
+// given node. Partitions are spread over cluster brokers by their IDs, while
+// a single broker leads all of them, unless it was told it is not the leader,
+// see SetNotLeaderForAll. Leadership of isolated brokers moves to the next
+// broker, but isolated brokers consider themselves leaders of all partitions.
+// It must be called with the lock held.
+func (s *Server) leader(partition int32, nodeID int32) int32 {
+	if len(s.nodes) == 0 && s.notLeader {
+		for _, broker := range s.brokers {
+			if broker.NodeID != s.nodeID {
+				return broker.NodeID
+			}
+		}
+		return -1
+	}
+	if len(s.nodes) == 0 || s.isolated[nodeID] {
+		return nodeID
+	}
+	i := int(partition) % len(s.nodes)
+	if i < 0 {
+		i += len(s.nodes)
+	}
+	for range s.nodes {
+		if leader := s.nodes[i]; !s.isolated[leader] {
+			return leader
+		}
+		i = (i + 1) % len(s.nodes)
+	}
+	return nodeID
+}
+
+// isCoordinator returns true if given node is the group coordinator. It must
+// be called with the lock held.
+func (s *Server) isCoordinator(nodeID int32) bool {
+	if s.isolated[nodeID] {
+		return false
+	}
+	return s.coordinatorID == -1 || s.coordinatorID == nodeID
+}
+
+// SetSeed initializes the random source of the server, which makes sampled
+// response delays repeatable. By default current time is used as the seed.
+func (s *Server) SetSeed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rnd = rand.New(rand.NewSource(seed))
+}
+
+// SetLatency delays every response to requests of given kind by given
+// duration. Zero delay removes the latency.
+func (s *Server) SetLatency(reqKind int16, delay time.Duration) {
+	s.SetLatencyDistribution(reqKind, delay, 0)
+}
+
+// SetLatencyDistribution delays responses to requests of given kind by
+// duration sampled for every request from normal distribution with given mean
+// and standard deviation, using the random source initialized by SetSeed.
+// Negative samples are clamped to zero. Requests sent over the same
+// connection are delayed one after another, as they are handled in order.
+// Zero mean and deviation removes the latency.
+func (s *Server) SetLatencyDistribution(reqKind int16, mean, stddev time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if mean == 0 && stddev == 0 {
+		delete(s.latencies, reqKind)
+		return
+	}
+	s.latencies[reqKind] = latency{mean: mean, stddev: stddev}
+}
+
+// sampleLatency returns the delay of the next response to request of given
+// kind.
+func (s *Server) sampleLatency(reqKind int16) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.latencies[reqKind]
+	if !ok {
+		return 0
+	}
+	delay := l.mean + time.Duration(s.rnd.NormFloat64()*float64(l.stddev))
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
+// sleep pauses the current goroutine for given duration. It returns false
+// early if the server is closed in the meantime.
+func (s *Server) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// SetRetentionLimit limits the number of messages kept in every partition.
+// When a partition grows over the limit, the oldest messages are dropped and
+// the log start offset advances, so that fetching them fails with
+// ErrOffsetOutOfRange, as if removed by retention. Zero means no limit, which
+// is the default.
+func (s *Server) SetRetentionLimit(maxMessagesPerPartition int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.retentionLimit = maxMessagesPerPartition
+	for _, parts := range s.topics {
+		for _, plog := range parts {
+			plog.trim(s.retentionLimit)
+		}
+	}
+}
+
+// SetMaxRecordsPerFetch limits the number of messages returned for every
+// partition of a fetch request, regardless of their size, so that tests can
+// get small batches deterministically. The MaxBytes limits of the request
+// still apply. Zero means no limit, which is the default.
+func (s *Server) SetMaxRecordsPerFetch(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxRecordsPerFetch = n
+}
+
+// SetMaxRequestBytes limits the size of requests the server accepts, as
+// socket.request.max.bytes does for a broker. The connection of a client
+// sending a bigger request is closed before the request is read. Zero means
+// no limit, which is the default.
+func (s *Server) SetMaxRequestBytes(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maxRequestBytes = n
+}
+
+// SetIdleTimeout makes the server close itself, as Close does, when no new
+// connection is made and no request is received for given duration, so that
+// a server a test forgot to close does not leak. The idle period starts when
+// the timeout is set. Zero disables the timeout, which is the default.
+func (s *Server) SetIdleTimeout(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+		s.idleTimer = nil
+	}
+	s.idleTimeout = d
+	if d > 0 {
+		s.idleTimer = time.AfterFunc(d, func() {
+			s.logger().Infof("no activity for %s, closing server", d)
+			_ = s.Close()
+		})
+	}
+}
+
+// SetAcceptDelay makes the server wait given duration after accepting every
+// connection, before it starts reading requests, simulating a broker that is
+// slow to accept connections. Connections are handed off one by one, so the
+// delays of concurrently opened connections add up. The TCP handshake itself
+// is completed by the operating system, so clients observe the delay while
+// waiting for the response to their first request. Zero disables the delay.
+func (s *Server) SetAcceptDelay(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.acceptDelay = d
+}
+
+// delayAccept sleeps for the accept delay, if set.
+func (s *Server) delayAccept() {
+	s.mu.RLock()
+	d := s.acceptDelay
+	s.mu.RUnlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// touch restarts the idle timeout, if set, because the server is in use.
+func (s *Server) touch() {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.idleTimer != nil {
+		s.idleTimer.Reset(s.idleTimeout)
+	}
+}
+
+// SetMessageFormat sets the message format fetched messages are encoded with.
+// Message format v0 carries no timestamps, while v1 adds message timestamps.
+// Message format v2 (record batches) is not supported by the proto package and
+// setting it, or any other unknown version, panics.
+func (s *Server) SetMessageFormat(version int) {
+	if version != proto.MessageFormatV0 && version != proto.MessageFormatV1 {
+		panic(fmt.Sprintf("unsupported message format %d", version))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.messageFormat = int8(version)
+}
+
+// SetAdvertiseBrokers controls whether metadata responses list the brokers.
+// If advertise is false, the broker list is empty, even though the server is
+// running, which allows testing clients that cannot find partition leaders.
+// Brokers are advertised by default.
+func (s *Server) SetAdvertiseBrokers(advertise bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hideBrokers = !advertise
+}
+
+// AddBroker makes metadata responses advertise another broker, such as a
+// server running elsewhere, in addition to the brokers served by this server.
+// Rack of the broker can be given as well; it is sent to clients using
+// metadata protocol version 1 or higher. If a broker with the same node ID is
+// already advertised, it is replaced.
+func (s *Server) AddBroker(nodeID int32, host string, port int32, rack ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	broker := proto.MetadataRespBroker{
+		NodeID: nodeID,
+		Host:   host,
+		Port:   port,
+	}
+	if len(rack) > 0 {
+		broker.Rack = rack[0]
+	}
+	for i, b := range s.brokers {
+		if b.NodeID == nodeID {
+			s.brokers[i] = broker
+			return
+		}
+	}
+	s.brokers = append(s.brokers, broker)
+}
+
+// SetRack sets the rack of an advertised broker, which allows setting rack of
+// brokers served by this server once they are running. Unknown node IDs are
+// ignored.
+func (s *Server) SetRack(nodeID int32, rack string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.brokers {
+		if s.brokers[i].NodeID == nodeID {
+			s.brokers[i].Rack = rack
+		}
+	}
+}
+
+// SetClusterID sets the cluster ID returned in metadata responses to clients
+// using metadata protocol version 2 or higher. By default no cluster ID is
+// set.
+func (s *Server) SetClusterID(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clusterID = id
+}
+
+// SetMetadataForConnection makes the server answer metadata requests sent
+// over connections accepted by match with given response instead of metadata
+// describing the server state. Correlation ID of the response is set to match
+// the request. If several matchers accept the connection, the one set first
+// wins. Matching on the remote address of the connection allows serving
+// different metadata to different clients, which models brokers of a cluster
+// that temporarily disagree about the cluster state.
+func (s *Server) SetMetadataForConnection(match func(conn net.Conn) bool, resp *proto.MetadataResp) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.connMetadata = append(s.connMetadata, connMetadata{match: match, resp: resp})
+}
+
+// ClearMetadataForConnections removes all metadata responses set with
+// SetMetadataForConnection.
+func (s *Server) ClearMetadataForConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.connMetadata = nil
+}
+
+// ShrinkISR removes given node from the in sync replicas of given partition.
+// The node is no longer listed as in sync replica in metadata responses and
+// fetch requests for the partition sent to that node fail with
+// ErrReplicaNotAvailable, as if the replica fell behind the leader.
+func (s *Server) ShrinkISR(topic string, partition int32, removeNode int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.outOfSync[topic]; !ok {
+		s.outOfSync[topic] = make(map[int32]map[int32]bool)
+	}
+	if _, ok := s.outOfSync[topic][partition]; !ok {
+		s.outOfSync[topic][partition] = make(map[int32]bool)
+	}
+	s.outOfSync[topic][partition][removeNode] = true
+	s.fetchCond.Broadcast()
+}
+
+// RestoreISR adds all nodes removed by ShrinkISR back to the in sync replicas
+// of given partition.
+func (s *Server) RestoreISR(topic string, partition int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.outOfSync[topic], partition)
+}
+
+// SetHighWaterMark overrides the high water mark reported by fetch responses
+// for given partition. A high water mark ahead of the stored messages makes a
+// consumer that fetched all of them see a lag, as if more data existed. Stored
+// messages at or above the high water mark are not returned, as they are not
+// committed yet.
+func (s *Server) SetHighWaterMark(topic string, partition int32, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.highWaterMarks[topic]; !ok {
+		s.highWaterMarks[topic] = make(map[int32]int64)
+	}
+	s.highWaterMarks[topic][partition] = offset
+	s.fetchCond.Broadcast()
+}
+
+// SetPreferredReadReplica makes the leader of given partition steer clients
+// to fetch from given node instead, as a broker selecting the closest replica
+// does. Fetch requests of version 11 and newer sent to the leader return no
+// messages, but PreferredReadReplica set to the node, which serves fetch
+// requests for the partition as if it was the leader. Node ID -1 restores
+// fetching from the leader.
+func (s *Server) SetPreferredReadReplica(topic string, partition int32, nodeID int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if nodeID == -1 {
+		delete(s.readReplicas[topic], partition)
+		return
+	}
+	if _, ok := s.readReplicas[topic]; !ok {
+		s.readReplicas[topic] = make(map[int32]int32)
+	}
+	s.readReplicas[topic][partition] = nodeID
+	s.fetchCond.Broadcast()
+}
+
+// AbortedTxn describes a transaction aborted by a producer, see
+// SetAbortedTransactions.
+type AbortedTxn struct {
+	ProducerID  int64
+	FirstOffset int64
+}
+
+// SetAbortedTransactions makes fetch responses for given partition list given
+// aborted transactions, so that parsing and filtering of aborted transactions
+// by read committed consumers can be tested without transaction support.
+// Transactions are sent only to clients using fetch version 4 or newer. Nil
+// list removes the transactions.
+func (s *Server) SetAbortedTransactions(topic string, partition int32, aborted []AbortedTxn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if aborted == nil {
+		delete(s.abortedTxns[topic], partition)
+		return
+	}
+	if _, ok := s.abortedTxns[topic]; !ok {
+		s.abortedTxns[topic] = make(map[int32][]AbortedTxn)
+	}
+	s.abortedTxns[topic][partition] = append([]AbortedTxn(nil), aborted...)
+}
+
+// SetPartitionOffline makes given partition lose its leader. Metadata
+// responses report the partition with no leader and ErrLeaderNotAvailable,
+// and produce and fetch requests for the partition fail with
+// ErrLeaderNotAvailable, while the rest of the topic stays available.
+func (s *Server) SetPartitionOffline(topic string, partition int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.offline[topic]; !ok {
+		s.offline[topic] = make(map[int32]bool)
+	}
+	s.offline[topic][partition] = true
+	s.fetchCond.Broadcast()
+}
+
+// SetPartitionOnline brings given partition taken offline by
+// SetPartitionOffline back.
+func (s *Server) SetPartitionOnline(topic string, partition int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.offline[topic], partition)
+}
+
+// SetOffsetFetchError sets the error returned for given partition in offset
+// fetch responses, no matter which consumer group asks. Pass nil error to
+// remove the override.
+func (s *Server) SetOffsetFetchError(topic string, partition int32, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err == nil {
+		delete(s.offsetFetchErrors[topic], partition)
+		return
+	}
+	if _, ok := s.offsetFetchErrors[topic]; !ok {
+		s.offsetFetchErrors[topic] = make(map[int32]error)
+	}
+	s.offsetFetchErrors[topic][partition] = err
+}
+
+// SetCoordinatorElection makes group coordinator requests fail with
+// ErrNoCoordinator, as a cluster does right after startup, before a
+// coordinator is elected. Clients are expected to retry the lookup until the
+// election is over, which is when it is set to false again.
+func (s *Server) SetCoordinatorElection(electing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.coordinatorElection = electing
+}
+
+// SetOffsetsLoading makes offset fetch requests fail with
+// ErrOffsetLoadInProgress for every partition, as a coordinator does while it
+// is loading committed offsets after a failover.
+func (s *Server) SetOffsetsLoading(loading bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.offsetsLoading = loading
+}
+
+// WaitForCommit blocks until given consumer group commits offset of at least
+// minOffset for given topic/partition, or until the context is done, in which
+// case the context error is returned.
+func (s *Server) WaitForCommit(
+	ctx context.Context, group, topic string, partition int32, minOffset int64) error {
+
+	// wake up the waiter when the context is done, as condition variables
+	// cannot be selected on
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.commitCond.Broadcast()
+			s.mu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for {
+		if toffset, ok := s.offsets[topic][partition][group]; ok && toffset.offset >= minOffset {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.commitCond.Wait()
+	}
+}
+
+const (
+	// timestampTypeConfig is the topic configuration key selecting whether
+	// messages keep the time they were created with ("CreateTime", default)
+	// or the time they were appended to the log ("LogAppendTime").
+	timestampTypeConfig = "message.timestamp.type"
+
+	// cleanupPolicyConfig is the topic configuration key selecting whether
+	// old messages are deleted ("delete", default) or compacted ("compact").
+	cleanupPolicyConfig = "cleanup.policy"
+)
+
+// SetTopicConfig sets configuration value of given topic, as returned by
+// describe configs requests. If topic does not exist, it is being created.
+// Setting "message.timestamp.type" to "LogAppendTime" makes produced messages
+// stamped with the server clock, which is reported in produce responses.
+// Setting "cleanup.policy" to "compact" enables compaction, see
+// EnableCompaction.
+func (s *Server) SetTopicConfig(topic, key, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.setTopicConfig(topic, key, value)
+}
+
+// EnableCompaction makes fetch responses of given topic look as if log
+// compaction has run: only the most recent message of every key is returned,
+// while offsets of the suppressed messages are left as gaps. Messages without
+// key are never suppressed. It is the same as setting "cleanup.policy" topic
+// configuration to "compact". If topic does not exist, it is being created.
+func (s *Server) EnableCompaction(topic string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.setTopicConfig(topic, cleanupPolicyConfig, "compact")
+}
+
+// setTopicConfig sets configuration value of given topic, creating the topic
+// if necessary. It must be called with the lock held.
+func (s *Server) setTopicConfig(topic, key, value string) {
+	if _, ok := s.topics[topic]; !ok {
+		s.createTopic(topic)
+	}
+	if _, ok := s.configs[topic]; !ok {
+		s.configs[topic] = make(map[string]string)
+	}
+	s.configs[topic][key] = value
+}
+
+// SetValidConfigKeys limits configuration keys that can be set with alter
+// configs requests. Requests setting any other key are rejected with
+// ErrInvalidConfig. Calling it without any key allows all keys, which is the
+// default.
+func (s *Server) SetValidConfigKeys(keys ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(keys) == 0 {
+		s.configKeys = nil
+		return
+	}
+	s.configKeys = make(map[string]bool)
+	for _, key := range keys {
+		s.configKeys[key] = true
+	}
+}
+
+// SetKeyPartitionValidator sets a function that is called for every produced
+// message with the message key and the partition it was sent to. If the
+// validator returns an error, the error is logged and the whole batch sent to
+// the partition is rejected with ErrInvalidMessage. This allows asserting that
+// the producer partitioner is consistent, for example that messages with the
+// same key always end up in the same partition. The validator is called with
+// the server lock held and must not call server methods. Pass nil to remove
+// the validator.
+func (s *Server) SetKeyPartitionValidator(fn func(key []byte, partition int32) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keyValidator = fn
+}
+
+// validateKeys returns the first error returned by the key validator for given
+// messages. It must be called with the lock held.
+func (s *Server) validateKeys(partition int32, messages []*proto.Message) error {
+	if s.keyValidator == nil {
+		return nil
+	}
+	for _, msg := range messages {
+		if err := s.keyValidator(msg.Key, partition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetCorrelationEcho sets how correlation IDs of responses are chosen. By
+// default, with CorrelationEcho, the correlation ID of the request is echoed.
+// CorrelationIncrement and CorrelationFixed ignore the request, which breaks
+// the protocol, but proves that a client matches responses to requests by
+// correlation ID rather than by the order of arrival.
+func (s *Server) SetCorrelationEcho(mode CorrelationMode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.correlationMode = mode
+}
+
+// duplicateCorrelationWindow is the number of the most recent requests of a
+// connection whose correlation IDs must not be reused, see
+// SetRejectDuplicateCorrelation. A correlation ID only has to be unique among
+// requests in flight, and clients keep only a few of them per connection, five
+// by default with both the Java client and sarama. The window is well above
+// that to catch clients reusing IDs too early, while it stays small enough not
+// to reject clients whose counter legitimately wrapped around and to keep the
+// bookkeeping per connection cheap.
+const duplicateCorrelationWindow = 128
+
+// SetRejectDuplicateCorrelation makes the server close client connections
+// that reuse a correlation ID of any of the previous 128 requests sent over
+// the same connection. Reused correlation IDs make it impossible to match
+// responses with requests of pipelining clients, which the mock server would
+// otherwise hide. Older IDs may be reused, so that long lived clients can
+// wrap their correlation ID counter.
+func (s *Server) SetRejectDuplicateCorrelation(reject bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.rejectDuplicateCorrelation = reject
+}
+
+// SetSupportedAPIs limits the request kinds the server handles, which allows
+// simulating an old broker. Requests of any other kind are answered with
+// ErrUnsupportedVersion set for every topic and partition they refer to,
+// before any middleware is called. Requests the server cannot build response
+// for make it close the connection, like a broker does for unknown APIs.
+// Calling it without any kind makes all APIs supported, which is the default.
+func (s *Server) SetSupportedAPIs(kinds ...int16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(kinds) == 0 {
+		s.supportedAPIs = nil
+		return
+	}
+	s.supportedAPIs = make(map[int16]bool)
+	for _, kind := range kinds {
+		s.supportedAPIs[kind] = true
+	}
+}
+
+// ExpectOnly declares the request kinds clients are expected to send. Requests
+// of any other kind are still handled as usual, but their kinds are recorded
+// and can be checked with Violations. Calling it again replaces the expected
+// kinds and clears recorded violations; calling it without any kind removes
+// the expectation.
+func (s *Server) ExpectOnly(kinds ...int16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.violations = nil
+	if len(kinds) == 0 {
+		s.expected = nil
+		return
+	}
+	s.expected = make(map[int16]bool)
+	for _, kind := range kinds {
+		s.expected[kind] = true
+	}
+}
+
+// Violations returns kinds of received requests that were not expected, see
+// ExpectOnly, in the order they arrived.
+func (s *Server) Violations() []int16 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]int16(nil), s.violations...)
+}
+
+// SetAutoCreatePattern limits automatic topic creation by produce and
+// metadata requests to topics with names matching given regular expression.
+// Requests for other missing topics fail with ErrUnknownTopicOrPartition.
+// Topics created with AddMessages are not affected. Empty pattern allows
+// creating any topic, which is the default. It panics if the pattern cannot be
+// compiled.
+func (s *Server) SetAutoCreatePattern(pattern string) {
+	var rx *regexp.Regexp
+	if pattern != "" {
+		rx = regexp.MustCompile(pattern)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.autoCreate = rx
+}
+
+// canAutoCreate returns true if topic with given name can be created on
+// request of a client. It must be called with the lock held.
+func (s *Server) canAutoCreate(name string) bool {
+	return s.autoCreate == nil || s.autoCreate.MatchString(name)
+}
+
+// createTopic creates an empty topic without any partitions. It must be
+// called with the write lock held.
+func (s *Server) createTopic(name string) map[int32]*partitionLog {
+	parts := make(map[int32]*partitionLog)
+	s.topics[name] = parts
+	if s.versionedMetadata {
+		s.topicVersions[name] = s.metadataVersion + 1
+	}
+	return parts
+}
+
+// internalTopics are topics kafka uses to store its own state.
+var internalTopics = map[string]bool{
+	offsetsTopic:          true,
+	"__transaction_state": true,
+}
+
+// SetAllowInternalTopicWrites controls whether clients can produce to internal
+// topics, such as __consumer_offsets. If not allowed, produce requests to
+// internal topics fail with ErrAuthorizationFailed (topic authorization
+// failed). Writes are allowed by default.
+func (s *Server) SetAllowInternalTopicWrites(allow bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.denyInternalWrites = !allow
+}
+
+// topicNameRx matches characters kafka allows in topic names.
+var topicNameRx = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+// SetTopicNameValidation makes the server reject requests referencing a topic
+// whose name differs only in letter case from an existing topic, with
+// ErrUnknownTopicOrPartition, instead of treating it as another topic. It
+// helps to catch clients spelling a topic name inconsistently.
+func (s *Server) SetTopicNameValidation(strict bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.strictTopicNames = strict
+}
+
+// misCased returns true if topic name validation is enabled and given topic
+// does not exist, but another one differing only in letter case does. It
+// must be called with the lock held.
+func (s *Server) misCased(name string) bool {
+	if !s.strictTopicNames {
+		return false
+	}
+	if _, ok := s.topics[name]; ok {
+		return false
+	}
+	for existing := range s.topics {
+		if strings.EqualFold(existing, name) {
+			s.logger().Errorf("topic %s referenced as %s", existing, name)
+			return true
+		}
+	}
+	return false
+}
+
+// validTopicName returns true if kafka accepts given topic name: it is at
+// most 249 characters long, consists of letters, digits, '.', '_' and '-'
+// only, and is neither "." nor "..".
+func validTopicName(name string) bool {
+	if len(name) > 249 || name == "." || name == ".." {
+		return false
 	}
-	return s
+	return topicNameRx.MatchString(name)
+}
+
+// topicVisible returns true if given topic should be included in metadata
+// responses. It must be called with the lock held.
+func (s *Server) topicVisible(name string) bool {
+	return s.topicVersions[name] <= s.metadataVersion
 }
 
 // Addr return server instance address or empty string if not running.
@@ -75,13 +1614,37 @@ func (s *Server) Addr() string {
 	panic("server should be running but isn't, no addr available")
 }
 
+// Listener returns the listener the server is accepting connections on, or
+// nil if the server is not running.
+func (s *Server) Listener() net.Listener {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.ln
+}
+
 // Reset will clear out local messages and topics.
 func (s *Server) Reset() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	s.topics = make(map[string]map[int32][]*proto.Message)
+	s.topics = make(map[string]map[int32]*partitionLog)
+	s.configs = make(map[string]map[string]string)
+	s.corrupt = make(map[string]map[int32]map[int64]bool)
+	s.offline = make(map[string]map[int32]bool)
+	s.highWaterMarks = make(map[string]map[int32]int64)
+	s.readReplicas = make(map[string]map[int32]int32)
+	s.abortedTxns = make(map[string]map[int32][]AbortedTxn)
+	s.replicationFactors = make(map[string]int)
+	s.leaderEpochs = make(map[string]map[int32]int32)
 	s.offsets = make(map[string]map[int32]map[string]*topicOffset)
+	s.topicVersions = make(map[string]int)
+	for _, d := range s.dedup {
+		d.stored = make(map[string]time.Time)
+	}
+
+	s.resetGen++
+	s.fetchCond.Broadcast()
 }
 
 // ResetTopic removes all messages and committed offsets for a topic, but
@@ -92,10 +1655,49 @@ func (s *Server) ResetTopic(topic string) {
 
 	if parts, ok := s.topics[topic]; ok {
 		for partitionID := range parts {
-			parts[partitionID] = make([]*proto.Message, 0)
+			parts[partitionID] = &partitionLog{messages: make([]*proto.Message, 0)}
 		}
 	}
 	delete(s.offsets, topic)
+	delete(s.corrupt, topic)
+	delete(s.highWaterMarks, topic)
+	delete(s.abortedTxns, topic)
+
+	s.resetGen++
+	s.fetchCond.Broadcast()
+}
+
+// Bounce simulates broker restart by closing all client connections. The
+// server keeps listening on the same address, so that clients can reconnect.
+// If retainState is false, all messages and topics are removed as well, as if
+// Reset was called.
+func (s *Server) Bounce(retainState bool) {
+	if !retainState {
+		s.Reset()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.logger().Infof("bounced server, closed %d connections", len(s.conns))
+}
+
+// SetUnavailable makes the server answer all requests with
+// ErrBrokerNotAvailable for given duration, after which normal service
+// resumes. This simulates a broker briefly down during a rolling restart,
+// while keeping client connections open. Requests that cannot carry an error
+// close the connection instead. Zero duration or Close end the window early.
+func (s *Server) SetUnavailable(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.unavailableUntil = time.Time{}
+	if d > 0 {
+		s.unavailableUntil = time.Now().Add(d)
+	}
 }
 
 // Close shut down server if running. It is safe to call it more than once.
@@ -103,8 +1705,18 @@ func (s *Server) Close() (err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if !s.stopped {
+		close(s.done)
+	}
 	s.stopped = true
+	s.unavailableUntil = time.Time{}
+	// release fetch requests hung until close
+	s.fetchCond.Broadcast()
 
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+		s.idleTimer = nil
+	}
 	if s.ln != nil {
 		err = s.ln.Close()
 		s.ln = nil
@@ -112,16 +1724,23 @@ func (s *Server) Close() (err error) {
 	return err
 }
 
-// ServeHTTP provides JSON serialized server state information.
+// ServeHTTP provides JSON serialized server state information. POST request
+// with the same JSON document loads topics and messages it contains into the
+// server instead, see importState.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	if r.Method == http.MethodPost {
+		s.importState(w, r)
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
 	topics := make(map[string]map[string][]*proto.Message)
 	for name, parts := range s.topics {
 		topics[name] = make(map[string][]*proto.Message)
-		for part, messages := range parts {
-			topics[name][strconv.Itoa(int(part))] = messages
+		for part, plog := range parts {
+			topics[name][strconv.Itoa(int(part))] = plog.messages
 		}
 	}
 
@@ -131,8 +1750,73 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"brokers": s.brokers,
 	})
 	if err != nil {
-		log.Errorf("cannot JSON encode state: %s", err)
+		s.logger().Errorf("cannot JSON encode state: %s", err)
+	}
+}
+
+// importState loads topics and messages of JSON serialized server state, as
+// returned by ServeHTTP. Every partition in the document replaces content of
+// the partition as LoadPartition would, keeping offsets of the messages,
+// which must be consecutive. Brokers are ignored. Malformed document is
+// rejected with 400 status code without changing the server state.
+func (s *Server) importState(w http.ResponseWriter, r *http.Request) {
+	var state struct {
+		Topics map[string]map[string][]*proto.Message `json:"topics"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+		http.Error(w, fmt.Sprintf("malformed state: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	type partition struct {
+		topic       string
+		id          int32
+		startOffset int64
+		messages    []*proto.Message
+	}
+	var partitions []partition
+	for name, parts := range state.Topics {
+		if name == "" {
+			http.Error(w, "empty topic name", http.StatusBadRequest)
+			return
+		}
+		for key, messages := range parts {
+			id, err := strconv.ParseInt(key, 10, 32)
+			if err != nil || id < 0 {
+				http.Error(w, fmt.Sprintf("invalid partition %q of topic %s", key, name), http.StatusBadRequest)
+				return
+			}
+			var startOffset int64
+			for i, msg := range messages {
+				if msg == nil {
+					http.Error(w, fmt.Sprintf("null message in %s:%d", name, id), http.StatusBadRequest)
+					return
+				}
+				if i == 0 {
+					startOffset = msg.Offset
+				}
+				if msg.Offset != startOffset+int64(i) || msg.Offset < 0 {
+					http.Error(w, fmt.Sprintf("offsets of %s:%d are not consecutive", name, id), http.StatusBadRequest)
+					return
+				}
+			}
+			partitions = append(partitions, partition{
+				topic:       name,
+				id:          int32(id),
+				startOffset: startOffset,
+				messages:    messages,
+			})
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range partitions {
+		s.loadPartition(p.topic, p.id, p.startOffset, p.messages)
 	}
+	s.logger().Infof("imported %d partitions", len(partitions))
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // AddMessages append messages to given topic/partition. If topic or partition
@@ -145,67 +1829,290 @@ func (s *Server) AddMessages(topic string, partition int32, messages ...*proto.M
 
 	parts, ok := s.topics[topic]
 	if !ok {
-		parts = make(map[int32][]*proto.Message)
-		s.topics[topic] = parts
+		parts = s.createTopic(topic)
 	}
 
 	for i := int32(0); i <= partition; i++ {
 		if _, ok := parts[i]; !ok {
-			parts[i] = make([]*proto.Message, 0)
+			parts[i] = &partitionLog{messages: make([]*proto.Message, 0)}
 		}
 	}
 	if len(messages) > 0 {
-		start := len(parts[partition])
+		plog := parts[partition]
+		start := plog.nextOffset()
 		for i, msg := range messages {
-			msg.Offset = int64(start + i)
+			msg.Offset = start + int64(i)
 			msg.Partition = partition
 			msg.Topic = topic
 		}
-		parts[partition] = append(parts[partition], messages...)
+		plog.messages = append(plog.messages, messages...)
+		plog.trim(s.retentionLimit)
+		s.fetchCond.Broadcast()
+	}
+}
+
+// FeedMessages appends given messages to topic/partition in the background,
+// one message every interval, as AddMessages would. It returns immediately;
+// the returned channel is closed once all messages are stored. Feeding stops
+// early if the server is closed. This allows testing long polling fetch
+// requests with data trickling in.
+func (s *Server) FeedMessages(
+	topic string, partition int32, interval time.Duration, messages ...*proto.Message) <-chan struct{} {
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for _, msg := range messages {
+			<-ticker.C
+
+			s.mu.RLock()
+			stopped := s.stopped
+			s.mu.RUnlock()
+			if stopped {
+				return
+			}
+			s.AddMessages(topic, partition, msg)
+		}
+	}()
+	return done
+}
+
+// LoadPartition replaces content of given topic/partition with given messages,
+// the first of which gets startOffset. Log start offset of the partition is
+// set to startOffset as well, so that fetching from lower offsets fails with
+// ErrOffsetOutOfRange and the earliest offset is startOffset. If topic or
+// partition does not exist, it is being created. This allows replaying a
+// captured log with its original offsets.
+func (s *Server) LoadPartition(topic string, partition int32, startOffset int64, messages []*proto.Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.loadPartition(topic, partition, startOffset, messages)
+}
+
+// loadPartition is LoadPartition that must be called with the lock held.
+func (s *Server) loadPartition(topic string, partition int32, startOffset int64, messages []*proto.Message) {
+	parts, ok := s.topics[topic]
+	if !ok {
+		parts = s.createTopic(topic)
+	}
+	for i := int32(0); i < partition; i++ {
+		if _, ok := parts[i]; !ok {
+			parts[i] = &partitionLog{messages: make([]*proto.Message, 0)}
+		}
+	}
+
+	plog := &partitionLog{
+		startOffset: startOffset,
+		messages:    make([]*proto.Message, len(messages)),
+	}
+	for i, msg := range messages {
+		msg.Offset = startOffset + int64(i)
+		msg.Partition = partition
+		msg.Topic = topic
+		plog.messages[i] = msg
+	}
+	plog.trim(s.retentionLimit)
+	parts[partition] = plog
+	s.fetchCond.Broadcast()
+}
+
+// ProduceMessages stores messages in given topic/partition the same way a
+// produce request sent by a client would. Unlike AddMessages, messages are
+// encoded into a produce request using given compression and decoded back
+// before being stored, so that fixture data goes through the same
+// compression, CRC and offset assignment as live produced data.
+func (s *Server) ProduceMessages(
+	topic string, partition int32, codec proto.Compression, messages ...*proto.Message) error {
+
+	b, err := (&proto.ProduceReq{
+		Compression:  codec,
+		RequiredAcks: proto.RequiredAcksLocal,
+		Topics: []proto.ProduceReqTopic{
+			{
+				Name: topic,
+				Partitions: []proto.ProduceReqPartition{
+					{ID: partition, Messages: messages},
+				},
+			},
+		},
+	}).Bytes()
+	if err != nil {
+		return fmt.Errorf("cannot encode produce request: %s", err)
+	}
+	req, err := proto.ReadProduceReq(bytes.NewBuffer(b))
+	if err != nil {
+		return fmt.Errorf("cannot decode produce request: %s", err)
+	}
+
+	// produce to the partition leader, which matters in a cluster
+	s.mu.RLock()
+	nodeID := s.leader(partition, s.nodeID)
+	s.mu.RUnlock()
+
+	resp, ok := s.handleProduceRequest(nodeID, nil, req, b).(*proto.ProduceResp)
+	if !ok {
+		// acknowledgement dropped, but the messages are stored unless the
+		// server was closed while the topic was paused
+		return nil
+	}
+	if err := resp.Topics[0].Partitions[0].Err; err != nil {
+		return err
+	}
+	return nil
+}
+
+// RoundTrip produces messages to given topic/partition as ProduceMessages
+// does and fetches the partition back from offset 0, returning all messages
+// it holds. Both requests and responses are encoded and decoded, so that a
+// single call checks the whole encode, store and decode cycle.
+func (s *Server) RoundTrip(
+	topic string, partition int32, messages ...*proto.Message) ([]*proto.Message, error) {
+
+	if err := s.ProduceMessages(topic, partition, proto.CompressionNone, messages...); err != nil {
+		return nil, fmt.Errorf("cannot produce: %s", err)
+	}
+
+	b, err := (&proto.FetchReq{
+		Topics: []proto.FetchReqTopic{
+			{
+				Name: topic,
+				Partitions: []proto.FetchReqPartition{
+					{ID: partition, FetchOffset: 0, MaxBytes: math.MaxInt32},
+				},
+			},
+		},
+	}).Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode fetch request: %s", err)
+	}
+	req, err := proto.ReadFetchReq(bytes.NewBuffer(b))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode fetch request: %s", err)
+	}
+
+	s.mu.RLock()
+	nodeID := s.leader(partition, s.nodeID)
+	s.mu.RUnlock()
+
+	fetched := s.handleFetchRequest(nodeID, nil, req)
+	if fetched == nil {
+		return nil, fmt.Errorf("cannot fetch: server closed")
+	}
+	b, err = fetched.Bytes()
+	if err != nil {
+		return nil, fmt.Errorf("cannot encode fetch response: %s", err)
+	}
+	resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode fetch response: %s", err)
+	}
+	part := resp.Topics[0].Partitions[0]
+	if part.Err != nil {
+		return nil, fmt.Errorf("cannot fetch: %s", part.Err)
+	}
+	return part.Messages, nil
+}
+
+// DrainTopic returns copies of all messages of given topic by partition, in
+// offset order. Messages, including their keys and values, are deep copied,
+// so they can be inspected while clients keep producing and modifying them
+// does not change the server state. Unknown topic has no partitions.
+func (s *Server) DrainTopic(topic string) map[int32][]*proto.Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	parts := make(map[int32][]*proto.Message)
+	for pid, plog := range s.topics[topic] {
+		messages := make([]*proto.Message, len(plog.messages))
+		for i, msg := range plog.messages {
+			m := *msg
+			if msg.Key != nil {
+				m.Key = append([]byte{}, msg.Key...)
+			}
+			if msg.Value != nil {
+				m.Value = append([]byte{}, msg.Value...)
+			}
+			messages[i] = &m
+		}
+		parts[pid] = messages
+	}
+	return parts
+}
+
+// Topics returns names of all topics known to the server, each mapped to its
+// partition IDs in ascending order.
+func (s *Server) Topics() map[string][]int32 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	topics := make(map[string][]int32, len(s.topics))
+	for name, parts := range s.topics {
+		ids := make([]int32, 0, len(parts))
+		for pid := range parts {
+			ids = append(ids, pid)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		topics[name] = ids
 	}
+	return topics
 }
 
 // Run starts kafka mock server listening on given address. Function only
 // returns when the listener has exited.
 func (s *Server) Run(addr string) error {
-	const nodeID = 100
+	ln, err := net.Listen("tcp4", addr)
+	if err != nil {
+		s.logger().Errorf("cannot listen on address %q: %s", addr, err)
+		return fmt.Errorf("cannot listen: %s", err)
+	}
+	return s.Serve(ln)
+}
 
-	ln, err := func() (net.Listener, error) {
+// Serve runs kafka mock server accepting connections on given listener
+// instead of binding a TCP port, which allows using in-memory listeners.
+// Listener address is advertised as the broker address. If it is not in
+// host:port form, whole address is used as the host and the port is 0.
+// Function only returns when the listener has exited and it always closes the
+// listener before returning.
+func (s *Server) Serve(ln net.Listener) error {
+	var nodeID int32
+
+	err := func() error {
 		s.mu.Lock()
 		defer s.mu.Unlock()
 
 		if s.ln != nil {
-			log.Errorf("server already running: %s", s.ln.Addr())
-			return nil, fmt.Errorf("server already running: %s", s.ln.Addr())
-		}
-
-		ln, err := net.Listen("tcp4", addr)
-		if err != nil {
-			log.Errorf("cannot listen on address %q: %s", addr, err)
-			return nil, fmt.Errorf("cannot listen: %s", err)
+			s.logger().Errorf("server already running: %s", s.ln.Addr())
+			return fmt.Errorf("server already running: %s", s.ln.Addr())
 		}
 
 		s.ln = ln
 		s.started = true
+		nodeID = s.nodeID
 
-		if host, port, err := net.SplitHostPort(ln.Addr().String()); err != nil {
-			log.Errorf("cannot extract host/port from %q: %s", ln.Addr(), err)
-			return nil, fmt.Errorf("cannot extract host/port from %q: %s", ln.Addr(), err)
-		} else {
-			prt, err := strconv.Atoi(port)
-			if err != nil {
-				log.Errorf("invalid port %q: %s", port, err)
-				return nil, fmt.Errorf("invalid port %q: %s", port, err)
-			}
-			s.brokers = append(s.brokers, proto.MetadataRespBroker{
-				NodeID: nodeID,
-				Host:   host,
-				Port:   int32(prt),
-			})
+		host, port, err := net.SplitHostPort(ln.Addr().String())
+		if err != nil {
+			host, port = ln.Addr().String(), "0"
+		}
+		prt, err := strconv.Atoi(port)
+		if err != nil {
+			s.logger().Errorf("invalid port %q: %s", port, err)
+			return fmt.Errorf("invalid port %q: %s", port, err)
 		}
-		return ln, nil
+		s.brokers = append(s.brokers, proto.MetadataRespBroker{
+			NodeID: nodeID,
+			Host:   host,
+			Port:   int32(prt),
+		})
+		return nil
 	}()
 	if err != nil {
+		_ = ln.Close()
 		return err
 	}
 
@@ -215,9 +2122,10 @@ func (s *Server) Run(addr string) error {
 	// Handle incoming connections for a long time
 	for {
 		if conn, err := ln.Accept(); err == nil {
+			s.delayAccept()
 			go s.handleClient(nodeID, conn)
 		} else {
-			log.Errorf("failed to accept: %s", err)
+			s.logger().Errorf("failed to accept: %s", err)
 			return fmt.Errorf("failed to accept: %s", err)
 		}
 	}
@@ -227,8 +2135,6 @@ func (s *Server) Run(addr string) error {
 // cannot be spawned.
 // Use Close method to stop spawned server.
 func (s *Server) MustSpawn() {
-	const nodeID = 100
-
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -236,12 +2142,18 @@ func (s *Server) MustSpawn() {
 		return
 	}
 
+	s.ln = s.spawnNode(s.nodeID)
+	s.started = true
+}
+
+// spawnNode starts accepting connections of given node on random port in the
+// background and registers the node as a broker. It panics if the node cannot
+// be spawned. It must be called with the lock held.
+func (s *Server) spawnNode(nodeID int32) net.Listener {
 	ln, err := net.Listen("tcp4", ":0")
 	if err != nil {
 		panic(fmt.Sprintf("cannot listen: %s", err))
 	}
-	s.ln = ln
-	s.started = true
 
 	if host, port, err := net.SplitHostPort(ln.Addr().String()); err != nil {
 		panic(fmt.Sprintf("cannot extract host/port from %q: %s", ln.Addr(), err))
@@ -260,106 +2172,314 @@ func (s *Server) MustSpawn() {
 	go func() {
 		for {
 			conn, err := ln.Accept()
-			if err == nil {
-				go s.handleClient(nodeID, conn)
+			if err != nil {
+				// listener was closed
+				return
 			}
+			s.delayAccept()
+			go s.handleClient(nodeID, conn)
 		}
 	}()
+	return ln
 }
 
 func (s *Server) handleClient(nodeID int32, conn net.Conn) {
+	s.mu.Lock()
+	s.conns[conn] = struct{}{}
+	s.mu.Unlock()
+	s.touch()
+
 	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+
 		_ = conn.Close()
 	}()
 
+	// correlation IDs of the most recent requests, oldest first, if
+	// duplicates are rejected
+	correlationIDs := make(map[int32]struct{})
+	var recentIDs []int32
+	// number of responses with correlation ID set by the server
+	var respCount int32
+
+	// buffered, so that the size of a request can be checked before reading it
+	rd := bufio.NewReader(conn)
+
 	for {
-		kind, b, err := proto.ReadReq(conn)
+		if size, err := rd.Peek(4); err == nil {
+			s.mu.RLock()
+			maxBytes := s.maxRequestBytes
+			s.mu.RUnlock()
+			if n := int32(binary.BigEndian.Uint32(size)); maxBytes > 0 && (n < 0 || int(n) > maxBytes) {
+				s.logger().Errorf("request of %d bytes exceeds limit of %d bytes, closing connection", n, maxBytes)
+				// trace the part of the rejected frame that was received
+				head, _ := rd.Peek(rd.Buffered())
+				s.traceFrame(nodeID, "rejected request", -1, head)
+				return
+			}
+		}
+
+		// keep the bytes read while tracing, so that a frame that cannot be
+		// read completely is traced as well
+		var frame io.Reader = rd
+		var read *bytes.Buffer
+		if s.tracing() {
+			read = new(bytes.Buffer)
+			frame = io.TeeReader(rd, read)
+		}
+		kind, b, err := proto.ReadReq(frame)
 		if err != nil {
+			if read != nil && read.Len() > 0 {
+				s.traceFrame(nodeID, "malformed request", -1, read.Bytes())
+			}
 			if err != io.EOF {
-				log.Errorf("client read error: %s", err)
+				s.logger().Errorf("client read error: %s", err)
 			}
 			return
 		}
+		s.touch()
+		s.stats.add(kind, b)
+		s.traceFrame(nodeID, "request", kind, b)
+
+		s.mu.RLock()
+		rejectDuplicates := s.rejectDuplicateCorrelation
+		s.mu.RUnlock()
+		if rejectDuplicates {
+			id := correlationID(b)
+			if _, ok := correlationIDs[id]; ok {
+				s.logger().Errorf("duplicate correlation ID %d of %d request, closing connection", id, kind)
+				return
+			}
+			correlationIDs[id] = struct{}{}
+			recentIDs = append(recentIDs, id)
+			if len(recentIDs) > duplicateCorrelationWindow {
+				delete(correlationIDs, recentIDs[0])
+				recentIDs = recentIDs[1:]
+			}
+		}
 
-		var resp response
+		if delay := s.sampleLatency(kind); delay > 0 && !s.sleep(delay) {
+			s.logger().Infof("server closed, dropping delayed %d request", kind)
+			return
+		}
 
-		for _, middleware := range s.middlewares {
-			resp = middleware(nodeID, kind, b)
-			if resp != nil {
-				break
+		resp, ok := s.handleRequest(nodeID, conn, kind, b)
+
+		var respb []byte
+		if ok && resp != nil {
+			respb, err = resp.Bytes()
+			if err != nil {
+				s.logger().Errorf("cannot serialize %T response: %s", resp, err)
+			}
+		}
+
+		s.mu.RLock()
+		rlog := s.requestLog
+		mode := s.correlationMode
+		s.mu.RUnlock()
+
+		if mode.kind != correlationEcho && len(respb) >= 8 {
+			respCount++
+			id := mode.fixed
+			if mode.kind == correlationIncrement {
+				id = respCount
 			}
+			// copy, as raw responses might be reused by the middleware
+			respb = append([]byte(nil), respb...)
+			binary.BigEndian.PutUint32(respb[4:], uint32(id))
+		}
+
+		if rlog != nil {
+			rlog.add(nodeID, kind, b, respb)
 		}
 
+		if !ok {
+			return
+		}
 		if resp == nil {
-			switch kind {
-			case proto.ProduceReqKind:
-				req, err := proto.ReadProduceReq(bytes.NewBuffer(b))
-				if err != nil {
-					log.Errorf("cannot parse produce request: %s\n%s", err, b)
-					return
-				}
-				resp = s.handleProduceRequest(nodeID, conn, req)
-			case proto.FetchReqKind:
-				req, err := proto.ReadFetchReq(bytes.NewBuffer(b))
-				if err != nil {
-					log.Errorf("cannot parse fetch request: %s\n%s", err, b)
-					return
-				}
-				resp = s.handleFetchRequest(nodeID, conn, req)
-			case proto.OffsetReqKind:
-				req, err := proto.ReadOffsetReq(bytes.NewBuffer(b))
-				if err != nil {
-					log.Errorf("cannot parse offset request: %s\n%s", err, b)
-					return
-				}
-				resp = s.handleOffsetRequest(nodeID, conn, req)
-			case proto.MetadataReqKind:
-				req, err := proto.ReadMetadataReq(bytes.NewBuffer(b))
-				if err != nil {
-					log.Errorf("cannot parse metadata request: %s\n%s", err, b)
-					return
-				}
-				resp = s.handleMetadataRequest(nodeID, conn, req)
-			case proto.OffsetCommitReqKind:
-				req, err := proto.ReadOffsetCommitReq(bytes.NewBuffer(b))
-				if err != nil {
-					log.Errorf("cannot parse offset commit request: %s\n%s", err, b)
-					return
-				}
-				resp = s.handleOffsetCommitRequest(nodeID, conn, req)
-			case proto.OffsetFetchReqKind:
-				req, err := proto.ReadOffsetFetchReq(bytes.NewBuffer(b))
-				if err != nil {
-					log.Errorf("cannot parse offset fetch request: %s\n%s", err, b)
-					return
-				}
-				resp = s.handleOffsetFetchRequest(nodeID, conn, req)
-			case proto.GroupCoordinatorReqKind:
-				req, err := proto.ReadGroupCoordinatorReq(bytes.NewBuffer(b))
-				if err != nil {
-					log.Errorf("cannot parse consumer metadata request: %s\n%s", err, b)
-					return
-				}
-				resp = s.handleGroupCoordinatorRequest(nodeID, conn, req)
-			default:
-				log.Errorf("unknown request: %d\n%s", kind, b)
-				return
+			s.logger().Errorf("no response for %d", kind)
+			return
+		}
+		s.traceFrame(nodeID, "response", kind, respb)
+		if _, err := conn.Write(respb); err != nil {
+			s.logger().Errorf("cannot write %T response: %s", resp, err)
+			return
+		}
+	}
+}
+
+// correlationID returns correlation ID of given request, which follows the
+// message size, request kind and API version.
+func correlationID(b []byte) int32 {
+	if len(b) < 12 {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(b[8:]))
+}
+
+// clientID returns client ID of given request, which follows the correlation
+// ID. Missing or null client ID is returned as empty string.
+func clientID(b []byte) string {
+	if len(b) < 14 {
+		return ""
+	}
+	size := int(int16(binary.BigEndian.Uint16(b[12:])))
+	if size < 0 || len(b) < 14+size {
+		return ""
+	}
+	return string(b[14 : 14+size])
+}
+
+// handleRequest runs middlewares and the default handler for a single
+// request. It returns false if the request could not be handled and the
+// connection should be closed. Handler panics, most likely caused by a
+// malformed request, are recovered from so that a single misbehaving client
+// cannot crash the whole test process.
+func (s *Server) handleRequest(
+	nodeID int32, conn net.Conn, kind int16, b []byte) (resp response, ok bool) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			s.logger().Errorf("panic while handling %d request: %v\n%s", kind, r, b)
+
+			s.mu.RLock()
+			onPanic := s.onHandlerPanic
+			s.mu.RUnlock()
+			if onPanic != nil {
+				onPanic(kind, b, r)
 			}
+			resp, ok = nil, false
+		}
+	}()
+
+	s.mu.Lock()
+	if s.expected != nil && !s.expected[kind] {
+		s.violations = append(s.violations, kind)
+	}
+	supported := s.supportedAPIs == nil || s.supportedAPIs[kind]
+	unavailable := time.Now().Before(s.unavailableUntil)
+	s.mu.Unlock()
+	if unavailable {
+		rejected, err := errorResponse(kind, b, proto.ErrBrokerNotAvailable)
+		if err != nil {
+			s.logger().Errorf("cannot reject %d request of unavailable broker, closing connection: %s", kind, err)
+			return nil, false
+		}
+		s.logger().Infof("rejected %d request, broker unavailable", kind)
+		return rejected, true
+	}
+	if !supported {
+		rejected, err := errorResponse(kind, b, proto.ErrUnsupportedVersion)
+		if err != nil {
+			s.logger().Errorf("cannot reject unsupported %d request, closing connection: %s", kind, err)
+			return nil, false
+		}
+		s.logger().Infof("rejected unsupported %d request", kind)
+		return rejected, true
+	}
+
+	if s.replay != nil {
+		scripted, found := s.replay.next(kind, b)
+		if !found {
+			s.logger().Errorf("no scripted response to %d request left, closing connection", kind)
+			return nil, false
+		}
+		return scripted, true
+	}
+
+	for _, middleware := range s.middlewares {
+		resp = middleware(nodeID, kind, b)
+		if resp != nil {
+			return resp, true
+		}
+	}
+
+	switch kind {
+	case proto.ProduceReqKind:
+		req, err := proto.ReadProduceReq(bytes.NewBuffer(b))
+		if err != nil {
+			s.logger().Errorf("cannot parse produce request: %s\n%s", err, b)
+			return nil, false
+		}
+		resp = s.handleProduceRequest(nodeID, conn, req, b)
+		if resp == nil {
+			// acknowledgement dropped, see DropNextProduceAck
+			return nil, false
+		}
+	case proto.FetchReqKind:
+		req, err := proto.ReadFetchReq(bytes.NewBuffer(b))
+		if err != nil {
+			s.logger().Errorf("cannot parse fetch request: %s\n%s", err, b)
+			return nil, false
+		}
+		resp = s.handleFetchRequest(nodeID, conn, req)
+		if resp == nil {
+			// hung until the server was closed, see SetFetchHang
+			return nil, false
+		}
+	case proto.OffsetReqKind:
+		req, err := proto.ReadOffsetReq(bytes.NewBuffer(b))
+		if err != nil {
+			s.logger().Errorf("cannot parse offset request: %s\n%s", err, b)
+			return nil, false
+		}
+		resp = s.handleOffsetRequest(nodeID, conn, req)
+	case proto.MetadataReqKind:
+		req, err := proto.ReadMetadataReq(bytes.NewBuffer(b))
+		if err != nil {
+			s.logger().Errorf("cannot parse metadata request: %s\n%s", err, b)
+			return nil, false
 		}
-
-		if resp == nil {
-			log.Errorf("no response for %d", kind)
-			return
+		resp = s.handleMetadataRequest(nodeID, conn, req)
+	case proto.OffsetCommitReqKind:
+		req, err := proto.ReadOffsetCommitReq(bytes.NewBuffer(b))
+		if err != nil {
+			s.logger().Errorf("cannot parse offset commit request: %s\n%s", err, b)
+			return nil, false
 		}
-		b, err = resp.Bytes()
+		resp = s.handleOffsetCommitRequest(nodeID, conn, req)
+	case proto.OffsetFetchReqKind:
+		req, err := proto.ReadOffsetFetchReq(bytes.NewBuffer(b))
 		if err != nil {
-			log.Errorf("cannot serialize %T response: %s", resp, err)
+			s.logger().Errorf("cannot parse offset fetch request: %s\n%s", err, b)
+			return nil, false
 		}
-		if _, err := conn.Write(b); err != nil {
-			log.Errorf("cannot write %T response: %s", resp, err)
-			return
+		resp = s.handleOffsetFetchRequest(nodeID, conn, req)
+	case proto.GroupCoordinatorReqKind:
+		req, err := proto.ReadGroupCoordinatorReq(bytes.NewBuffer(b))
+		if err != nil {
+			s.logger().Errorf("cannot parse consumer metadata request: %s\n%s", err, b)
+			return nil, false
+		}
+		resp = s.handleGroupCoordinatorRequest(nodeID, conn, req)
+	case proto.DescribeConfigsReqKind:
+		req, err := proto.ReadDescribeConfigsReq(bytes.NewBuffer(b))
+		if err != nil {
+			s.logger().Errorf("cannot parse describe configs request: %s\n%s", err, b)
+			return nil, false
 		}
+		resp = s.handleDescribeConfigsRequest(nodeID, conn, req)
+	case proto.AlterConfigsReqKind:
+		req, err := proto.ReadAlterConfigsReq(bytes.NewBuffer(b))
+		if err != nil {
+			s.logger().Errorf("cannot parse alter configs request: %s\n%s", err, b)
+			return nil, false
+		}
+		resp = s.handleAlterConfigsRequest(nodeID, conn, req)
+	case proto.DeleteGroupsReqKind:
+		req, err := proto.ReadDeleteGroupsReq(bytes.NewBuffer(b))
+		if err != nil {
+			s.logger().Errorf("cannot parse delete groups request: %s\n%s", err, b)
+			return nil, false
+		}
+		resp = s.handleDeleteGroupsRequest(nodeID, conn, req)
+	default:
+		s.logger().Errorf("unknown request: %d\n%s", kind, b)
+		return nil, false
 	}
+	return resp, true
 }
 
 type response interface {
@@ -367,91 +2487,449 @@ type response interface {
 }
 
 func (s *Server) handleProduceRequest(
-	nodeID int32, conn net.Conn, req *proto.ProduceReq) response {
+	nodeID int32, conn net.Conn, req *proto.ProduceReq, b []byte) response {
+
+	topics := make([]string, len(req.Topics))
+	for i, topic := range req.Topics {
+		topics[i] = topic.Name
+	}
+	if !s.waitUnpaused(topics) {
+		s.logger().Infof("server closed, dropping paused produce request %d", req.CorrelationID)
+		return nil
+	}
+
+	resp, committed, dropAck := s.storeProduced(nodeID, req, b)
+	s.notifyCommitted(committed)
+
+	if req.RequiredAcks == proto.RequiredAcksAll && !s.waitReplicated(req, resp) {
+		s.logger().Infof("server closed, dropping unreplicated produce request %d", req.CorrelationID)
+		return nil
+	}
+	if dropAck {
+		s.logger().Infof("dropping acknowledgement of produce request %d", req.CorrelationID)
+		return nil
+	}
+	return resp
+}
+
+// storeProduced stores messages of given produce request, decoded from raw
+// request b, and returns the response, together with offsets committed by
+// producing to __consumer_offsets and flag telling whether the
+// acknowledgement should be dropped, see DropNextProduceAck.
+func (s *Server) storeProduced(
+	nodeID int32, req *proto.ProduceReq, b []byte) (*proto.ProduceResp, []commitEvent, bool) {
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	var raw rawProduced
+	if s.retainRaw {
+		raw = rawProducedMessages(b, req)
+	}
+
 	resp := &proto.ProduceResp{
+		Version:       req.Version,
 		CorrelationID: req.CorrelationID,
 		Topics:        make([]proto.ProduceRespTopic, len(req.Topics)),
 	}
+	now := time.Now()
+	var committed []commitEvent
+	dropAck := false
 
 	for ti, topic := range req.Topics {
-		t, ok := s.topics[topic.Name]
-		if !ok {
-			t = make(map[int32][]*proto.Message)
-			s.topics[topic.Name] = t
-		}
-
 		respParts := make([]proto.ProduceRespPartition, len(topic.Partitions))
 		resp.Topics[ti].Name = topic.Name
 		resp.Topics[ti].Partitions = respParts
 
+		if len(topic.Partitions) == 0 {
+			// nothing to store, do not auto create the topic either
+			continue
+		}
+		if !validTopicName(topic.Name) {
+			for pi, part := range topic.Partitions {
+				respParts[pi].ID = part.ID
+				respParts[pi].Err = proto.ErrInvalidTopic
+				respParts[pi].Offset = -1
+			}
+			continue
+		}
+		if (internalTopics[topic.Name] && s.denyInternalWrites) || s.denied[topic.Name][OperationWrite] {
+			s.logger().Infof("rejected unauthorized produce to topic %s", topic.Name)
+			for pi, part := range topic.Partitions {
+				respParts[pi].ID = part.ID
+				respParts[pi].Err = proto.ErrAuthorizationFailed
+				respParts[pi].Offset = -1
+			}
+			continue
+		}
+		t, ok := s.topics[topic.Name]
+		if !ok && (!s.canAutoCreate(topic.Name) || s.misCased(topic.Name)) {
+			for pi, part := range topic.Partitions {
+				respParts[pi].ID = part.ID
+				respParts[pi].Err = proto.ErrUnknownTopicOrPartition
+				respParts[pi].Offset = -1
+			}
+			continue
+		}
+		if !ok {
+			t = s.createTopic(topic.Name)
+		}
+		logAppendTime := s.configs[topic.Name][timestampTypeConfig] == "LogAppendTime"
+
 		for pi, part := range topic.Partitions {
-			p, ok := t[part.ID]
+			if s.paused[topic.Name] || s.offline[topic.Name][part.ID] {
+				respParts[pi].ID = part.ID
+				respParts[pi].Err = proto.ErrLeaderNotAvailable
+				respParts[pi].Offset = -1
+				continue
+			}
+			if s.leader(part.ID, nodeID) != nodeID {
+				respParts[pi].ID = part.ID
+				respParts[pi].Err = proto.ErrNotLeaderForPartition
+				respParts[pi].Offset = -1
+				continue
+			}
+			if failure, ok := s.produceFailures[topic.Name][part.ID]; ok {
+				if !failure.sticky {
+					delete(s.produceFailures[topic.Name], part.ID)
+				}
+				s.logger().Infof("failed produce to %s:%d: %s", topic.Name, part.ID, failure.err)
+				respParts[pi].ID = part.ID
+				respParts[pi].Err = failure.err
+				respParts[pi].Offset = -1
+				continue
+			}
+			if s.isolated[nodeID] && req.RequiredAcks == proto.RequiredAcksAll {
+				// other replicas never acknowledge the messages
+				respParts[pi].ID = part.ID
+				respParts[pi].Err = proto.ErrRequestTimeout
+				respParts[pi].Offset = -1
+				continue
+			}
+			if err := s.validateKeys(part.ID, part.Messages); err != nil {
+				s.logger().Errorf("invalid message key produced to %s:%d: %s",
+					topic.Name, part.ID, err)
+				respParts[pi].ID = part.ID
+				respParts[pi].Err = proto.ErrInvalidMessage
+				respParts[pi].Offset = -1
+				continue
+			}
+			plog, ok := t[part.ID]
 			if !ok {
-				p = make([]*proto.Message, 0)
-				t[part.ID] = p
+				plog = &partitionLog{messages: make([]*proto.Message, 0)}
+				t[part.ID] = plog
+			}
+
+			messages := part.Messages
+			if d, ok := s.dedup[topic.Name]; ok {
+				messages = d.filter(messages, now)
+				if dropped := len(part.Messages) - len(messages); dropped > 0 {
+					s.logger().Infof("dropped %d duplicate messages produced to %s:%d",
+						dropped, topic.Name, part.ID)
+				}
 			}
 
-			log.Infof("produced %d messages to %s:%d at offset %d",
-				len(part.Messages), topic.Name, part.ID, len(t[part.ID]))
-			for _, msg := range part.Messages {
-				msg.Offset = int64(len(t[part.ID]))
+			// like a broker, report the offset of the first appended message
+			baseOffset := plog.nextOffset()
+			s.logger().Infof("produced %d messages to %s:%d at offset %d",
+				len(messages), topic.Name, part.ID, baseOffset)
+			for i, msg := range messages {
+				msg.Offset = baseOffset + int64(i)
 				msg.Topic = topic.Name
-				t[part.ID] = append(t[part.ID], msg)
+				if logAppendTime {
+					msg.Timestamp = now
+				}
+				if rb, ok := raw[msg]; ok {
+					plog.setRaw(msg.Offset, rb)
+				}
+			}
+			plog.messages = append(plog.messages, messages...)
+			plog.trim(s.retentionLimit)
+			if topic.Name == offsetsTopic {
+				committed = append(committed, s.applyOffsetRecords(messages)...)
 			}
 
 			respParts[pi].ID = part.ID
-			respParts[pi].Offset = int64(len(t[part.ID])) - 1
+			respParts[pi].Offset = baseOffset
+			if logAppendTime {
+				respParts[pi].LogAppendTime = now
+			}
+			if s.dropAcks[topic.Name][part.ID] {
+				delete(s.dropAcks[topic.Name], part.ID)
+				dropAck = true
+			}
+			s.fetchCond.Broadcast()
 		}
 	}
-	return resp
+	return resp, committed, dropAck
+}
+
+// waitReplicated delays the response to produce request that requires
+// acknowledgement of all replicas by the replication delay. If the delay
+// exceeds the request timeout, the response is sent once the timeout passes
+// and stored messages are reported with ErrRequestTimeout, although they
+// remain stored, as with a broker. It returns false if the server was closed
+// before the response is due.
+func (s *Server) waitReplicated(req *proto.ProduceReq, resp *proto.ProduceResp) bool {
+	s.mu.RLock()
+	delay := s.replicationDelay
+	s.mu.RUnlock()
+	if delay <= 0 {
+		return true
+	}
+
+	if req.Timeout > 0 && req.Timeout < delay {
+		if !s.sleep(req.Timeout) {
+			return false
+		}
+		for _, topic := range resp.Topics {
+			for pi := range topic.Partitions {
+				if part := &topic.Partitions[pi]; part.Err == nil {
+					part.Err = proto.ErrRequestTimeout
+				}
+			}
+		}
+		return true
+	}
+	return s.sleep(delay)
 }
 
 func (s *Server) handleFetchRequest(
 	nodeID int32, conn net.Conn, req *proto.FetchReq) response {
 
+	topics := make([]string, len(req.Topics))
+	for i, topic := range req.Topics {
+		topics[i] = topic.Name
+	}
+	if !s.waitUnpaused(topics) {
+		s.logger().Infof("server closed, dropping paused fetch request %d", req.CorrelationID)
+		return nil
+	}
+	if !s.waitUnhung() {
+		s.logger().Infof("server closed, dropping hung fetch request %d", req.CorrelationID)
+		return nil
+	}
+
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
+	resp, ready := s.fetchMessages(nodeID, req)
+
+	// Long polling: if there is not enough data, wait until more is produced
+	// or until MaxWaitTime passes. Reset of the server state wakes the
+	// fetcher as well, because it might be waiting for data that will never
+	// arrive.
+	if !ready && req.MaxWaitTime > 0 {
+		deadline := time.Now().Add(req.MaxWaitTime)
+		timer := time.AfterFunc(req.MaxWaitTime, s.wakeFetchers)
+		defer timer.Stop()
+
+		atomic.AddInt32(&s.parkedFetches, 1)
+		resetGen := s.resetGen
+		for !ready && s.resetGen == resetGen && time.Now().Before(deadline) {
+			s.fetchCond.Wait()
+			resp, ready = s.fetchMessages(nodeID, req)
+		}
+		atomic.AddInt32(&s.parkedFetches, -1)
+	}
+
+	for _, topic := range resp.Topics {
+		for _, part := range topic.Partitions {
+			numFetched := len(part.Messages)
+			if numFetched > 0 || !strings.HasPrefix(topic.Name, "__") {
+				s.logger().Infof("fetched %d messages from %s:%d",
+					numFetched, topic.Name, part.ID)
+			}
+		}
+	}
+	return s.corruptedResponse(resp)
+}
+
+// fetchMessages builds a response for given fetch request using currently
+// stored messages. It returns true if the response can be sent right away,
+// because enough data is available or one of the partitions failed. It must
+// be called with the lock held.
+func (s *Server) fetchMessages(nodeID int32, req *proto.FetchReq) (*proto.FetchResp, bool) {
 	resp := &proto.FetchResp{
+		Version:       req.Version,
 		CorrelationID: req.CorrelationID,
+		MessageFormat: s.messageFormat,
 		Topics:        make([]proto.FetchRespTopic, len(req.Topics)),
 	}
+	// Since v3 the whole response is limited by MaxBytes as well. Partitions
+	// are filled in request order and once the budget is used up, the rest
+	// of them is returned empty.
+	budget := int32(-1)
+	if req.Version >= 3 && req.MaxBytes > 0 {
+		budget = req.MaxBytes
+	}
+
+	var size int32
+	var failed bool
+	// request without partitions can be answered right away, as no data can
+	// ever arrive for it
+	requested := 0
 	for ti, topic := range req.Topics {
+		requested += len(topic.Partitions)
 		respParts := make([]proto.FetchRespPartition, len(topic.Partitions))
 		resp.Topics[ti].Name = topic.Name
 		resp.Topics[ti].Partitions = respParts
 		for pi, part := range topic.Partitions {
 			respParts[pi].ID = part.ID
+			respParts[pi].PreferredReadReplica = -1
 
+			if s.denied[topic.Name][OperationRead] {
+				respParts[pi].Err = proto.ErrAuthorizationFailed
+				failed = true
+				continue
+			}
+			if s.paused[topic.Name] || s.offline[topic.Name][part.ID] {
+				respParts[pi].Err = proto.ErrLeaderNotAvailable
+				failed = true
+				continue
+			}
+			if s.outOfSync[topic.Name][part.ID][nodeID] {
+				respParts[pi].Err = proto.ErrReplicaNotAvailable
+				failed = true
+				continue
+			}
 			partitions, ok := s.topics[topic.Name]
 			if !ok {
 				respParts[pi].Err = proto.ErrUnknownTopicOrPartition
+				failed = true
 				continue
 			}
-			messages, ok := partitions[part.ID]
+			plog, ok := partitions[part.ID]
 			if !ok {
 				respParts[pi].Err = proto.ErrUnknownTopicOrPartition
+				failed = true
+				continue
+			}
+			replica, hasReplica := s.readReplicas[topic.Name][part.ID]
+			if s.leader(part.ID, nodeID) != nodeID && (!hasReplica || replica != nodeID) {
+				respParts[pi].Err = proto.ErrNotLeaderForPartition
+				failed = true
+				continue
+			}
+			if epoch := s.leaderEpochs[topic.Name][part.ID]; req.Version >= 9 && part.CurrentLeaderEpoch >= 0 && part.CurrentLeaderEpoch != epoch {
+				respParts[pi].Err = proto.ErrFencedLeaderEpoch
+				if part.CurrentLeaderEpoch > epoch {
+					respParts[pi].Err = proto.ErrUnknownLeaderEpoch
+				}
+				failed = true
 				continue
 			}
-			if part.FetchOffset > int64(len(messages)) {
+			if hasReplica && replica != nodeID && req.Version >= 11 {
+				// redirect to the follower without returning any data
+				respParts[pi].PreferredReadReplica = replica
+				failed = true
+				continue
+			}
+			highWaterMark := plog.nextOffset()
+			if hwm, ok := s.highWaterMarks[topic.Name][part.ID]; ok {
+				highWaterMark = hwm
+			}
+			respParts[pi].TipOffset = highWaterMark
+			respParts[pi].LastStableOffset = highWaterMark
+			respParts[pi].LogStartOffset = plog.startOffset
+			if part.FetchOffset < plog.startOffset || part.FetchOffset > plog.nextOffset() {
 				respParts[pi].Err = proto.ErrOffsetOutOfRange
+				failed = true
 				continue
 			}
-			respParts[pi].TipOffset = int64(len(messages))
-			respParts[pi].Messages = messages[part.FetchOffset:]
-			numFetched := len(respParts[pi].Messages)
-			if numFetched > 0 || !strings.HasPrefix(topic.Name, "__") {
-				log.Infof("fetched %d messages from %s:%d at offset %d",
-					numFetched, topic.Name, part.ID, part.FetchOffset)
+			messages := plog.messages[part.FetchOffset-plog.startOffset:]
+			if committed := highWaterMark - part.FetchOffset; committed < int64(len(messages)) {
+				if committed < 0 {
+					committed = 0
+				}
+				messages = messages[:committed]
+			}
+			if s.configs[topic.Name][cleanupPolicyConfig] == "compact" {
+				messages = compacted(plog.messages, messages)
+			}
+			if s.maxRecordsPerFetch > 0 && len(messages) > s.maxRecordsPerFetch {
+				messages = messages[:s.maxRecordsPerFetch]
+			}
+
+			// Return as many messages as fit into MaxBytes, but always at
+			// least one so that a consumer cannot get stuck on a message
+			// bigger than its fetch size. With the response budget, only
+			// the first non-empty partition is guaranteed a message.
+			maxBytes := part.MaxBytes
+			atLeastOne := true
+			if budget >= 0 {
+				if budget-size < maxBytes {
+					maxBytes = budget - size
+				}
+				atLeastOne = size == 0
+			}
+			var partSize int32
+			for i, msg := range messages {
+				msize := messageSize(msg, s.messageFormat)
+				if (i > 0 || !atLeastOne) && partSize+msize > maxBytes {
+					messages = messages[:i]
+					break
+				}
+				partSize += msize
+			}
+			respParts[pi].Messages = messages
+			size += partSize
+			for _, txn := range s.abortedTxns[topic.Name][part.ID] {
+				respParts[pi].AbortedTransactions = append(respParts[pi].AbortedTransactions,
+					proto.FetchRespAbortedTransaction{
+						ProducerID:  txn.ProducerID,
+						FirstOffset: txn.FirstOffset,
+					})
 			}
 		}
 	}
+	return resp, failed || size >= req.MinBytes || requested == 0
+}
 
-	return resp
+// compacted returns messages that are not superseded by a later message with
+// the same key in the whole partition log.
+func compacted(all []*proto.Message, messages []*proto.Message) []*proto.Message {
+	latest := make(map[string]int64)
+	for _, msg := range all {
+		if msg.Key != nil {
+			latest[string(msg.Key)] = msg.Offset
+		}
+	}
+
+	kept := make([]*proto.Message, 0, len(messages))
+	for _, msg := range messages {
+		if msg.Key == nil || latest[string(msg.Key)] == msg.Offset {
+			kept = append(kept, msg)
+		}
+	}
+	return kept
+}
+
+// OutstandingFetches returns the number of long polling fetch requests that
+// are currently waiting for data. It allows checking that a consumer is
+// parked in a fetch rather than stuck elsewhere.
+func (s *Server) OutstandingFetches() int {
+	return int(atomic.LoadInt32(&s.parkedFetches))
+}
+
+// wakeFetchers wakes up all fetch requests waiting for new messages, so that
+// they can check if their request can be served.
+func (s *Server) wakeFetchers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fetchCond.Broadcast()
+}
+
+// messageSize returns the number of bytes given message takes in a message
+// set encoded with given message format.
+func messageSize(m *proto.Message, format int8) int32 {
+	// offset + message size + crc + magic byte + attributes + key + value
+	size := int32(8 + 4 + 4 + 1 + 1 + 4 + len(m.Key) + 4 + len(m.Value))
+	if format >= proto.MessageFormatV1 {
+		size += 8 // timestamp
+	}
+	return size
 }
 
 func (s *Server) handleOffsetRequest(
@@ -461,6 +2939,7 @@ func (s *Server) handleOffsetRequest(
 	defer s.mu.RUnlock()
 
 	resp := &proto.OffsetResp{
+		Version:       req.Version,
 		CorrelationID: req.CorrelationID,
 		Topics:        make([]proto.OffsetRespTopic, len(req.Topics)),
 	}
@@ -470,25 +2949,44 @@ func (s *Server) handleOffsetRequest(
 		resp.Topics[ti].Partitions = respPart
 		for pi, part := range topic.Partitions {
 			respPart[pi].ID = part.ID
+			respPart[pi].TimeMs = -1
+			if s.misCased(topic.Name) {
+				respPart[pi].Err = proto.ErrUnknownTopicOrPartition
+				continue
+			}
+			if s.leader(part.ID, nodeID) != nodeID {
+				respPart[pi].Err = proto.ErrNotLeaderForPartition
+				continue
+			}
 			switch part.TimeMs {
 			case -1: // latest
-				msgs := len(s.topics[topic.Name][part.ID])
-				respPart[pi].Offsets = []int64{int64(msgs), 0}
-				log.Infof("requested latest offset from %s:%d, returning %d",
-					topic.Name, part.ID, msgs)
+				var latest int64
+				if plog, ok := s.topics[topic.Name][part.ID]; ok {
+					latest = plog.nextOffset()
+				}
+				respPart[pi].Offsets = []int64{latest, 0}
+				s.logger().Infof("requested latest offset from %s:%d, returning %d",
+					topic.Name, part.ID, latest)
 			case -2: // earliest
-				respPart[pi].Offsets = []int64{0, 0}
-				log.Infof("requested earliest offset from %s:%d, returning %d",
-					topic.Name, part.ID, 0)
+				var earliest int64
+				if plog, ok := s.topics[topic.Name][part.ID]; ok {
+					earliest = plog.startOffset
+				}
+				respPart[pi].Offsets = []int64{earliest, 0}
+				s.logger().Infof("requested earliest offset from %s:%d, returning %d",
+					topic.Name, part.ID, earliest)
 			default:
-				log.Errorf("offset time for %s:%d not supported: %d",
+				s.logger().Errorf("offset time for %s:%d not supported: %d",
 					topic.Name, part.ID, part.TimeMs)
 				return nil
 			}
 
 			// Now if they've asked for fewer, cut some off -- unclear if this
-			// is correct but it seems so given what we support right now
-			respPart[pi].Offsets = respPart[pi].Offsets[0:part.MaxOffsets]
+			// is correct but it seems so given what we support right now.
+			// Since v1 the number of offsets is not requested.
+			if req.Version == 0 {
+				respPart[pi].Offsets = respPart[pi].Offsets[0:part.MaxOffsets]
+			}
 		}
 	}
 	return resp
@@ -497,25 +2995,51 @@ func (s *Server) handleOffsetRequest(
 func (s *Server) handleGroupCoordinatorRequest(
 	nodeID int32, conn net.Conn, req *proto.GroupCoordinatorReq) response {
 
-	// Fetches the read-lock, so try not to do this inside our own RLock
-	// as that can lead to deadlock state if someone happens to try to Lock
-	// while we're inside the first RLock
-	addr := s.Addr()
-
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	log.Infof("requested consumer metadata")
+	s.logger().Infof("requested consumer metadata")
+
+	resp := &proto.GroupCoordinatorResp{
+		Version:       req.Version,
+		CorrelationID: req.CorrelationID,
+	}
+
+	// the server is both the group and the transaction coordinator
+	switch req.CoordinatorType {
+	case proto.CoordinatorGroup, proto.CoordinatorTransaction:
+	default:
+		resp.Err = proto.ErrInvalidRequest
+		resp.ErrMessage = fmt.Sprintf("unknown coordinator type %d", req.CoordinatorType)
+		resp.CoordinatorID = -1
+		resp.CoordinatorPort = -1
+		return resp
+	}
 
-	addrps := strings.Split(addr, ":")
-	port, _ := strconv.Atoi(addrps[1])
+	if s.isolated[nodeID] || s.coordinatorElection {
+		resp.Err = proto.ErrNoCoordinator
+		resp.CoordinatorID = -1
+		resp.CoordinatorPort = -1
+		return resp
+	}
 
-	return &proto.GroupCoordinatorResp{
-		CorrelationID:   req.CorrelationID,
-		CoordinatorID:   0,
-		CoordinatorHost: addrps[0],
-		CoordinatorPort: int32(port),
+	coordinatorID := nodeID
+	if s.coordinatorID != -1 {
+		coordinatorID = s.coordinatorID
 	}
+	for _, broker := range s.brokers {
+		if broker.NodeID == coordinatorID {
+			resp.CoordinatorID = broker.NodeID
+			resp.CoordinatorHost = broker.Host
+			resp.CoordinatorPort = broker.Port
+			return resp
+		}
+	}
+
+	resp.Err = proto.ErrNoCoordinator
+	resp.CoordinatorID = -1
+	resp.CoordinatorPort = -1
+	return resp
 }
 
 func (s *Server) getTopicOffset(group, topic string, partID int32) *topicOffset {
@@ -543,10 +3067,11 @@ func (s *Server) getTopicOffset(group, topic string, partID int32) *topicOffset
 func (s *Server) handleOffsetFetchRequest(
 	nodeID int32, conn net.Conn, req *proto.OffsetFetchReq) response {
 
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
 	resp := &proto.OffsetFetchResp{
+		Version:       req.Version,
 		CorrelationID: req.CorrelationID,
 		Topics:        make([]proto.OffsetFetchRespTopic, len(req.Topics)),
 	}
@@ -555,12 +3080,33 @@ func (s *Server) handleOffsetFetchRequest(
 		resp.Topics[ti].Name = topic.Name
 		resp.Topics[ti].Partitions = respPart
 		for pi, part := range topic.Partitions {
-			toffset := s.getTopicOffset(req.ConsumerGroup, topic.Name, part)
 			respPart[pi].ID = part
-			respPart[pi].Metadata = toffset.metadata
-			respPart[pi].Offset = toffset.offset
-			log.Infof("requested committed offset for group %s from %s:%d, returning %d",
-				req.ConsumerGroup, topic.Name, part, toffset.offset)
+			respPart[pi].Offset = -1
+
+			if !s.isCoordinator(nodeID) {
+				respPart[pi].Err = proto.ErrNotCoordinator
+				continue
+			}
+			if s.offsetsLoading {
+				respPart[pi].Err = proto.ErrOffsetLoadInProgress
+				continue
+			}
+			if err := s.offsetFetchErrors[topic.Name][part]; err != nil {
+				respPart[pi].Err = err
+				continue
+			}
+			if s.misCased(topic.Name) {
+				respPart[pi].Err = proto.ErrUnknownTopicOrPartition
+				continue
+			}
+
+			// offset that was never committed is reported as -1
+			if toffset, ok := s.offsets[topic.Name][part][req.ConsumerGroup]; ok {
+				respPart[pi].Metadata = toffset.metadata
+				respPart[pi].Offset = toffset.offset
+			}
+			s.logger().Infof("requested committed offset for group %s from %s:%d, returning %d",
+				req.ConsumerGroup, topic.Name, part, respPart[pi].Offset)
 		}
 	}
 	return resp
@@ -569,27 +3115,75 @@ func (s *Server) handleOffsetFetchRequest(
 func (s *Server) handleOffsetCommitRequest(
 	nodeID int32, conn net.Conn, req *proto.OffsetCommitReq) response {
 
+	// notify about stored offsets once the lock is released
+	var committed []commitEvent
+	defer func() { s.notifyCommitted(committed) }()
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	resp := &proto.OffsetCommitResp{
+		Version:       req.Version,
 		CorrelationID: req.CorrelationID,
 		Topics:        make([]proto.OffsetCommitRespTopic, len(req.Topics)),
 	}
+
+	failErr, fail := s.commitFailures[req.ConsumerGroup]
+	delete(s.commitFailures, req.ConsumerGroup)
+
 	for ti, topic := range req.Topics {
 		respPart := make([]proto.OffsetCommitRespPartition, len(topic.Partitions))
 		resp.Topics[ti].Name = topic.Name
 		resp.Topics[ti].Partitions = respPart
 		for pi, part := range topic.Partitions {
+			if !s.isCoordinator(nodeID) {
+				respPart[pi].ID = part.ID
+				respPart[pi].Err = proto.ErrNotCoordinator
+				continue
+			}
+			if fail {
+				respPart[pi].ID = part.ID
+				respPart[pi].Err = failErr
+				s.logger().Infof("failed offset commit for group %s to %s:%d: %s",
+					req.ConsumerGroup, topic.Name, part.ID, failErr)
+				continue
+			}
+			if s.misCased(topic.Name) {
+				respPart[pi].ID = part.ID
+				respPart[pi].Err = proto.ErrUnknownTopicOrPartition
+				continue
+			}
+			if _, ok := s.topics[topic.Name][part.ID]; !ok && s.validateCommits {
+				respPart[pi].ID = part.ID
+				respPart[pi].Err = proto.ErrUnknownTopicOrPartition
+				s.logger().Infof("rejected offset commit for group %s to unknown %s:%d",
+					req.ConsumerGroup, topic.Name, part.ID)
+				continue
+			}
+			if s.maxOffsetMetadata > 0 && len(part.Metadata) > s.maxOffsetMetadata {
+				respPart[pi].ID = part.ID
+				respPart[pi].Err = proto.ErrOffsetMetadataTooLarge
+				s.logger().Infof("rejected offset commit for group %s to %s:%d: %d bytes of metadata",
+					req.ConsumerGroup, topic.Name, part.ID, len(part.Metadata))
+				continue
+			}
 			toffset := s.getTopicOffset(req.ConsumerGroup, topic.Name, part.ID)
 			toffset.metadata = part.Metadata
 			toffset.offset = part.Offset
+			committed = append(committed, commitEvent{
+				group:     req.ConsumerGroup,
+				topic:     topic.Name,
+				partition: part.ID,
+				offset:    part.Offset,
+				metadata:  part.Metadata,
+			})
 
 			respPart[pi].ID = part.ID
-			log.Infof("committed offset for group %s from %s:%d, saved %d",
+			s.logger().Infof("committed offset for group %s from %s:%d, saved %d",
 				req.ConsumerGroup, topic.Name, part.ID, part.Offset)
 		}
 	}
+	s.commitCond.Broadcast()
 	return resp
 }
 
@@ -599,53 +3193,258 @@ func (s *Server) handleMetadataRequest(
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	log.Infof("requested metadata")
+	s.logger().Infof("requested metadata")
+
+	for _, cm := range s.connMetadata {
+		if cm.match(conn) {
+			resp := *cm.resp
+			resp.Version = req.Version
+			resp.CorrelationID = req.CorrelationID
+			return &resp
+		}
+	}
 
 	resp := &proto.MetadataResp{
+		Version:       req.Version,
 		CorrelationID: req.CorrelationID,
 		Topics:        make([]proto.MetadataRespTopic, 0, len(s.topics)),
-		Brokers:       s.brokers,
+		Brokers:       append([]proto.MetadataRespBroker{}, s.brokers...),
+		ClusterID:     s.clusterID,
+		ControllerID:  nodeID,
+	}
+
+	if s.hideBrokers {
+		resp.Brokers = []proto.MetadataRespBroker{}
+	}
+	if len(s.nodes) != 0 {
+		resp.ControllerID = s.nodes[0]
+	}
+
+	// since v1, empty topic list means no topics rather than all of them
+	if req.Version >= 1 && req.Topics != nil && len(req.Topics) == 0 {
+		return resp
 	}
 
 	if req.Topics != nil && len(req.Topics) > 0 {
 		// if particular topic was requested, create empty log if does not yet exists
 		for _, name := range req.Topics {
+			if !validTopicName(name) {
+				resp.Topics = append(resp.Topics, proto.MetadataRespTopic{
+					Name:       name,
+					Err:        proto.ErrInvalidTopic,
+					Partitions: []proto.MetadataRespPartition{},
+				})
+				continue
+			}
 			partitions, ok := s.topics[name]
+			// since v4, clients choose whether topics may be created
+			noCreate := req.Version >= 4 && !req.AllowAutoTopicCreation
+			if !ok && (noCreate || !s.canAutoCreate(name) || s.misCased(name)) {
+				resp.Topics = append(resp.Topics, proto.MetadataRespTopic{
+					Name:       name,
+					Err:        proto.ErrUnknownTopicOrPartition,
+					Partitions: []proto.MetadataRespPartition{},
+				})
+				continue
+			}
 			if !ok {
-				partitions = make(map[int32][]*proto.Message)
-				partitions[0] = make([]*proto.Message, 0)
-				s.topics[name] = partitions
-			}
-
-			parts := make([]proto.MetadataRespPartition, len(partitions))
-			for pid := range partitions {
-				p := &parts[pid]
-				p.ID = pid
-				p.Leader = nodeID
-				p.Replicas = []int32{nodeID}
-				p.Isrs = []int32{nodeID}
-			}
-			resp.Topics = append(resp.Topics, proto.MetadataRespTopic{
-				Name:       name,
-				Partitions: parts,
-			})
+				partitions = s.createTopic(name)
+				partitions[0] = &partitionLog{messages: make([]*proto.Message, 0)}
+			}
 
+			if !s.topicVisible(name) {
+				// the topic exists, but the metadata served is older
+				resp.Topics = append(resp.Topics, proto.MetadataRespTopic{
+					Name:       name,
+					Err:        proto.ErrLeaderNotAvailable,
+					Partitions: []proto.MetadataRespPartition{},
+				})
+				continue
+			}
+			resp.Topics = append(resp.Topics, s.metadataTopic(nodeID, name, partitions))
 		}
 	} else {
 		for name, partitions := range s.topics {
-			parts := make([]proto.MetadataRespPartition, len(partitions))
-			for pid := range partitions {
-				p := &parts[pid]
-				p.ID = pid
-				p.Leader = nodeID
-				p.Replicas = []int32{nodeID}
-				p.Isrs = []int32{nodeID}
-			}
-			resp.Topics = append(resp.Topics, proto.MetadataRespTopic{
-				Name:       name,
-				Partitions: parts,
+			if !s.topicVisible(name) {
+				continue
+			}
+			resp.Topics = append(resp.Topics, s.metadataTopic(nodeID, name, partitions))
+		}
+	}
+	return resp
+}
+
+// metadataTopic returns metadata description of given topic with partitions
+// ordered by their IDs. It must be called with the lock held.
+func (s *Server) metadataTopic(
+	nodeID int32, name string, partitions map[int32]*partitionLog) proto.MetadataRespTopic {
+
+	ids := make([]int, 0, len(partitions))
+	for pid := range partitions {
+		ids = append(ids, int(pid))
+	}
+	sort.Ints(ids)
+
+	parts := make([]proto.MetadataRespPartition, len(ids))
+	for i, pid := range ids {
+		p := &parts[i]
+		p.ID = int32(pid)
+		p.Leader = s.leader(p.ID, nodeID)
+		p.LeaderEpoch = s.leaderEpochs[name][p.ID]
+		p.Replicas = s.replicas(name, p.ID, p.Leader, nodeID)
+		p.Isrs = []int32{}
+		for _, replica := range p.Replicas {
+			// the rest of the cluster drops isolated brokers from ISR,
+			// while the isolated broker itself is not aware of it
+			if !s.isolated[nodeID] && s.isolated[replica] {
+				continue
+			}
+			if !s.outOfSync[name][p.ID][replica] {
+				p.Isrs = append(p.Isrs, replica)
+			}
+		}
+		p.Err = s.metadataErrors[name][p.ID]
+		if s.offline[name][p.ID] {
+			p.Leader = -1
+			p.Isrs = []int32{}
+			p.Err = proto.ErrLeaderNotAvailable
+		}
+	}
+	return proto.MetadataRespTopic{
+		Name:       name,
+		IsInternal: internalTopics[name],
+		Partitions: parts,
+	}
+}
+
+func (s *Server) handleDescribeConfigsRequest(
+	nodeID int32, conn net.Conn, req *proto.DescribeConfigsReq) response {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	resp := &proto.DescribeConfigsResp{
+		CorrelationID: req.CorrelationID,
+		Resources:     make([]proto.DescribeConfigsRespResource, len(req.Resources)),
+	}
+	for ri, res := range req.Resources {
+		respRes := &resp.Resources[ri]
+		respRes.Type = res.Type
+		respRes.Name = res.Name
+		respRes.Configs = []proto.DescribeConfigsRespConfig{}
+
+		// only topics have configuration, other resources are described
+		// as having none
+		if res.Type != proto.ConfigResourceTopic {
+			continue
+		}
+		if _, ok := s.topics[res.Name]; !ok {
+			respRes.Err = proto.ErrUnknownTopicOrPartition
+			continue
+		}
+
+		var names []string
+		if res.ConfigNames != nil {
+			names = res.ConfigNames
+		} else {
+			for name := range s.configs[res.Name] {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+		for _, name := range names {
+			value, ok := s.configs[res.Name][name]
+			if !ok {
+				continue
+			}
+			respRes.Configs = append(respRes.Configs, proto.DescribeConfigsRespConfig{
+				Name:  name,
+				Value: value,
 			})
 		}
+		s.logger().Infof("described %d configs of topic %s", len(respRes.Configs), res.Name)
+	}
+	return resp
+}
+
+func (s *Server) handleAlterConfigsRequest(
+	nodeID int32, conn net.Conn, req *proto.AlterConfigsReq) response {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := &proto.AlterConfigsResp{
+		CorrelationID: req.CorrelationID,
+		Resources:     make([]proto.AlterConfigsRespResource, len(req.Resources)),
+	}
+	for ri, res := range req.Resources {
+		respRes := &resp.Resources[ri]
+		respRes.Type = res.Type
+		respRes.Name = res.Name
+
+		if res.Type != proto.ConfigResourceTopic {
+			respRes.Err = proto.ErrInvalidConfig
+			respRes.ErrMessage = "only topic configuration can be altered"
+			continue
+		}
+		if _, ok := s.topics[res.Name]; !ok {
+			respRes.Err = proto.ErrUnknownTopicOrPartition
+			continue
+		}
+
+		configs := make(map[string]string)
+		for _, conf := range res.Configs {
+			if s.configKeys != nil && !s.configKeys[conf.Name] {
+				respRes.Err = proto.ErrInvalidConfig
+				respRes.ErrMessage = fmt.Sprintf("unknown config %q", conf.Name)
+				break
+			}
+			configs[conf.Name] = conf.Value
+		}
+		if respRes.Err != nil || req.ValidateOnly {
+			continue
+		}
+
+		// like the broker, replace the whole configuration of the topic
+		s.configs[res.Name] = configs
+		s.logger().Infof("altered %d configs of topic %s", len(configs), res.Name)
+	}
+	return resp
+}
+
+func (s *Server) handleDeleteGroupsRequest(
+	nodeID int32, conn net.Conn, req *proto.DeleteGroupsReq) response {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resp := &proto.DeleteGroupsResp{
+		CorrelationID: req.CorrelationID,
+		Groups:        make([]proto.DeleteGroupsRespGroup, len(req.Groups)),
+	}
+	for gi, group := range req.Groups {
+		resp.Groups[gi].Name = group
+		if !s.isCoordinator(nodeID) {
+			resp.Groups[gi].Err = proto.ErrNotCoordinator
+			continue
+		}
+
+		// group membership is not tracked, so every group that committed
+		// offsets is known and empty
+		var deleted int
+		for _, parts := range s.offsets {
+			for _, groups := range parts {
+				if _, ok := groups[group]; ok {
+					delete(groups, group)
+					deleted++
+				}
+			}
+		}
+		if deleted == 0 {
+			resp.Groups[gi].Err = proto.ErrGroupIDNotFound
+			continue
+		}
+		s.logger().Infof("deleted group %s with %d committed offsets", group, deleted)
 	}
 	return resp
 }
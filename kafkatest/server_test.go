@@ -0,0 +1,3571 @@
+package kafkatest
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "gopkg.in/check.v1"
+
+	"github.com/dropbox/kafka/proto"
+)
+
+var _ = Suite(&ServerSuite{})
+
+func Test(t *testing.T) { TestingT(t) }
+
+type ServerSuite struct{}
+
+func (s *ServerSuite) SetUpTest(c *C) {
+	ResetTestLogger(c)
+}
+
+// dialServer returns connection to given mock server, that is closed
+// together with the server.
+func dialServer(c *C, srv *Server) net.Conn {
+	conn, err := net.DialTimeout("tcp", srv.Addr(), time.Second)
+	c.Assert(err, IsNil)
+	return conn
+}
+
+// roundTrip writes request to the connection and returns the raw response.
+func roundTrip(c *C, conn net.Conn, req proto.Request) []byte {
+	_, err := req.WriteTo(conn)
+	c.Assert(err, IsNil)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, b, err := proto.ReadResp(conn)
+	c.Assert(err, IsNil)
+	return b
+}
+
+func (s *ServerSuite) TestHandlerPanicClosesConnection(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	panics := make(chan int16, 1)
+	srv.OnHandlerPanic(func(kind int16, b []byte, recovered interface{}) {
+		panics <- kind
+	})
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	// asking for more offsets than the server has makes the handler panic
+	_, err := (&proto.OffsetReq{
+		CorrelationID: 1,
+		Topics: []proto.OffsetReqTopic{
+			{
+				Name: "test",
+				Partitions: []proto.OffsetReqPartition{
+					{ID: 0, TimeMs: proto.OffsetReqTimeLatest, MaxOffsets: 100},
+				},
+			},
+		},
+	}).WriteTo(conn)
+	c.Assert(err, IsNil)
+
+	select {
+	case kind := <-panics:
+		c.Assert(kind, Equals, int16(proto.OffsetReqKind))
+	case <-time.After(time.Second):
+		c.Fatal("handler panic was not reported")
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+
+	// server keeps serving other clients
+	conn2 := dialServer(c, srv)
+	defer conn2.Close()
+	b := roundTrip(c, conn2, &proto.MetadataReq{CorrelationID: 2})
+	resp, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.CorrelationID, Equals, int32(2))
+}
+
+func (s *ServerSuite) TestStaleMetadata(c *C) {
+	srv := NewServer()
+	srv.AddMessages("old", 0)
+	srv.SetMetadataVersion(1)
+	srv.AddMessages("new", 0)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1})
+	resp, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics, HasLen, 1)
+	c.Assert(resp.Topics[0].Name, Equals, "old")
+
+	b = roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 2, Topics: []string{"new"}})
+	resp, err = proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics, HasLen, 1)
+	c.Assert(resp.Topics[0].Err, Equals, proto.ErrLeaderNotAvailable)
+
+	srv.SetMetadataVersion(2)
+	b = roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 3})
+	resp, err = proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics, HasLen, 2)
+}
+
+func (s *ServerSuite) TestChaosMiddleware(c *C) {
+	srv := NewServer(ChaosMiddleware(ChaosConfig{
+		Rate:  1,
+		Kinds: []int16{proto.ProduceReqKind},
+		Err:   proto.ErrNotLeaderForPartition,
+	}))
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, &proto.ProduceReq{
+		CorrelationID: 7,
+		RequiredAcks:  proto.RequiredAcksLocal,
+		Topics: []proto.ProduceReqTopic{
+			{
+				Name: "test",
+				Partitions: []proto.ProduceReqPartition{
+					{ID: 0, Messages: []*proto.Message{{Value: []byte("a")}}},
+				},
+			},
+		},
+	})
+	resp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.CorrelationID, Equals, int32(7))
+	c.Assert(resp.Topics[0].Partitions[0].Err, Equals, proto.ErrNotLeaderForPartition)
+
+	// not affected request kinds are handled as usual
+	b = roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 8, Topics: []string{"test"}})
+	meta, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(meta.Topics[0].Err, IsNil)
+}
+
+func (s *ServerSuite) TestChaosMiddlewareFetchV11(c *C) {
+	srv := NewServer(ChaosMiddleware(ChaosConfig{
+		Rate:  1,
+		Kinds: []int16{proto.FetchReqKind},
+		Err:   proto.ErrNotLeaderForPartition,
+	}))
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("a")})
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	req := fetchReq("test", 0, 0)
+	req.Version = 11
+	b := roundTrip(c, conn, req)
+	resp, err := proto.ReadVersionedFetchResp(bytes.NewBuffer(b), 11)
+	c.Assert(err, IsNil)
+	part := resp.Topics[0].Partitions[0]
+	c.Assert(part.Err, Equals, proto.ErrNotLeaderForPartition)
+	c.Assert(part.PreferredReadReplica, Equals, int32(-1))
+	c.Assert(part.Messages, HasLen, 0)
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+// pipeListener is in-memory listener, serving connections created by Dial.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *pipeListener) Dial() net.Conn {
+	client, server := net.Pipe()
+	l.conns <- server
+	return client
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	select {
+	case <-l.closed:
+	default:
+		close(l.closed)
+	}
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+func (s *ServerSuite) TestServeCustomListener(c *C) {
+	srv := NewServer()
+	ln := newPipeListener()
+	done := make(chan error)
+	go func() {
+		done <- srv.Serve(ln)
+	}()
+
+	conn := ln.Dial()
+	defer conn.Close()
+	c.Assert(srv.Addr(), Equals, "pipe")
+
+	b := roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1})
+	resp, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Brokers, HasLen, 1)
+	c.Assert(resp.Brokers[0].Host, Equals, "pipe")
+	c.Assert(resp.Brokers[0].Port, Equals, int32(0))
+
+	c.Assert(srv.Close(), IsNil)
+	select {
+	case err := <-done:
+		c.Assert(err, NotNil)
+	case <-time.After(time.Second):
+		c.Fatal("Serve did not return after Close")
+	}
+}
+
+// fetchReq returns fetch request for a single topic partition.
+func fetchReq(topic string, partition int32, offset int64) *proto.FetchReq {
+	return &proto.FetchReq{
+		CorrelationID: 1,
+		Topics: []proto.FetchReqTopic{
+			{
+				Name: topic,
+				Partitions: []proto.FetchReqPartition{
+					{ID: partition, FetchOffset: offset, MaxBytes: 1 << 20},
+				},
+			},
+		},
+	}
+}
+
+func (s *ServerSuite) TestLongPollFetch(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	req := fetchReq("test", 0, 0)
+	req.MaxWaitTime = 5 * time.Second
+	req.MinBytes = 1
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		srv.AddMessages("test", 0, &proto.Message{Value: []byte("first")})
+	}()
+
+	start := time.Now()
+	b := roundTrip(c, conn, req)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+	resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Messages, HasLen, 1)
+}
+
+func (s *ServerSuite) TestResetWakesLongPollFetch(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	req := fetchReq("test", 0, 0)
+	req.MaxWaitTime = 5 * time.Second
+	req.MinBytes = 1
+
+	// keep resetting, as there is no way to tell when the fetch is parked
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(50 * time.Millisecond):
+				srv.ResetTopic("test")
+			}
+		}
+	}()
+
+	start := time.Now()
+	b := roundTrip(c, conn, req)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+	resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Messages, HasLen, 0)
+}
+
+func (s *ServerSuite) TestFullResetWakesLongPollFetch(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	req := fetchReq("test", 0, 0)
+	req.MaxWaitTime = 5 * time.Second
+	req.MinBytes = 1
+
+	go func() {
+		for srv.OutstandingFetches() == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		srv.Reset()
+	}()
+
+	start := time.Now()
+	b := roundTrip(c, conn, req)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+	resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	// the topic is gone after the reset
+	c.Assert(resp.Topics[0].Partitions[0].Err, Equals, proto.ErrUnknownTopicOrPartition)
+	c.Assert(resp.Topics[0].Partitions[0].Messages, HasLen, 0)
+}
+
+func (s *ServerSuite) TestListener(c *C) {
+	srv := NewServer()
+	c.Assert(srv.Listener(), IsNil)
+
+	srv.MustSpawn()
+	defer srv.Close()
+	ln := srv.Listener()
+	c.Assert(ln, NotNil)
+	c.Assert(ln.Addr().String(), Equals, srv.Addr())
+
+	c.Assert(srv.Close(), IsNil)
+	c.Assert(srv.Listener(), IsNil)
+}
+
+func (s *ServerSuite) TestOutstandingFetches(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	c.Assert(srv.OutstandingFetches(), Equals, 0)
+
+	req := fetchReq("test", 0, 0)
+	req.MaxWaitTime = 5 * time.Second
+	req.MinBytes = 1
+	_, err := req.WriteTo(conn)
+	c.Assert(err, IsNil)
+
+	deadline := time.Now().Add(time.Second)
+	for srv.OutstandingFetches() != 1 {
+		c.Assert(time.Now().Before(deadline), Equals, true)
+		time.Sleep(time.Millisecond)
+	}
+
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("a")})
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, b, err := proto.ReadResp(conn)
+	c.Assert(err, IsNil)
+	resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Messages, HasLen, 1)
+	c.Assert(srv.OutstandingFetches(), Equals, 0)
+}
+
+func (s *ServerSuite) TestRawResponse(c *C) {
+	raw := RawResponse{0, 0, 0, 100, 0, 0, 0, 1, 0xff}
+	srv := NewServer(func(nodeID int32, kind int16, b []byte) Response {
+		return raw
+	})
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	_, err := (&proto.MetadataReq{CorrelationID: 1}).WriteTo(conn)
+	c.Assert(err, IsNil)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	b := make([]byte, len(raw))
+	_, err = io.ReadFull(conn, b)
+	c.Assert(err, IsNil)
+	c.Assert(b, DeepEquals, []byte(raw))
+}
+
+func (s *ServerSuite) TestMaxOffsetMetadataBytes(c *C) {
+	srv := NewServer()
+	srv.SetMaxOffsetMetadataBytes(4)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	req := commitReq("group", "test", 0, 5)
+	req.Topics[0].Partitions[0].Metadata = "meta"
+	b := roundTrip(c, conn, req)
+	resp, err := proto.ReadOffsetCommitResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+
+	req = commitReq("group", "test", 0, 6)
+	req.Topics[0].Partitions[0].Metadata = "metadata"
+	b = roundTrip(c, conn, req)
+	resp, err = proto.ReadOffsetCommitResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, Equals, proto.ErrOffsetMetadataTooLarge)
+	c.Assert(committedOffset(c, conn, "group", "test", 0), Equals, int64(5))
+}
+
+func (s *ServerSuite) TestValidateCommitTargets(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 1)
+	srv.SetValidateCommitTargets(true)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	cases := []struct {
+		topic     string
+		partition int32
+		err       error
+	}{
+		{"test", 0, nil},
+		{"test", 1, nil},
+		{"test", 2, proto.ErrUnknownTopicOrPartition},
+		{"unknown", 0, proto.ErrUnknownTopicOrPartition},
+	}
+	for _, tc := range cases {
+		b := roundTrip(c, conn, commitReq("group", tc.topic, tc.partition, 5))
+		resp, err := proto.ReadOffsetCommitResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		c.Assert(resp.Topics[0].Partitions[0].Err, Equals, tc.err,
+			Commentf("%s:%d", tc.topic, tc.partition))
+	}
+	c.Assert(committedOffset(c, conn, "group", "test", 2), Equals, int64(-1))
+
+	srv.SetValidateCommitTargets(false)
+	b := roundTrip(c, conn, commitReq("group", "unknown", 0, 5))
+	resp, err := proto.ReadOffsetCommitResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+}
+
+func (s *ServerSuite) TestReplicationDelay(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0)
+	srv.SetReplicationDelay(100 * time.Millisecond)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	req := produceReq("test", 0, "a")
+	req.RequiredAcks = proto.RequiredAcksAll
+	req.Timeout = 900 * time.Millisecond
+	start := time.Now()
+	b := roundTrip(c, conn, req)
+	c.Assert(time.Since(start) >= 100*time.Millisecond, Equals, true)
+	resp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+
+	// replication takes longer than the producer is willing to wait
+	req = produceReq("test", 0, "b")
+	req.RequiredAcks = proto.RequiredAcksAll
+	req.Timeout = 10 * time.Millisecond
+	b = roundTrip(c, conn, req)
+	resp, err = proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, Equals, proto.ErrRequestTimeout)
+	// as with a broker, timed out messages were appended nevertheless
+	c.Assert(srv.DrainTopic("test")[0], HasLen, 2)
+
+	// leader acknowledgement is not delayed
+	b = roundTrip(c, conn, produceReq("test", 0, "c"))
+	resp, err = proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+
+	b = roundTrip(c, conn, fetchReq("test", 0, 0))
+	fresp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(fresp.Topics[0].Partitions[0].Messages, HasLen, 3)
+}
+
+func (s *ServerSuite) TestReplicationDelayClose(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0)
+	srv.SetReplicationDelay(time.Minute)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	req := produceReq("test", 0, "a")
+	req.RequiredAcks = proto.RequiredAcksAll
+	_, err := req.WriteTo(conn)
+	c.Assert(err, IsNil)
+	time.Sleep(50 * time.Millisecond)
+
+	// closing the server interrupts the delay and closes the connection
+	c.Assert(srv.Close(), IsNil)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = proto.ReadResp(conn)
+	c.Assert(err, Equals, io.EOF)
+	c.Assert(srv.DrainTopic("test")[0], HasLen, 1)
+}
+
+func (s *ServerSuite) TestOnCommit(c *C) {
+	srv := NewServer()
+	srv.FailNextCommit("failing", proto.ErrRebalanceInProgress)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	var commits []string
+	srv.OnCommit(func(group, topic string, partition int32, offset int64, metadata string) {
+		// the lock is not held, so the server can be used
+		srv.AddMessages("observed", 0)
+		commits = append(commits, fmt.Sprintf("%s %s:%d %d %s", group, topic, partition, offset, metadata))
+	})
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	req := commitReq("group", "test", 0, 5)
+	req.Topics[0].Partitions = append(req.Topics[0].Partitions,
+		proto.OffsetCommitReqPartition{ID: 1, Offset: 7, Metadata: "meta"})
+	roundTrip(c, conn, req)
+	roundTrip(c, conn, commitReq("failing", "test", 0, 1))
+
+	c.Assert(commits, DeepEquals, []string{
+		"group test:0 5 ",
+		"group test:1 7 meta",
+	})
+}
+
+func (s *ServerSuite) TestBrokerRack(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+	srv.SetRack(100, "rack-a")
+	srv.AddBroker(200, "10.0.0.2", 9092, "rack-b")
+	srv.AddBroker(300, "10.0.0.3", 9092)
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, &proto.MetadataReq{Version: 1, CorrelationID: 1})
+	resp, err := proto.ReadVersionedMetadataResp(bytes.NewBuffer(b), 1)
+	c.Assert(err, IsNil)
+	racks := make(map[int32]string)
+	for _, broker := range resp.Brokers {
+		racks[broker.NodeID] = broker.Rack
+	}
+	c.Assert(racks, DeepEquals, map[int32]string{100: "rack-a", 200: "rack-b", 300: ""})
+
+	// replacing the broker
+	srv.AddBroker(200, "10.0.0.4", 9093)
+	b = roundTrip(c, conn, &proto.MetadataReq{Version: 1, CorrelationID: 2})
+	resp, err = proto.ReadVersionedMetadataResp(bytes.NewBuffer(b), 1)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Brokers, HasLen, 3)
+	c.Assert(resp.Brokers[1], DeepEquals, proto.MetadataRespBroker{NodeID: 200, Host: "10.0.0.4", Port: 9093})
+}
+
+func (s *ServerSuite) TestExpectOnly(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0)
+	srv.ExpectOnly(proto.MetadataReqKind, proto.FetchReqKind)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1})
+	roundTrip(c, conn, fetchReq("test", 0, 0))
+	c.Assert(srv.Violations(), HasLen, 0)
+
+	// unexpected requests are still handled
+	b := roundTrip(c, conn, produceReq("test", 0, "a"))
+	resp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+	roundTrip(c, conn, commitReq("group", "test", 0, 1))
+	c.Assert(srv.Violations(), DeepEquals, []int16{proto.ProduceReqKind, proto.OffsetCommitReqKind})
+
+	srv.ExpectOnly()
+	roundTrip(c, conn, produceReq("test", 0, "b"))
+	c.Assert(srv.Violations(), HasLen, 0)
+}
+
+func (s *ServerSuite) TestDrainTopic(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0, &proto.Message{Key: []byte("k"), Value: []byte("a")})
+	srv.AddMessages("test", 2, &proto.Message{Value: []byte("b")}, &proto.Message{})
+
+	parts := srv.DrainTopic("test")
+	c.Assert(parts, HasLen, 3)
+	c.Assert(parts[1], HasLen, 0)
+	c.Assert(parts[2], HasLen, 2)
+	c.Assert(parts[2][1].Offset, Equals, int64(1))
+	c.Assert(parts[2][1].Value, IsNil)
+
+	// copies do not share memory with the server
+	parts[0][0].Key[0] = 'x'
+	parts[0][0].Offset = 10
+	again := srv.DrainTopic("test")
+	c.Assert(string(again[0][0].Key), Equals, "k")
+	c.Assert(again[0][0].Offset, Equals, int64(0))
+
+	c.Assert(srv.DrainTopic("unknown"), HasLen, 0)
+}
+
+func (s *ServerSuite) TestDedupByKey(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0)
+	srv.SetDedupByKey("test", 100*time.Millisecond)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	produce := func(keys ...string) {
+		req := produceReq("test", 0, keys...)
+		for i, msg := range req.Topics[0].Partitions[0].Messages {
+			if keys[i] != "" {
+				msg.Key = []byte(keys[i])
+			}
+		}
+		b := roundTrip(c, conn, req)
+		resp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+	}
+
+	produce("a", "b", "a", "")
+	produce("b", "c", "")
+	time.Sleep(150 * time.Millisecond)
+	produce("a")
+
+	var stored []string
+	for _, msg := range srv.DrainTopic("test")[0] {
+		stored = append(stored, string(msg.Key))
+	}
+	c.Assert(stored, DeepEquals, []string{"a", "b", "", "c", "", "a"})
+}
+
+type captureLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *captureLogger) Infof(format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs = append(l.logs, fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) Errorf(format string, args ...interface{}) {
+	l.Infof(format, args...)
+}
+
+func (s *ServerSuite) TestServerLogger(c *C) {
+	logger := &captureLogger{}
+	srv := NewServer()
+	srv.SetLogger(logger)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+	roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1})
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	c.Assert(logger.logs, DeepEquals, []string{"requested metadata"})
+}
+
+// produceReq returns produce request for a single topic partition.
+func produceReq(topic string, partition int32, values ...string) *proto.ProduceReq {
+	messages := make([]*proto.Message, len(values))
+	for i, v := range values {
+		messages[i] = &proto.Message{Value: []byte(v)}
+	}
+	return &proto.ProduceReq{
+		CorrelationID: 1,
+		RequiredAcks:  proto.RequiredAcksLocal,
+		Topics: []proto.ProduceReqTopic{
+			{
+				Name: topic,
+				Partitions: []proto.ProduceReqPartition{
+					{ID: partition, Messages: messages},
+				},
+			},
+		},
+	}
+}
+
+func (s *ServerSuite) TestPauseTopic(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("a")})
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	srv.PauseTopic("test")
+
+	b := roundTrip(c, conn, produceReq("test", 0, "b"))
+	presp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(presp.Topics[0].Partitions[0].Err, Equals, proto.ErrLeaderNotAvailable)
+
+	b = roundTrip(c, conn, fetchReq("test", 0, 0))
+	fresp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(fresp.Topics[0].Partitions[0].Err, Equals, proto.ErrLeaderNotAvailable)
+
+	srv.ResumeTopic("test")
+
+	b = roundTrip(c, conn, produceReq("test", 0, "b"))
+	presp, err = proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(presp.Topics[0].Partitions[0].Err, IsNil)
+
+	b = roundTrip(c, conn, fetchReq("test", 0, 0))
+	fresp, err = proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(fresp.Topics[0].Partitions[0].Err, IsNil)
+	c.Assert(fresp.Topics[0].Partitions[0].Messages, HasLen, 2)
+}
+
+func (s *ServerSuite) TestPauseTopicBlocking(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("a")})
+	srv.SetPauseBlocking(true)
+	srv.PauseTopic("test")
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		srv.ResumeTopic("test")
+	}()
+
+	start := time.Now()
+	b := roundTrip(c, conn, fetchReq("test", 0, 0))
+	c.Assert(time.Since(start) >= 50*time.Millisecond, Equals, true)
+	resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Messages, HasLen, 1)
+}
+
+func (s *ServerSuite) TestPauseTopicBlockingClose(c *C) {
+	srv := NewServer()
+	srv.SetPauseBlocking(true)
+	srv.PauseTopic("test")
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	_, err := fetchReq("test", 0, 0).WriteTo(conn)
+	c.Assert(err, IsNil)
+	time.Sleep(50 * time.Millisecond)
+
+	// closing the server releases the blocked request and its connection
+	c.Assert(srv.Close(), IsNil)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = proto.ReadResp(conn)
+	c.Assert(err, Equals, io.EOF)
+}
+
+// commitReq returns offset commit request for a single topic partition.
+func commitReq(group, topic string, partition int32, offset int64) *proto.OffsetCommitReq {
+	return &proto.OffsetCommitReq{
+		CorrelationID: 1,
+		ConsumerGroup: group,
+		Topics: []proto.OffsetCommitReqTopic{
+			{
+				Name: topic,
+				Partitions: []proto.OffsetCommitReqPartition{
+					{ID: partition, Offset: offset},
+				},
+			},
+		},
+	}
+}
+
+// committedOffset returns offset committed by the group, as reported by the
+// server.
+func committedOffset(c *C, conn net.Conn, group, topic string, partition int32) int64 {
+	b := roundTrip(c, conn, &proto.OffsetFetchReq{
+		CorrelationID: 1,
+		ConsumerGroup: group,
+		Topics: []proto.OffsetFetchReqTopic{
+			{Name: topic, Partitions: []int32{partition}},
+		},
+	})
+	resp, err := proto.ReadOffsetFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	return resp.Topics[0].Partitions[0].Offset
+}
+
+func (s *ServerSuite) TestFailNextCommit(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, commitReq("g", "test", 0, 5))
+	resp, err := proto.ReadOffsetCommitResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+
+	srv.FailNextCommit("g", proto.ErrRequestTimeout)
+
+	b = roundTrip(c, conn, commitReq("g", "test", 0, 10))
+	resp, err = proto.ReadOffsetCommitResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, Equals, proto.ErrRequestTimeout)
+	c.Assert(committedOffset(c, conn, "g", "test", 0), Equals, int64(5))
+
+	b = roundTrip(c, conn, commitReq("g", "test", 0, 10))
+	resp, err = proto.ReadOffsetCommitResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+	c.Assert(committedOffset(c, conn, "g", "test", 0), Equals, int64(10))
+}
+
+func (s *ServerSuite) TestProduceMessages(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	for _, codec := range []proto.Compression{
+		proto.CompressionNone,
+		proto.CompressionGzip,
+		proto.CompressionSnappy,
+	} {
+		srv.ResetTopic("test")
+		err := srv.ProduceMessages("test", 0, codec,
+			&proto.Message{Value: []byte("first")},
+			&proto.Message{Key: []byte("k"), Value: []byte("second")})
+		c.Assert(err, IsNil)
+
+		conn := dialServer(c, srv)
+		b := roundTrip(c, conn, fetchReq("test", 0, 0))
+		conn.Close()
+		resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		messages := resp.Topics[0].Partitions[0].Messages
+		c.Assert(messages, HasLen, 2)
+		c.Assert(messages[0].Offset, Equals, int64(0))
+		c.Assert(string(messages[0].Value), Equals, "first")
+		c.Assert(messages[1].Offset, Equals, int64(1))
+		c.Assert(string(messages[1].Key), Equals, "k")
+		c.Assert(string(messages[1].Value), Equals, "second")
+	}
+}
+
+func (s *ServerSuite) TestProduceMessagesDroppedAck(c *C) {
+	srv := NewServer()
+	srv.DropNextProduceAck("test", 0)
+	srv.AddMessages("test", 0)
+	c.Assert(srv.ProduceMessages("test", 0, proto.CompressionNone, &proto.Message{Value: []byte("a")}), IsNil)
+	c.Assert(srv.topics["test"][0].messages, HasLen, 1)
+}
+
+func (s *ServerSuite) TestMetadataPartitionError(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 1)
+	srv.SetMetadataPartitionError("test", 1, proto.ErrReplicaNotAvailable)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1, Topics: []string{"test"}})
+	resp, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	parts := resp.Topics[0].Partitions
+	c.Assert(parts, HasLen, 2)
+	c.Assert(parts[0].Err, IsNil)
+	c.Assert(parts[1].Err, Equals, proto.ErrReplicaNotAvailable)
+	c.Assert(parts[1].Leader, Equals, int32(100))
+
+	srv.SetMetadataPartitionError("test", 1, nil)
+	b = roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 2, Topics: []string{"test"}})
+	resp, err = proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[1].Err, IsNil)
+}
+
+func (s *ServerSuite) TestOffsetFetchErrors(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	fetch := func() []proto.OffsetFetchRespPartition {
+		b := roundTrip(c, conn, &proto.OffsetFetchReq{
+			CorrelationID: 1,
+			ConsumerGroup: "g",
+			Topics: []proto.OffsetFetchReqTopic{
+				{Name: "test", Partitions: []int32{0, 1}},
+			},
+		})
+		resp, err := proto.ReadOffsetFetchResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		return resp.Topics[0].Partitions
+	}
+
+	srv.SetOffsetFetchError("test", 1, proto.ErrUnknownTopicOrPartition)
+	parts := fetch()
+	c.Assert(parts[0].Err, IsNil)
+	c.Assert(parts[1].Err, Equals, proto.ErrUnknownTopicOrPartition)
+
+	srv.SetOffsetsLoading(true)
+	parts = fetch()
+	c.Assert(parts[0].Err, Equals, proto.ErrOffsetLoadInProgress)
+	c.Assert(parts[1].Err, Equals, proto.ErrOffsetLoadInProgress)
+
+	srv.SetOffsetsLoading(false)
+	srv.SetOffsetFetchError("test", 1, nil)
+	parts = fetch()
+	c.Assert(parts[0].Err, IsNil)
+	c.Assert(parts[1].Err, IsNil)
+}
+
+func (s *ServerSuite) TestOffsetFetchNeverCommitted(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	c.Assert(committedOffset(c, conn, "g", "test", 0), Equals, int64(-1))
+	// fetching must not create the offset entry
+	c.Assert(committedOffset(c, conn, "g", "test", 0), Equals, int64(-1))
+
+	b := roundTrip(c, conn, commitReq("g", "test", 0, 0))
+	resp, err := proto.ReadOffsetCommitResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+	c.Assert(committedOffset(c, conn, "g", "test", 0), Equals, int64(0))
+
+	// other groups did not commit anything
+	c.Assert(committedOffset(c, conn, "other", "test", 0), Equals, int64(-1))
+}
+
+func (s *ServerSuite) TestWaitForCommit(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	committed := make(chan error, 1)
+	go func() {
+		for offset := int64(1); offset <= 3; offset++ {
+			time.Sleep(20 * time.Millisecond)
+			if _, err := commitReq("g", "test", 0, offset).WriteTo(conn); err != nil {
+				committed <- err
+				return
+			}
+			if _, _, err := proto.ReadResp(conn); err != nil {
+				committed <- err
+				return
+			}
+		}
+		committed <- nil
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c.Assert(srv.WaitForCommit(ctx, "g", "test", 0, 3), IsNil)
+	c.Assert(<-committed, IsNil)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := srv.WaitForCommit(ctx, "g", "test", 0, 4)
+	c.Assert(err, Equals, context.DeadlineExceeded)
+}
+
+func (s *ServerSuite) TestAutoCreatePattern(c *C) {
+	srv := NewServer()
+	srv.SetAutoCreatePattern("^allowed-")
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, produceReq("denied", 0, "a"))
+	presp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(presp.Topics[0].Partitions[0].Err, Equals, proto.ErrUnknownTopicOrPartition)
+
+	b = roundTrip(c, conn, produceReq("allowed-1", 0, "a"))
+	presp, err = proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(presp.Topics[0].Partitions[0].Err, IsNil)
+
+	b = roundTrip(c, conn, &proto.MetadataReq{
+		CorrelationID: 1,
+		Topics:        []string{"denied", "allowed-2"},
+	})
+	meta, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(meta.Topics, HasLen, 2)
+	c.Assert(meta.Topics[0].Err, Equals, proto.ErrUnknownTopicOrPartition)
+	c.Assert(meta.Topics[1].Err, IsNil)
+
+	// listing all topics shows only the created ones
+	b = roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 2})
+	meta, err = proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(meta.Topics, HasLen, 2)
+}
+
+func (s *ServerSuite) TestRequestLog(c *C) {
+	srv := NewServer()
+	srv.EnableRequestLog()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 42, ClientID: "tester", Topics: []string{"test"}})
+
+	var buf bytes.Buffer
+	c.Assert(srv.DumpRequestLog(&buf), IsNil)
+
+	var entries []struct {
+		Kind          int16
+		CorrelationID int32  `json:"correlation_id"`
+		ClientID      string `json:"client_id"`
+		Request       string
+		Response      []byte
+	}
+	c.Assert(json.Unmarshal(buf.Bytes(), &entries), IsNil)
+	c.Assert(entries, HasLen, 1)
+	c.Assert(entries[0].Kind, Equals, int16(proto.MetadataReqKind))
+	c.Assert(entries[0].CorrelationID, Equals, int32(42))
+	c.Assert(entries[0].ClientID, Equals, "tester")
+	c.Assert(strings.Contains(entries[0].Request, "test"), Equals, true)
+	c.Assert(entries[0].Response, DeepEquals, b)
+}
+
+func (s *ServerSuite) TestMetadataForConnection(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn1 := dialServer(c, srv)
+	defer conn1.Close()
+	conn2 := dialServer(c, srv)
+	defer conn2.Close()
+
+	srv.SetMetadataForConnection(func(conn net.Conn) bool {
+		return conn.RemoteAddr().String() == conn1.LocalAddr().String()
+	}, &proto.MetadataResp{
+		Brokers: []proto.MetadataRespBroker{{NodeID: 7, Host: "other", Port: 9092}},
+		Topics:  []proto.MetadataRespTopic{},
+	})
+
+	b := roundTrip(c, conn1, &proto.MetadataReq{CorrelationID: 1})
+	resp, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.CorrelationID, Equals, int32(1))
+	c.Assert(resp.Brokers[0].NodeID, Equals, int32(7))
+	c.Assert(resp.Topics, HasLen, 0)
+
+	b = roundTrip(c, conn2, &proto.MetadataReq{CorrelationID: 2})
+	resp, err = proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Brokers[0].NodeID, Equals, int32(100))
+	c.Assert(resp.Topics, HasLen, 1)
+
+	srv.ClearMetadataForConnections()
+	b = roundTrip(c, conn1, &proto.MetadataReq{CorrelationID: 3})
+	resp, err = proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Brokers[0].NodeID, Equals, int32(100))
+}
+
+func (s *ServerSuite) TestProduceFetchPreservesNull(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	req := produceReq("test", 0)
+	req.Topics[0].Partitions[0].Messages = []*proto.Message{
+		{Key: []byte("deleted"), Value: nil},
+		{Key: nil, Value: []byte{}},
+	}
+	b := roundTrip(c, conn, req)
+	presp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(presp.Topics[0].Partitions[0].Err, IsNil)
+
+	b = roundTrip(c, conn, fetchReq("test", 0, 0))
+	fresp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	messages := fresp.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 2)
+
+	// tombstone
+	c.Assert(string(messages[0].Key), Equals, "deleted")
+	c.Assert(messages[0].Value == nil, Equals, true)
+
+	c.Assert(messages[1].Key == nil, Equals, true)
+	c.Assert(messages[1].Value == nil, Equals, false)
+	c.Assert(messages[1].Value, HasLen, 0)
+}
+
+func (s *ServerSuite) TestProduceReturnsBaseOffset(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0, &proto.Message{}, &proto.Message{})
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, produceReq("test", 0, "a", "b", "c", "d", "e"))
+	resp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Offset, Equals, int64(2))
+
+	b = roundTrip(c, conn, fetchReq("test", 0, 2))
+	fresp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	messages := fresp.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 5)
+	for i, msg := range messages {
+		c.Assert(msg.Offset, Equals, int64(2+i))
+	}
+}
+
+func (s *ServerSuite) TestProduceLogAppendTime(c *C) {
+	srv := NewServer()
+	srv.SetTopicConfig("appended", "message.timestamp.type", "LogAppendTime")
+	srv.AddMessages("created", 0)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	before := time.Now().Truncate(time.Millisecond)
+	req := produceReq("appended", 0, "a")
+	req.Version = 2
+	b := roundTrip(c, conn, req)
+	resp, err := proto.ReadVersionedProduceResp(bytes.NewBuffer(b), 2)
+	c.Assert(err, IsNil)
+	part := resp.Topics[0].Partitions[0]
+	c.Assert(part.Err, IsNil)
+	c.Assert(part.LogAppendTime.Before(before), Equals, false)
+	c.Assert(part.LogAppendTime.After(time.Now()), Equals, false)
+
+	b = roundTrip(c, conn, fetchReq("appended", 0, 0))
+	fresp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(fresp.Topics[0].Partitions[0].Messages, HasLen, 1)
+
+	req = produceReq("created", 0, "a")
+	req.Version = 2
+	b = roundTrip(c, conn, req)
+	resp, err = proto.ReadVersionedProduceResp(bytes.NewBuffer(b), 2)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].LogAppendTime.IsZero(), Equals, true)
+}
+
+func (s *ServerSuite) TestCluster(c *C) {
+	cluster := NewCluster(3)
+	defer cluster.Close()
+	for _, pid := range []int32{0, 1, 2} {
+		cluster.Server().AddMessages("test", pid)
+	}
+
+	addrs := cluster.BootstrapAddrs()
+	c.Assert(addrs, HasLen, 3)
+	c.Assert(cluster.NodeIDs(), DeepEquals, []int32{100, 101, 102})
+
+	conns := make([]net.Conn, len(addrs))
+	for i, addr := range addrs {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		c.Assert(err, IsNil)
+		defer conn.Close()
+		conns[i] = conn
+
+		// every broker agrees on the cluster topology
+		b := roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1})
+		resp, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		c.Assert(resp.Brokers, HasLen, 3)
+		c.Assert(resp.Topics, HasLen, 1)
+		for _, part := range resp.Topics[0].Partitions {
+			c.Assert(part.Leader, Equals, 100+part.ID)
+			c.Assert(part.Replicas, DeepEquals, []int32{100, 101, 102})
+			c.Assert(part.Isrs, DeepEquals, []int32{100, 101, 102})
+		}
+	}
+
+	// only the leader accepts messages
+	b := roundTrip(c, conns[0], produceReq("test", 1, "a"))
+	resp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, Equals, proto.ErrNotLeaderForPartition)
+
+	b = roundTrip(c, conns[1], produceReq("test", 1, "a"))
+	resp, err = proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+
+	b = roundTrip(c, conns[1], fetchReq("test", 1, 0))
+	fresp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(fresp.Topics[0].Partitions[0].Err, IsNil)
+	c.Assert(fresp.Topics[0].Partitions[0].Messages, HasLen, 1)
+
+	b = roundTrip(c, conns[2], fetchReq("test", 1, 0))
+	fresp, err = proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(fresp.Topics[0].Partitions[0].Err, Equals, proto.ErrNotLeaderForPartition)
+
+	// fixtures are stored through the leader of the partition
+	c.Assert(cluster.Server().ProduceMessages("test", 2, proto.CompressionNone,
+		&proto.Message{Value: []byte("b")}), IsNil)
+
+	c.Assert(cluster.Close(), IsNil)
+	for _, addr := range addrs {
+		_, err := net.DialTimeout("tcp", addr, time.Second)
+		c.Assert(err, NotNil)
+	}
+}
+
+func (s *ServerSuite) TestClusterIsolate(c *C) {
+	cluster := NewCluster(3)
+	defer cluster.Close()
+	cluster.Server().AddMessages("test", 0)
+	cluster.Server().AddMessages("test", 1)
+
+	addrs := cluster.BootstrapAddrs()
+	conns := make([]net.Conn, len(addrs))
+	for i, addr := range addrs {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		c.Assert(err, IsNil)
+		defer conn.Close()
+		conns[i] = conn
+	}
+
+	leaders := func(conn net.Conn) (map[int32]int32, map[int32][]int32) {
+		b := roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1})
+		resp, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		leaders := make(map[int32]int32)
+		isrs := make(map[int32][]int32)
+		for _, part := range resp.Topics[0].Partitions {
+			leaders[part.ID] = part.Leader
+			isrs[part.ID] = part.Isrs
+		}
+		return leaders, isrs
+	}
+
+	cluster.Isolate(101)
+
+	// the rest of the cluster moved on
+	ldrs, isrs := leaders(conns[0])
+	c.Assert(ldrs, DeepEquals, map[int32]int32{0: 100, 1: 102})
+	c.Assert(isrs[1], DeepEquals, []int32{100, 102})
+
+	// while the isolated broker did not
+	ldrs, isrs = leaders(conns[1])
+	c.Assert(ldrs, DeepEquals, map[int32]int32{0: 101, 1: 101})
+	c.Assert(isrs[1], DeepEquals, []int32{100, 101, 102})
+
+	req := produceReq("test", 1, "a")
+	req.RequiredAcks = proto.RequiredAcksAll
+	b := roundTrip(c, conns[1], req)
+	resp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, Equals, proto.ErrRequestTimeout)
+
+	b = roundTrip(c, conns[2], req)
+	resp, err = proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+
+	b = roundTrip(c, conns[1], commitReq("group", "test", 1, 1))
+	cresp, err := proto.ReadOffsetCommitResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(cresp.Topics[0].Partitions[0].Err, Equals, proto.ErrNotCoordinator)
+
+	cluster.Rejoin(101)
+	ldrs, _ = leaders(conns[0])
+	c.Assert(ldrs, DeepEquals, map[int32]int32{0: 100, 1: 101})
+}
+
+func (s *ServerSuite) TestLatency(c *C) {
+	srv := NewServer()
+	srv.SetLatency(proto.MetadataReqKind, 50*time.Millisecond)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	start := time.Now()
+	roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1})
+	c.Assert(time.Since(start) >= 50*time.Millisecond, Equals, true)
+
+	// other request kinds are not delayed
+	c.Assert(srv.sampleLatency(proto.FetchReqKind), Equals, time.Duration(0))
+
+	srv.SetLatency(proto.MetadataReqKind, 0)
+	c.Assert(srv.sampleLatency(proto.MetadataReqKind), Equals, time.Duration(0))
+}
+
+func (s *ServerSuite) TestLatencyClose(c *C) {
+	srv := NewServer()
+	srv.SetLatency(proto.MetadataReqKind, time.Minute)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	_, err := (&proto.MetadataReq{CorrelationID: 1}).WriteTo(conn)
+	c.Assert(err, IsNil)
+	time.Sleep(50 * time.Millisecond)
+
+	// closing the server interrupts the delay and closes the connection
+	c.Assert(srv.Close(), IsNil)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = proto.ReadResp(conn)
+	c.Assert(err, Equals, io.EOF)
+}
+
+func (s *ServerSuite) TestLatencyDistribution(c *C) {
+	samples := func(seed int64) []time.Duration {
+		srv := NewServer()
+		srv.SetSeed(seed)
+		srv.SetLatencyDistribution(proto.FetchReqKind, 10*time.Millisecond, 20*time.Millisecond)
+		delays := make([]time.Duration, 100)
+		for i := range delays {
+			delays[i] = srv.sampleLatency(proto.FetchReqKind)
+		}
+		return delays
+	}
+
+	delays := samples(42)
+	c.Assert(samples(42), DeepEquals, delays)
+
+	var clamped, jittered int
+	for _, delay := range delays {
+		c.Assert(delay >= 0, Equals, true)
+		if delay == 0 {
+			clamped++
+		} else if delay != 10*time.Millisecond {
+			jittered++
+		}
+	}
+	c.Assert(clamped > 0, Equals, true)
+	c.Assert(jittered > 0, Equals, true)
+}
+
+func (s *ServerSuite) TestCompaction(c *C) {
+	srv := NewServer()
+	srv.EnableCompaction("test")
+	srv.AddMessages("test", 0,
+		&proto.Message{Key: []byte("a"), Value: []byte("1")},
+		&proto.Message{Key: []byte("b"), Value: []byte("2")},
+		&proto.Message{Value: []byte("3")},
+		&proto.Message{Key: []byte("a"), Value: []byte("4")},
+		&proto.Message{Key: []byte("c"), Value: []byte("5")},
+		&proto.Message{Key: []byte("b"), Value: []byte("6")})
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, fetchReq("test", 0, 0))
+	resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	var offsets []int64
+	var values []string
+	for _, msg := range resp.Topics[0].Partitions[0].Messages {
+		offsets = append(offsets, msg.Offset)
+		values = append(values, string(msg.Value))
+	}
+	c.Assert(offsets, DeepEquals, []int64{2, 3, 4, 5})
+	c.Assert(values, DeepEquals, []string{"3", "4", "5", "6"})
+	c.Assert(resp.Topics[0].Partitions[0].TipOffset, Equals, int64(6))
+}
+
+func (s *ServerSuite) TestPartitionOffline(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("a")})
+	srv.AddMessages("test", 1, &proto.Message{Value: []byte("b")})
+	srv.SetPartitionOffline("test", 1)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1, Topics: []string{"test"}})
+	mresp, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	parts := mresp.Topics[0].Partitions
+	c.Assert(parts, HasLen, 2)
+	c.Assert(parts[0].Err, IsNil)
+	c.Assert(parts[0].Leader, Equals, int32(100))
+	c.Assert(parts[1].Err, Equals, proto.ErrLeaderNotAvailable)
+	c.Assert(parts[1].Leader, Equals, int32(-1))
+
+	b = roundTrip(c, conn, produceReq("test", 1, "c"))
+	presp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(presp.Topics[0].Partitions[0].Err, Equals, proto.ErrLeaderNotAvailable)
+
+	b = roundTrip(c, conn, fetchReq("test", 1, 0))
+	fresp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(fresp.Topics[0].Partitions[0].Err, Equals, proto.ErrLeaderNotAvailable)
+
+	b = roundTrip(c, conn, produceReq("test", 0, "c"))
+	presp, err = proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(presp.Topics[0].Partitions[0].Err, IsNil)
+
+	srv.SetPartitionOnline("test", 1)
+	b = roundTrip(c, conn, fetchReq("test", 1, 0))
+	fresp, err = proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(fresp.Topics[0].Partitions[0].Err, IsNil)
+	c.Assert(fresp.Topics[0].Partitions[0].Messages, HasLen, 1)
+}
+
+func (s *ServerSuite) TestImportState(c *C) {
+	src := NewServer()
+	src.LoadPartition("test", 1, 10, []*proto.Message{
+		{Key: []byte("k"), Value: []byte("a")},
+		{Value: []byte("b")},
+	})
+	export := httptest.NewRecorder()
+	src.ServeHTTP(export, httptest.NewRequest("GET", "/", nil))
+	c.Assert(export.Code, Equals, http.StatusOK)
+
+	srv := NewServer()
+	imp := httptest.NewRecorder()
+	srv.ServeHTTP(imp, httptest.NewRequest("POST", "/", export.Body))
+	c.Assert(imp.Code, Equals, http.StatusNoContent)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, fetchReq("test", 1, 10))
+	resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	messages := resp.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 2)
+	c.Assert(messages[0].Offset, Equals, int64(10))
+	c.Assert(string(messages[0].Key), Equals, "k")
+	c.Assert(string(messages[1].Value), Equals, "b")
+
+	for _, body := range []string{
+		`not json`,
+		`{"topics": {"test": {"x": []}}}`,
+		`{"topics": {"test": {"0": [null]}}}`,
+		`{"topics": {"test": {"0": [{"Offset": 1}, {"Offset": 3}]}}}`,
+	} {
+		rec := httptest.NewRecorder()
+		srv.ServeHTTP(rec, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		c.Assert(rec.Code, Equals, http.StatusBadRequest, Commentf("body %s", body))
+	}
+}
+
+func (s *ServerSuite) TestProduceFetchPreservesAttributes(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	// timestamp type bit set, no compression
+	req := produceReq("test", 0, "a")
+	req.Topics[0].Partitions[0].Messages[0].Attributes = 0x08
+	b := roundTrip(c, conn, req)
+	presp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(presp.Topics[0].Partitions[0].Err, IsNil)
+
+	b = roundTrip(c, conn, fetchReq("test", 0, 0))
+	resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	messages := resp.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 1)
+	c.Assert(messages[0].Attributes, Equals, int8(0x08))
+	c.Assert(string(messages[0].Value), Equals, "a")
+}
+
+func (s *ServerSuite) TestSupportedAPIs(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("a")})
+	srv.SetSupportedAPIs(proto.MetadataReqKind, proto.ProduceReqKind)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1})
+	mresp, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(mresp.Topics, HasLen, 1)
+
+	b = roundTrip(c, conn, fetchReq("test", 0, 0))
+	fresp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(fresp.Topics[0].Partitions[0].Err, Equals, proto.ErrUnsupportedVersion)
+	c.Assert(fresp.Topics[0].Partitions[0].Messages, HasLen, 0)
+
+	// requests the server knows nothing about close the connection
+	_, err = conn.Write([]byte{0, 0, 0, 10, 0, 18, 0, 0, 0, 0, 0, 1, 0, 0})
+	c.Assert(err, IsNil)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+
+	srv.SetSupportedAPIs()
+	conn = dialServer(c, srv)
+	defer conn.Close()
+	b = roundTrip(c, conn, fetchReq("test", 0, 0))
+	fresp, err = proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(fresp.Topics[0].Partitions[0].Err, IsNil)
+}
+
+func (s *ServerSuite) TestDropNextProduceAck(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0)
+	srv.DropNextProduceAck("test", 0)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	_, err := produceReq("test", 0, "a").WriteTo(conn)
+	c.Assert(err, IsNil)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+
+	// retry succeeds and duplicates the message
+	conn = dialServer(c, srv)
+	defer conn.Close()
+	b := roundTrip(c, conn, produceReq("test", 0, "a"))
+	presp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(presp.Topics[0].Partitions[0].Err, IsNil)
+	c.Assert(presp.Topics[0].Partitions[0].Offset, Equals, int64(1))
+
+	b = roundTrip(c, conn, fetchReq("test", 0, 0))
+	fresp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	messages := fresp.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 2)
+	c.Assert(string(messages[0].Value), Equals, "a")
+	c.Assert(string(messages[1].Value), Equals, "a")
+}
+
+func (s *ServerSuite) TestInvalidTopicName(c *C) {
+	srv := NewServer()
+	srv.SetAutoCreatePattern(".*")
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	invalid := []string{"", ".", "..", "with space", "slash/topic", strings.Repeat("x", 250)}
+	for _, name := range invalid {
+		b := roundTrip(c, conn, produceReq(name, 0, "a"))
+		presp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		c.Assert(presp.Topics[0].Partitions[0].Err, Equals, proto.ErrInvalidTopic, Commentf("topic %q", name))
+	}
+
+	b := roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1, Topics: invalid})
+	mresp, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(mresp.Topics, HasLen, len(invalid))
+	for _, topic := range mresp.Topics {
+		c.Assert(topic.Err, Equals, proto.ErrInvalidTopic, Commentf("topic %q", topic.Name))
+	}
+
+	// nothing was created
+	b = roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 2})
+	mresp, err = proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(mresp.Topics, HasLen, 0)
+
+	name := "valid.topic_name-" + strings.Repeat("x", 232)
+	b = roundTrip(c, conn, produceReq(name, 0, "a"))
+	presp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(presp.Topics[0].Partitions[0].Err, IsNil)
+}
+
+func (s *ServerSuite) TestProduceCompressedReturnsBaseOffset(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	for _, codec := range []proto.Compression{proto.CompressionGzip, proto.CompressionSnappy} {
+		values := make([]string, 10)
+		for i := range values {
+			values[i] = fmt.Sprintf("value-%d", i)
+		}
+		req := produceReq("test", 0, values...)
+		req.Compression = codec
+
+		srv.ResetTopic("test")
+		srv.AddMessages("test", 0, &proto.Message{}, &proto.Message{}, &proto.Message{})
+		b := roundTrip(c, conn, req)
+		resp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+		c.Assert(resp.Topics[0].Partitions[0].Offset, Equals, int64(3))
+
+		b = roundTrip(c, conn, fetchReq("test", 0, 3))
+		fresp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		messages := fresp.Topics[0].Partitions[0].Messages
+		c.Assert(messages, HasLen, 10)
+		for i, msg := range messages {
+			c.Assert(msg.Offset, Equals, int64(3+i))
+			c.Assert(string(msg.Value), Equals, values[i])
+		}
+	}
+}
+
+func (s *ServerSuite) TestFailProduceWith(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 1)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	produce := func(partition int32) error {
+		b := roundTrip(c, conn, produceReq("test", partition, "a"))
+		resp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		return resp.Topics[0].Partitions[0].Err
+	}
+
+	srv.FailProduceWith("test", 0, proto.ErrKafkaStorageError, false)
+	c.Assert(produce(0), Equals, proto.ErrKafkaStorageError)
+	c.Assert(produce(0), IsNil)
+
+	srv.FailProduceWith("test", 1, proto.ErrKafkaStorageError, true)
+	c.Assert(produce(1), Equals, proto.ErrKafkaStorageError)
+	c.Assert(produce(1), Equals, proto.ErrKafkaStorageError)
+	c.Assert(produce(0), IsNil)
+	srv.FailProduceWith("test", 1, nil, false)
+	c.Assert(produce(1), IsNil)
+
+	parts := srv.DrainTopic("test")
+	c.Assert(parts[0], HasLen, 2)
+	c.Assert(parts[1], HasLen, 1)
+}
+
+func (s *ServerSuite) TestReplayServer(c *C) {
+	encode := func(r Response) []byte {
+		b, err := r.Bytes()
+		c.Assert(err, IsNil)
+		return b
+	}
+	srv := ReplayServer([]ScriptedResponse{
+		{Kind: proto.MetadataReqKind, Response: encode(&proto.MetadataResp{CorrelationID: 99})},
+		{Kind: proto.ProduceReqKind, Response: encode(&proto.ProduceResp{
+			Topics: []proto.ProduceRespTopic{
+				{Name: "x", Partitions: []proto.ProduceRespPartition{{Err: proto.ErrNotLeaderForPartition}}},
+			},
+		})},
+		{Kind: proto.ProduceReqKind, Response: encode(&proto.ProduceResp{
+			Topics: []proto.ProduceRespTopic{
+				{Name: "x", Partitions: []proto.ProduceRespPartition{{Offset: 42}}},
+			},
+		})},
+	})
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	req := &proto.MetadataReq{CorrelationID: 7}
+	b := roundTrip(c, conn, req)
+	mresp, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(mresp.CorrelationID, Equals, int32(7))
+
+	// request content is ignored
+	b = roundTrip(c, conn, produceReq("test", 0, "a"))
+	presp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(presp.Topics[0].Partitions[0].Err, Equals, proto.ErrNotLeaderForPartition)
+	b = roundTrip(c, conn, produceReq("test", 0, "a"))
+	presp, err = proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(presp.Topics[0].Partitions[0].Offset, Equals, int64(42))
+
+	// script exhausted
+	_, err = produceReq("test", 0, "a").WriteTo(conn)
+	c.Assert(err, IsNil)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+}
+
+func (s *ServerSuite) TestCorrelationEcho(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	correlationIDs := func(n int) []int32 {
+		conn := dialServer(c, srv)
+		defer conn.Close()
+
+		ids := make([]int32, n)
+		for i := range ids {
+			b := roundTrip(c, conn, &proto.MetadataReq{CorrelationID: int32(10 + i)})
+			resp, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+			c.Assert(err, IsNil)
+			ids[i] = resp.CorrelationID
+		}
+		return ids
+	}
+
+	c.Assert(correlationIDs(3), DeepEquals, []int32{10, 11, 12})
+
+	srv.SetCorrelationEcho(CorrelationIncrement)
+	c.Assert(correlationIDs(3), DeepEquals, []int32{1, 2, 3})
+
+	srv.SetCorrelationEcho(CorrelationFixed(0))
+	c.Assert(correlationIDs(2), DeepEquals, []int32{0, 0})
+
+	srv.SetCorrelationEcho(CorrelationEcho)
+	c.Assert(correlationIDs(1), DeepEquals, []int32{10})
+}
+
+func (s *ServerSuite) TestMetadataWithoutTopicsListsBrokers(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	for _, req := range []*proto.MetadataReq{
+		{Version: 0, CorrelationID: 1},
+		{Version: 1, CorrelationID: 2},
+		{Version: 1, CorrelationID: 3, Topics: []string{}},
+		{Version: 2, CorrelationID: 4},
+	} {
+		b := roundTrip(c, conn, req)
+		resp, err := proto.ReadVersionedMetadataResp(bytes.NewBuffer(b), req.Version)
+		c.Assert(err, IsNil)
+		c.Assert(resp.Topics, HasLen, 0)
+		c.Assert(resp.Brokers, HasLen, 1, Commentf("version %d", req.Version))
+		c.Assert(resp.Brokers[0].NodeID, Equals, int32(100))
+	}
+}
+
+func (s *ServerSuite) TestInternalTopicWrites(c *C) {
+	srv := NewServer()
+	srv.AddMessages("__consumer_offsets", 0)
+	srv.AddMessages("__custom", 0)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	produce := func(topic string) error {
+		b := roundTrip(c, conn, produceReq(topic, 0, "a"))
+		resp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		return resp.Topics[0].Partitions[0].Err
+	}
+
+	c.Assert(produce("__consumer_offsets"), IsNil)
+
+	srv.SetAllowInternalTopicWrites(false)
+	c.Assert(produce("__consumer_offsets"), Equals, proto.ErrAuthorizationFailed)
+	c.Assert(produce("__custom"), IsNil)
+	c.Assert(srv.DrainTopic("__consumer_offsets")[0], HasLen, 1)
+
+	b := roundTrip(c, conn, &proto.MetadataReq{Version: 1, CorrelationID: 1, Topics: []string{"__consumer_offsets", "__custom"}})
+	resp, err := proto.ReadVersionedMetadataResp(bytes.NewBuffer(b), 1)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].IsInternal, Equals, true)
+	c.Assert(resp.Topics[1].IsInternal, Equals, false)
+}
+
+func (s *ServerSuite) TestCommitViaOffsetsTopic(c *C) {
+	srv := NewServer()
+	srv.AddMessages("__consumer_offsets", 0)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	var commits []string
+	srv.OnCommit(func(group, topic string, partition int32, offset int64, metadata string) {
+		commits = append(commits, fmt.Sprintf("%s %s:%d %d %s", group, topic, partition, offset, metadata))
+	})
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	offsetKey := func(group, topic string, partition int32) []byte {
+		var b bytes.Buffer
+		binary.Write(&b, binary.BigEndian, int16(1))
+		binary.Write(&b, binary.BigEndian, int16(len(group)))
+		b.WriteString(group)
+		binary.Write(&b, binary.BigEndian, int16(len(topic)))
+		b.WriteString(topic)
+		binary.Write(&b, binary.BigEndian, partition)
+		return b.Bytes()
+	}
+	offsetValue := func(offset int64, metadata string) []byte {
+		var b bytes.Buffer
+		binary.Write(&b, binary.BigEndian, int16(1))
+		binary.Write(&b, binary.BigEndian, offset)
+		binary.Write(&b, binary.BigEndian, int16(len(metadata)))
+		b.WriteString(metadata)
+		binary.Write(&b, binary.BigEndian, int64(0)) // commit timestamp
+		binary.Write(&b, binary.BigEndian, int64(0)) // expire timestamp
+		return b.Bytes()
+	}
+	produce := func(messages ...*proto.Message) {
+		req := &proto.ProduceReq{
+			CorrelationID: 1,
+			RequiredAcks:  proto.RequiredAcksLocal,
+			Timeout:       time.Second,
+			Topics: []proto.ProduceReqTopic{
+				{
+					Name: "__consumer_offsets",
+					Partitions: []proto.ProduceReqPartition{
+						{ID: 0, Messages: messages},
+					},
+				},
+			},
+		}
+		b := roundTrip(c, conn, req)
+		resp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+	}
+
+	produce(
+		&proto.Message{Key: offsetKey("g", "events", 2), Value: offsetValue(42, "meta")},
+		&proto.Message{Key: []byte{0, 2, 0, 1, 'g'}, Value: []byte("group metadata")},
+	)
+	c.Assert(committedOffset(c, conn, "g", "events", 2), Equals, int64(42))
+
+	// tombstone removes the committed offset
+	produce(&proto.Message{Key: offsetKey("g", "events", 2)})
+	c.Assert(committedOffset(c, conn, "g", "events", 2), Equals, int64(-1))
+
+	// only stored offsets are reported
+	c.Assert(commits, DeepEquals, []string{"g events:2 42 meta"})
+}
+
+func (s *ServerSuite) TestTopics(c *C) {
+	srv := NewServer()
+	c.Assert(srv.Topics(), HasLen, 0)
+
+	srv.AddMessages("a", 2)
+	srv.AddMessages("a", 0)
+	srv.AddMessages("a", 1)
+	srv.AddMessages("b", 0)
+	c.Assert(srv.Topics(), DeepEquals, map[string][]int32{
+		"a": {0, 1, 2},
+		"b": {0},
+	})
+}
+
+func (s *ServerSuite) TestMaxRecordsPerFetch(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0,
+		&proto.Message{Value: []byte("a")},
+		&proto.Message{Value: []byte("b")},
+		&proto.Message{Value: []byte("c")},
+		&proto.Message{Value: []byte("d")},
+		&proto.Message{Value: []byte("e")})
+	srv.SetMaxRecordsPerFetch(2)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	var values []string
+	for offset := int64(0); offset < 5; {
+		b := roundTrip(c, conn, fetchReq("test", 0, offset))
+		resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		messages := resp.Topics[0].Partitions[0].Messages
+		c.Assert(len(messages) <= 2, Equals, true)
+		c.Assert(messages, Not(HasLen), 0)
+		for _, m := range messages {
+			values = append(values, string(m.Value))
+		}
+		offset = messages[len(messages)-1].Offset + 1
+	}
+	c.Assert(values, DeepEquals, []string{"a", "b", "c", "d", "e"})
+}
+
+func (s *ServerSuite) TestHighWaterMark(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0,
+		&proto.Message{Value: []byte("a")},
+		&proto.Message{Value: []byte("b")},
+		&proto.Message{Value: []byte("c")})
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	fetch := func(offset int64) proto.FetchRespPartition {
+		b := roundTrip(c, conn, fetchReq("test", 0, offset))
+		resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		return resp.Topics[0].Partitions[0]
+	}
+	lag := func(part proto.FetchRespPartition) int64 {
+		last := part.Messages[len(part.Messages)-1]
+		return part.TipOffset - last.Offset - 1
+	}
+
+	part := fetch(0)
+	c.Assert(part.Messages, HasLen, 3)
+	c.Assert(lag(part), Equals, int64(0))
+
+	// consumer read everything stored, but more data is reported
+	srv.SetHighWaterMark("test", 0, 10)
+	part = fetch(0)
+	c.Assert(part.Messages, HasLen, 3)
+	c.Assert(part.TipOffset, Equals, int64(10))
+	c.Assert(lag(part), Equals, int64(7))
+
+	// messages above the high water mark are not committed yet
+	srv.SetHighWaterMark("test", 0, 2)
+	part = fetch(0)
+	c.Assert(part.Messages, HasLen, 2)
+	c.Assert(part.TipOffset, Equals, int64(2))
+	c.Assert(fetch(2).Messages, HasLen, 0)
+}
+
+func (s *ServerSuite) TestMaxRequestBytes(c *C) {
+	srv := NewServer()
+	srv.SetMaxRequestBytes(200)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, produceReq("test", 0, "small"))
+	resp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+
+	req, err := produceReq("test", 0, strings.Repeat("x", 500)).Bytes()
+	c.Assert(err, IsNil)
+	_, err = conn.Write(req)
+	c.Assert(err, IsNil)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	// connection is closed, possibly reset because of the unread request
+	_, _, err = proto.ReadResp(conn)
+	c.Assert(err, NotNil)
+	if nerr, ok := err.(net.Error); ok {
+		c.Assert(nerr.Timeout(), Equals, false)
+	}
+	c.Assert(srv.DrainTopic("test")[0], HasLen, 1)
+}
+
+func (s *ServerSuite) TestDeleteGroups(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	roundTrip(c, conn, commitReq("g1", "a", 0, 10))
+	roundTrip(c, conn, commitReq("g1", "b", 1, 20))
+	roundTrip(c, conn, commitReq("g2", "a", 0, 30))
+
+	b := roundTrip(c, conn, &proto.DeleteGroupsReq{
+		CorrelationID: 1,
+		Groups:        []string{"g1", "unknown"},
+	})
+	resp, err := proto.ReadDeleteGroupsResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Groups, DeepEquals, []proto.DeleteGroupsRespGroup{
+		{Name: "g1"},
+		{Name: "unknown", Err: proto.ErrGroupIDNotFound},
+	})
+
+	c.Assert(committedOffset(c, conn, "g1", "a", 0), Equals, int64(-1))
+	c.Assert(committedOffset(c, conn, "g1", "b", 1), Equals, int64(-1))
+	c.Assert(committedOffset(c, conn, "g2", "a", 0), Equals, int64(30))
+}
+
+func (s *ServerSuite) TestTopicNameValidation(c *C) {
+	srv := NewServer()
+	srv.AddMessages("Events", 0)
+	srv.SetTopicNameValidation(true)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, produceReq("events", 0, "a"))
+	presp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(presp.Topics[0].Partitions[0].Err, Equals, proto.ErrUnknownTopicOrPartition)
+
+	b = roundTrip(c, conn, produceReq("Events", 0, "a"))
+	presp, err = proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(presp.Topics[0].Partitions[0].Err, IsNil)
+
+	b = roundTrip(c, conn, commitReq("g", "EVENTS", 0, 1))
+	cresp, err := proto.ReadOffsetCommitResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(cresp.Topics[0].Partitions[0].Err, Equals, proto.ErrUnknownTopicOrPartition)
+
+	b = roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1, Topics: []string{"events", "other"}})
+	mresp, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(mresp.Topics[0].Err, Equals, proto.ErrUnknownTopicOrPartition)
+	c.Assert(mresp.Topics[1].Err, IsNil) // auto created
+
+	c.Assert(srv.Topics(), DeepEquals, map[string][]int32{
+		"Events": {0},
+		"other":  {0},
+	})
+}
+
+func (s *ServerSuite) TestStatsByClientID(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	produce := produceReq("test", 0, "a")
+	produce.ClientID = "producer"
+	roundTrip(c, conn, produce)
+	roundTrip(c, conn, produce)
+	fetch := fetchReq("test", 0, 0)
+	fetch.ClientID = "consumer"
+	roundTrip(c, conn, fetch)
+	roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1})
+
+	stats := srv.Stats()
+	c.Assert(stats.ByClientID, DeepEquals, map[string]int{
+		"producer": 2,
+		"consumer": 1,
+		"":         1,
+	})
+	c.Assert(stats.Requests, DeepEquals, map[int16]int{
+		proto.ProduceReqKind:  2,
+		proto.FetchReqKind:    1,
+		proto.MetadataReqKind: 1,
+	})
+}
+
+func (s *ServerSuite) TestDenyTopic(c *C) {
+	srv := NewServer()
+	srv.AddMessages("read-only", 0, &proto.Message{Value: []byte("a")})
+	srv.AddMessages("secret", 0, &proto.Message{Value: []byte("a")})
+	srv.DenyTopic("read-only", OperationWrite)
+	srv.DenyTopic("secret")
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	produce := func(topic string) error {
+		b := roundTrip(c, conn, produceReq(topic, 0, "b"))
+		resp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		return resp.Topics[0].Partitions[0].Err
+	}
+	fetch := func(topic string) error {
+		b := roundTrip(c, conn, fetchReq(topic, 0, 0))
+		resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		return resp.Topics[0].Partitions[0].Err
+	}
+
+	c.Assert(produce("read-only"), Equals, proto.ErrAuthorizationFailed)
+	c.Assert(fetch("read-only"), IsNil)
+	c.Assert(produce("secret"), Equals, proto.ErrAuthorizationFailed)
+	c.Assert(fetch("secret"), Equals, proto.ErrAuthorizationFailed)
+
+	b := roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1, Topics: []string{"secret"}})
+	meta, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(meta.Topics[0].Err, IsNil)
+
+	srv.AllowTopic("secret")
+	c.Assert(produce("secret"), IsNil)
+	c.Assert(fetch("secret"), IsNil)
+}
+
+func (s *ServerSuite) TestIdleTimeout(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+	srv.SetIdleTimeout(200 * time.Millisecond)
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	// requests keep the server alive past the idle timeout
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1})
+	}
+
+	addr := srv.Addr()
+	time.Sleep(400 * time.Millisecond)
+	_, err := net.DialTimeout("tcp", addr, time.Second)
+	c.Assert(err, NotNil)
+}
+
+func (s *ServerSuite) TestPreferredReadReplica(c *C) {
+	cluster := NewCluster(3)
+	defer cluster.Close()
+	srv := cluster.Server()
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("a")})
+	srv.SetPreferredReadReplica("test", 0, 102)
+
+	addrs := cluster.BootstrapAddrs()
+	fetch := func(addr string, version int16) proto.FetchRespPartition {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		c.Assert(err, IsNil)
+		defer conn.Close()
+
+		req := fetchReq("test", 0, 0)
+		req.Version = version
+		b := roundTrip(c, conn, req)
+		resp, err := proto.ReadVersionedFetchResp(bytes.NewBuffer(b), version)
+		c.Assert(err, IsNil)
+		return resp.Topics[0].Partitions[0]
+	}
+
+	// the leader steers the client to the follower
+	part := fetch(addrs[0], 11)
+	c.Assert(part.Err, IsNil)
+	c.Assert(part.PreferredReadReplica, Equals, int32(102))
+	c.Assert(part.Messages, HasLen, 0)
+
+	part = fetch(addrs[2], 11)
+	c.Assert(part.Err, IsNil)
+	c.Assert(part.PreferredReadReplica, Equals, int32(-1))
+	c.Assert(part.Messages, HasLen, 1)
+
+	// other followers are not to be fetched from
+	c.Assert(fetch(addrs[1], 11).Err, Equals, proto.ErrNotLeaderForPartition)
+
+	// older clients cannot be redirected
+	c.Assert(fetch(addrs[0], 5).Messages, HasLen, 1)
+
+	srv.SetPreferredReadReplica("test", 0, -1)
+	c.Assert(fetch(addrs[0], 11).Messages, HasLen, 1)
+	c.Assert(fetch(addrs[2], 11).Err, Equals, proto.ErrNotLeaderForPartition)
+}
+
+func (s *ServerSuite) TestVersionedOffsetResponses(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0,
+		&proto.Message{Value: []byte("a")},
+		&proto.Message{Value: []byte("b")})
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, &proto.OffsetReq{
+		Version:       1,
+		CorrelationID: 1,
+		ReplicaID:     -1,
+		Topics: []proto.OffsetReqTopic{
+			{Name: "test", Partitions: []proto.OffsetReqPartition{{ID: 0, TimeMs: -1}}},
+		},
+	})
+	oresp, err := proto.ReadVersionedOffsetResp(bytes.NewBuffer(b), 1)
+	c.Assert(err, IsNil)
+	c.Assert(oresp.Topics[0].Partitions[0].Offsets, DeepEquals, []int64{2})
+	c.Assert(oresp.Topics[0].Partitions[0].TimeMs, Equals, int64(-1))
+
+	commit := commitReq("g", "test", 0, 1)
+	commit.Version = 3
+	b = roundTrip(c, conn, commit)
+	cresp, err := proto.ReadVersionedOffsetCommitResp(bytes.NewBuffer(b), 3)
+	c.Assert(err, IsNil)
+	c.Assert(cresp.Topics[0].Partitions[0].Err, IsNil)
+
+	b = roundTrip(c, conn, &proto.OffsetFetchReq{
+		Version:       3,
+		CorrelationID: 1,
+		ConsumerGroup: "g",
+		Topics: []proto.OffsetFetchReqTopic{
+			{Name: "test", Partitions: []int32{0}},
+		},
+	})
+	fresp, err := proto.ReadVersionedOffsetFetchResp(bytes.NewBuffer(b), 3)
+	c.Assert(err, IsNil)
+	c.Assert(fresp.Err, IsNil)
+	c.Assert(fresp.Topics[0].Partitions[0].Offset, Equals, int64(1))
+
+	// the response is encoded in the requested version
+	c.Assert(len(b), Equals, 4+4+4+4+2+len("test")+4+4+8+2+2+2)
+}
+
+func (s *ServerSuite) TestRoundTrip(c *C) {
+	srv := NewServer()
+
+	messages, err := srv.RoundTrip("test", 0,
+		&proto.Message{Key: []byte("k"), Value: []byte("a")},
+		&proto.Message{Value: []byte("b")})
+	c.Assert(err, IsNil)
+	c.Assert(messages, HasLen, 2)
+	c.Assert(messages[0].Offset, Equals, int64(0))
+	c.Assert(string(messages[0].Key), Equals, "k")
+	c.Assert(string(messages[0].Value), Equals, "a")
+	c.Assert(messages[1].Key, IsNil)
+	c.Assert(string(messages[1].Value), Equals, "b")
+
+	srv.SetPartitionOffline("test", 0)
+	_, err = srv.RoundTrip("test", 0, &proto.Message{Value: []byte("c")})
+	c.Assert(err, ErrorMatches, "cannot produce: .*leader not available.*")
+}
+
+func (s *ServerSuite) TestNotLeaderForAll(c *C) {
+	leader := NewServer()
+	leader.SetNodeID(2)
+	leader.MustSpawn()
+	defer leader.Close()
+
+	stale := NewServer()
+	stale.SetNodeID(1)
+	stale.SetNotLeaderForAll(true)
+	stale.AddMessages("test", 0)
+	stale.MustSpawn()
+	defer stale.Close()
+
+	host, port, err := net.SplitHostPort(leader.Addr())
+	c.Assert(err, IsNil)
+	portNum, err := strconv.Atoi(port)
+	c.Assert(err, IsNil)
+	stale.AddBroker(2, host, int32(portNum))
+
+	conn := dialServer(c, stale)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, produceReq("test", 0, "a"))
+	presp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(presp.Topics[0].Partitions[0].Err, Equals, proto.ErrNotLeaderForPartition)
+
+	b = roundTrip(c, conn, fetchReq("test", 0, 0))
+	fresp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(fresp.Topics[0].Partitions[0].Err, Equals, proto.ErrNotLeaderForPartition)
+
+	// metadata points the client to the real leader
+	b = roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1, Topics: []string{"test"}})
+	mresp, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(mresp.Topics[0].Partitions[0].Leader, Equals, int32(2))
+	var leaderAddr string
+	for _, broker := range mresp.Brokers {
+		if broker.NodeID == 2 {
+			leaderAddr = net.JoinHostPort(broker.Host, strconv.Itoa(int(broker.Port)))
+		}
+	}
+	c.Assert(leaderAddr, Equals, leader.Addr())
+
+	stale.SetNotLeaderForAll(false)
+	b = roundTrip(c, conn, produceReq("test", 0, "a"))
+	presp, err = proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(presp.Topics[0].Partitions[0].Err, IsNil)
+}
+
+func (s *ServerSuite) TestEmptyRequests(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	// topic without partitions is echoed back, but not created
+	b := roundTrip(c, conn, &proto.ProduceReq{
+		CorrelationID: 1,
+		RequiredAcks:  proto.RequiredAcksLocal,
+		Timeout:       time.Second,
+		Topics:        []proto.ProduceReqTopic{{Name: "test"}},
+	})
+	presp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(presp.Topics, HasLen, 1)
+	c.Assert(presp.Topics[0].Name, Equals, "test")
+	c.Assert(presp.Topics[0].Partitions, HasLen, 0)
+	c.Assert(srv.Topics(), HasLen, 0)
+
+	b = roundTrip(c, conn, &proto.ProduceReq{CorrelationID: 2, RequiredAcks: proto.RequiredAcksLocal})
+	presp, err = proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(presp.CorrelationID, Equals, int32(2))
+	c.Assert(presp.Topics, HasLen, 0)
+
+	// fetch requests are answered without waiting for data
+	start := time.Now()
+	b = roundTrip(c, conn, &proto.FetchReq{
+		CorrelationID: 3,
+		MaxWaitTime:   5 * time.Second,
+		MinBytes:      1,
+		Topics:        []proto.FetchReqTopic{{Name: "test"}},
+	})
+	fresp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(fresp.Topics, HasLen, 1)
+	c.Assert(fresp.Topics[0].Name, Equals, "test")
+	c.Assert(fresp.Topics[0].Partitions, HasLen, 0)
+
+	b = roundTrip(c, conn, &proto.FetchReq{
+		CorrelationID: 4,
+		MaxWaitTime:   5 * time.Second,
+		MinBytes:      1,
+	})
+	fresp, err = proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(fresp.CorrelationID, Equals, int32(4))
+	c.Assert(fresp.Topics, HasLen, 0)
+	c.Assert(time.Since(start) < time.Second, Equals, true)
+}
+
+func (s *ServerSuite) TestTraceWriter(c *C) {
+	srv := NewServer()
+	var trace syncBuffer
+	srv.SetTraceWriter(&trace)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	req := &proto.MetadataReq{CorrelationID: 1, ClientID: "tracer"}
+	b := roundTrip(c, conn, req)
+	reqb, err := req.Bytes()
+	c.Assert(err, IsNil)
+
+	out := trace.String()
+	c.Assert(out, Matches, fmt.Sprintf("(?s).* request kind 3, %d bytes\n.*", len(reqb)))
+	c.Assert(out, Matches, fmt.Sprintf("(?s).* response kind 3, %d bytes\n.*", len(b)))
+	c.Assert(strings.Contains(out, hex.Dump(reqb)), Equals, true)
+	c.Assert(strings.Contains(out, hex.Dump(b)), Equals, true)
+
+	srv.SetTraceWriter(nil)
+	roundTrip(c, conn, req)
+	c.Assert(trace.String(), Equals, out)
+}
+
+func (s *ServerSuite) TestTraceWriterRejectedFrames(c *C) {
+	srv := NewServer()
+	var trace syncBuffer
+	srv.SetTraceWriter(&trace)
+	srv.SetMaxRequestBytes(100)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	read := func(conn net.Conn) {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		c.Assert(err, NotNil)
+	}
+
+	// oversized frame is rejected after reading its header
+	conn := dialServer(c, srv)
+	_, err := conn.Write([]byte{0, 0, 1, 0, 0, 3})
+	c.Assert(err, IsNil)
+	read(conn)
+	conn.Close()
+
+	// frame cut short by the client
+	conn = dialServer(c, srv)
+	_, err = conn.Write([]byte{0, 0, 0, 10, 0, 3, 0, 0})
+	c.Assert(err, IsNil)
+	c.Assert(conn.(*net.TCPConn).CloseWrite(), IsNil)
+	read(conn)
+	conn.Close()
+
+	out := trace.String()
+	c.Assert(out, Matches, "(?s).* rejected request kind -1, [46] bytes\n.*")
+	c.Assert(out, Matches, "(?s).* malformed request kind -1, 8 bytes\n.*")
+	c.Assert(strings.Contains(out, hex.Dump([]byte{0, 0, 0, 10, 0, 3, 0, 0})), Equals, true)
+}
+
+// syncBuffer is a buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func (s *ServerSuite) TestAbortedTransactions(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0,
+		&proto.Message{Value: []byte("a")},
+		&proto.Message{Value: []byte("b")})
+	srv.AddMessages("test", 1, &proto.Message{Value: []byte("c")})
+	srv.SetAbortedTransactions("test", 0, []AbortedTxn{
+		{ProducerID: 7, FirstOffset: 0},
+		{ProducerID: 9, FirstOffset: 1},
+	})
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	fetch := func(partition int32) proto.FetchRespPartition {
+		req := fetchReq("test", partition, 0)
+		req.Version = 4
+		req.IsolationLevel = 1
+		b := roundTrip(c, conn, req)
+		resp, err := proto.ReadVersionedFetchResp(bytes.NewBuffer(b), 4)
+		c.Assert(err, IsNil)
+		return resp.Topics[0].Partitions[0]
+	}
+
+	part := fetch(0)
+	c.Assert(part.Messages, HasLen, 2)
+	c.Assert(part.AbortedTransactions, DeepEquals, []proto.FetchRespAbortedTransaction{
+		{ProducerID: 7, FirstOffset: 0},
+		{ProducerID: 9, FirstOffset: 1},
+	})
+	c.Assert(fetch(1).AbortedTransactions, HasLen, 0)
+
+	srv.SetAbortedTransactions("test", 0, nil)
+	c.Assert(fetch(0).AbortedTransactions, HasLen, 0)
+}
+
+func (s *ServerSuite) TestReplicationFactor(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0)
+	srv.AddMessages("test", 1)
+	srv.AddMessages("other", 0)
+	srv.AddBroker(7, "localhost", 9092)
+	srv.AddBroker(8, "localhost", 9093)
+	srv.SetReplicationFactor("test", 2)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	metadata := func(topic string) []proto.MetadataRespPartition {
+		b := roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1, Topics: []string{topic}})
+		resp, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		return resp.Topics[0].Partitions
+	}
+
+	nodeID := srv.nodeID
+	parts := metadata("test")
+	c.Assert(parts, HasLen, 2)
+	for _, part := range parts {
+		c.Assert(part.Leader, Equals, nodeID)
+		c.Assert(part.Replicas, DeepEquals, []int32{nodeID, 7})
+		c.Assert(part.Isrs, DeepEquals, []int32{nodeID, 7})
+	}
+	c.Assert(metadata("other")[0].Replicas, DeepEquals, []int32{nodeID})
+
+	// replicas cycle through brokers, starting with the leader
+	srv.SetNotLeaderForAll(true)
+	c.Assert(metadata("test")[0].Replicas, DeepEquals, []int32{7, 8})
+
+	// the factor is limited to the number of brokers
+	srv.SetReplicationFactor("test", 5)
+	c.Assert(metadata("test")[0].Replicas, DeepEquals, []int32{7, 8, nodeID})
+
+	srv.SetReplicationFactor("test", 0)
+	c.Assert(metadata("test")[0].Replicas, DeepEquals, []int32{nodeID})
+}
+
+func (s *ServerSuite) TestAcceptDelay(c *C) {
+	srv := NewServer()
+	srv.SetAcceptDelay(200 * time.Millisecond)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	start := time.Now()
+	conn := dialServer(c, srv)
+	defer conn.Close()
+	b := roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1})
+	_, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(time.Since(start) >= 200*time.Millisecond, Equals, true)
+
+	// established connections are not affected
+	start = time.Now()
+	roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 2})
+	c.Assert(time.Since(start) < 200*time.Millisecond, Equals, true)
+
+	srv.SetAcceptDelay(0)
+	start = time.Now()
+	conn2 := dialServer(c, srv)
+	defer conn2.Close()
+	roundTrip(c, conn2, &proto.MetadataReq{CorrelationID: 3})
+	c.Assert(time.Since(start) < 200*time.Millisecond, Equals, true)
+}
+
+func (s *ServerSuite) TestUnavailable(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("a")})
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	fetch := func() error {
+		b := roundTrip(c, conn, fetchReq("test", 0, 0))
+		resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		return resp.Topics[0].Partitions[0].Err
+	}
+
+	srv.SetUnavailable(200 * time.Millisecond)
+	c.Assert(fetch(), Equals, proto.ErrBrokerNotAvailable)
+	b := roundTrip(c, conn, produceReq("test", 0, "b"))
+	resp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, Equals, proto.ErrBrokerNotAvailable)
+
+	time.Sleep(250 * time.Millisecond)
+	c.Assert(fetch(), IsNil)
+
+	// rejected messages are not stored
+	b = roundTrip(c, conn, fetchReq("test", 0, 0))
+	fresp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(fresp.Topics[0].Partitions[0].Messages, HasLen, 1)
+
+	srv.SetUnavailable(time.Hour)
+	c.Assert(fetch(), Equals, proto.ErrBrokerNotAvailable)
+	srv.SetUnavailable(0)
+	c.Assert(fetch(), IsNil)
+}
+
+func (s *ServerSuite) TestLeaderEpoch(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("a")})
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	metadata := func() proto.MetadataRespPartition {
+		req := &proto.MetadataReq{Version: 7, CorrelationID: 1, Topics: []string{"test"}}
+		b := roundTrip(c, conn, req)
+		resp, err := proto.ReadVersionedMetadataResp(bytes.NewBuffer(b), 7)
+		c.Assert(err, IsNil)
+		return resp.Topics[0].Partitions[0]
+	}
+	fetch := func(epoch int32) error {
+		req := fetchReq("test", 0, 0)
+		req.Version = 9
+		req.Topics[0].Partitions[0].CurrentLeaderEpoch = epoch
+		b := roundTrip(c, conn, req)
+		resp, err := proto.ReadVersionedFetchResp(bytes.NewBuffer(b), 9)
+		c.Assert(err, IsNil)
+		return resp.Topics[0].Partitions[0].Err
+	}
+
+	c.Assert(metadata().LeaderEpoch, Equals, int32(0))
+	c.Assert(fetch(0), IsNil)
+
+	c.Assert(srv.BumpLeaderEpoch("test", 0), Equals, int32(1))
+	c.Assert(metadata().LeaderEpoch, Equals, int32(1))
+	c.Assert(fetch(0), Equals, proto.ErrFencedLeaderEpoch)
+	c.Assert(fetch(2), Equals, proto.ErrUnknownLeaderEpoch)
+	c.Assert(fetch(1), IsNil)
+	// clients not tracking epochs are not validated
+	c.Assert(fetch(-1), IsNil)
+}
+
+func (s *ServerSuite) TestMetadataNoAutoCreate(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	req := &proto.MetadataReq{Version: 4, CorrelationID: 1, Topics: []string{"test"}}
+	b := roundTrip(c, conn, req)
+	resp, err := proto.ReadVersionedMetadataResp(bytes.NewBuffer(b), 4)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Err, Equals, proto.ErrUnknownTopicOrPartition)
+	c.Assert(srv.Topics(), HasLen, 0)
+
+	req.AllowAutoTopicCreation = true
+	b = roundTrip(c, conn, req)
+	resp, err = proto.ReadVersionedMetadataResp(bytes.NewBuffer(b), 4)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Err, IsNil)
+	c.Assert(srv.Topics(), HasLen, 1)
+}
+
+func (s *ServerSuite) TestRawMessageBytes(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	produce := func(value string) []byte {
+		req := produceReq("test", 0, value)
+		b, err := req.Bytes()
+		c.Assert(err, IsNil)
+		roundTrip(c, conn, req)
+		return b
+	}
+
+	produce("a")
+	c.Assert(srv.RawMessageBytes("test", 0, 0), IsNil)
+
+	srv.SetRetainRawMessages(true)
+	b := produce("b")
+	raw := srv.RawMessageBytes("test", 0, 1)
+	c.Assert(raw, NotNil)
+	// the only message of the request is at its very end, after its size
+	c.Assert(raw, DeepEquals, b[len(b)-len(raw):])
+	size := binary.BigEndian.Uint32(b[len(b)-len(raw)-4:])
+	c.Assert(int(size), Equals, len(raw))
+
+	// compressed messages share the wrapper message
+	c.Assert(srv.ProduceMessages("test", 0, proto.CompressionGzip,
+		&proto.Message{Value: []byte("c")},
+		&proto.Message{Value: []byte("d")}), IsNil)
+	c.Assert(srv.RawMessageBytes("test", 0, 2), NotNil)
+	c.Assert(srv.RawMessageBytes("test", 0, 3), DeepEquals, srv.RawMessageBytes("test", 0, 2))
+
+	// callers get a copy of the retained bytes
+	raw[0] ^= 0xff
+	c.Assert(srv.RawMessageBytes("test", 0, 1), DeepEquals, b[len(b)-len(raw):])
+
+	// retained bytes are dropped together with trimmed messages
+	srv.SetRetentionLimit(2)
+	c.Assert(srv.RawMessageBytes("test", 0, 1), IsNil)
+	c.Assert(srv.RawMessageBytes("test", 0, 2), NotNil)
+
+	srv.ResetTopic("test")
+	c.Assert(srv.RawMessageBytes("test", 0, 2), IsNil)
+}
+
+func (s *ServerSuite) TestCoordinatorElection(c *C) {
+	srv := NewServer()
+	srv.SetCoordinatorElection(true)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	findCoordinator := func() *proto.GroupCoordinatorResp {
+		b := roundTrip(c, conn, &proto.GroupCoordinatorReq{CorrelationID: 1, ConsumerGroup: "g"})
+		resp, err := proto.ReadGroupCoordinatorResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		return resp
+	}
+
+	resp := findCoordinator()
+	c.Assert(resp.Err, Equals, proto.ErrNoCoordinator)
+	c.Assert(resp.CoordinatorID, Equals, int32(-1))
+
+	srv.SetCoordinatorElection(false)
+	resp = findCoordinator()
+	c.Assert(resp.Err, IsNil)
+	c.Assert(resp.CoordinatorID, Equals, srv.nodeID)
+}
+
+func (s *ServerSuite) TestFetchHang(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("a")})
+	srv.SetFetchHang(true)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	// the request times out on the client side
+	_, err := fetchReq("test", 0, 0).WriteTo(conn)
+	c.Assert(err, IsNil)
+	_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = proto.ReadResp(conn)
+	c.Assert(err, NotNil)
+	nerr, ok := err.(net.Error)
+	c.Assert(ok, Equals, true)
+	c.Assert(nerr.Timeout(), Equals, true)
+
+	// other requests are served
+	conn2 := dialServer(c, srv)
+	defer conn2.Close()
+	roundTrip(c, conn2, &proto.MetadataReq{CorrelationID: 1})
+
+	// closing the server releases the hung request and its connection
+	c.Assert(srv.Close(), IsNil)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = proto.ReadResp(conn)
+	c.Assert(err, NotNil)
+	if nerr, ok := err.(net.Error); ok {
+		c.Assert(nerr.Timeout(), Equals, false)
+	}
+}
+
+func (s *ServerSuite) TestFetchHangReleased(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("a")})
+	srv.SetFetchHang(true)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	time.AfterFunc(100*time.Millisecond, func() { srv.SetFetchHang(false) })
+	b := roundTrip(c, conn, fetchReq("test", 0, 0))
+	resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Messages, HasLen, 1)
+}
+
+func (s *ServerSuite) TestBounce(c *C) {
+	for _, retain := range []bool{true, false} {
+		srv := NewServer()
+		srv.AddMessages("test", 0, &proto.Message{Value: []byte("a")})
+		srv.MustSpawn()
+		addr := srv.Addr()
+
+		conn := dialServer(c, srv)
+		roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1})
+
+		srv.Bounce(retain)
+
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		c.Assert(err, Equals, io.EOF)
+		conn.Close()
+
+		c.Assert(srv.Addr(), Equals, addr)
+		conn = dialServer(c, srv)
+		b := roundTrip(c, conn, fetchReq("test", 0, 0))
+		resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		if retain {
+			c.Assert(resp.Topics[0].Partitions[0].Messages, HasLen, 1)
+		} else {
+			c.Assert(resp.Topics[0].Partitions[0].Err, Equals, proto.ErrUnknownTopicOrPartition)
+		}
+		conn.Close()
+		srv.Close()
+	}
+}
+
+func (s *ServerSuite) TestFetchMaxBytes(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0,
+		&proto.Message{Value: bytes.Repeat([]byte("x"), 1000)},
+		&proto.Message{Value: []byte("a")},
+		&proto.Message{Value: []byte("b")})
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	// message bigger than MaxBytes is returned on its own
+	req := fetchReq("test", 0, 0)
+	req.Topics[0].Partitions[0].MaxBytes = 1
+	b := roundTrip(c, conn, req)
+	resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	messages := resp.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 1)
+	c.Assert(messages[0].Offset, Equals, int64(0))
+
+	// small messages are truncated to fit MaxBytes
+	req = fetchReq("test", 0, 1)
+	req.Topics[0].Partitions[0].MaxBytes = messageSize(&proto.Message{Value: []byte("a")}, proto.MessageFormatV0) + 1
+	b = roundTrip(c, conn, req)
+	resp, err = proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	messages = resp.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 1)
+	c.Assert(messages[0].Offset, Equals, int64(1))
+}
+
+func (s *ServerSuite) TestFetchMaxBytesMessageFormatV1(c *C) {
+	srv := NewServer()
+	srv.SetMessageFormat(proto.MessageFormatV1)
+	srv.AddMessages("test", 0,
+		&proto.Message{Value: []byte("a")},
+		&proto.Message{Value: []byte("b")},
+		&proto.Message{Value: []byte("c")})
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	// two messages would fit without the timestamps of format v1
+	v0Size := messageSize(&proto.Message{Value: []byte("a")}, proto.MessageFormatV0)
+	v1Size := messageSize(&proto.Message{Value: []byte("a")}, proto.MessageFormatV1)
+	c.Assert(v1Size, Equals, v0Size+8)
+	req := fetchReq("test", 0, 0)
+	req.Topics[0].Partitions[0].MaxBytes = 2*v1Size - 1
+	b := roundTrip(c, conn, req)
+	resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Messages, HasLen, 1)
+
+	req.Topics[0].Partitions[0].MaxBytes = 2 * v1Size
+	b = roundTrip(c, conn, req)
+	resp, err = proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Messages, HasLen, 2)
+}
+
+func (s *ServerSuite) TestFetchResponseMaxBytes(c *C) {
+	srv := NewServer()
+	for _, pid := range []int32{0, 1, 2} {
+		srv.AddMessages("test", pid,
+			&proto.Message{Value: []byte("a")},
+			&proto.Message{Value: []byte("b")})
+	}
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	// the budget is used up in the middle of the second partition
+	req := &proto.FetchReq{
+		Version:       3,
+		CorrelationID: 1,
+		MaxBytes:      3 * messageSize(&proto.Message{Value: []byte("a")}, proto.MessageFormatV0),
+		Topics: []proto.FetchReqTopic{
+			{
+				Name: "test",
+				Partitions: []proto.FetchReqPartition{
+					{ID: 0, FetchOffset: 0, MaxBytes: 1 << 20},
+					{ID: 1, FetchOffset: 0, MaxBytes: 1 << 20},
+					{ID: 2, FetchOffset: 0, MaxBytes: 1 << 20},
+				},
+			},
+		},
+	}
+	b := roundTrip(c, conn, req)
+	resp, err := proto.ReadVersionedFetchResp(bytes.NewBuffer(b), 3)
+	c.Assert(err, IsNil)
+	parts := resp.Topics[0].Partitions
+	c.Assert(parts, HasLen, 3)
+	for i, want := range []int{2, 1, 0} {
+		c.Assert(parts[i].Err, IsNil)
+		c.Assert(parts[i].TipOffset, Equals, int64(2))
+		c.Assert(parts[i].Messages, HasLen, want)
+	}
+}
+
+func (s *ServerSuite) TestKeyPartitionValidator(c *C) {
+	srv := NewServer()
+	seen := make(map[string]int32)
+	srv.SetKeyPartitionValidator(func(key []byte, partition int32) error {
+		if p, ok := seen[string(key)]; ok && p != partition {
+			return fmt.Errorf("key %q sent to %d, previously to %d", key, partition, p)
+		}
+		seen[string(key)] = partition
+		return nil
+	})
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	produce := func(partition int32, key string) error {
+		req := produceReq("test", partition)
+		req.Topics[0].Partitions[0].Messages = []*proto.Message{{Key: []byte(key)}}
+		b := roundTrip(c, conn, req)
+		resp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		return resp.Topics[0].Partitions[0].Err
+	}
+
+	c.Assert(produce(0, "a"), IsNil)
+	c.Assert(produce(1, "b"), IsNil)
+	c.Assert(produce(0, "a"), IsNil)
+	c.Assert(produce(1, "a"), Equals, proto.ErrInvalidMessage)
+}
+
+func (s *ServerSuite) TestRejectDuplicateCorrelation(c *C) {
+	srv := NewServer()
+	srv.SetRejectDuplicateCorrelation(true)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1})
+	roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 2})
+
+	_, err := (&proto.MetadataReq{CorrelationID: 1}).WriteTo(conn)
+	c.Assert(err, IsNil)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, Equals, io.EOF)
+
+	// correlation IDs are tracked per connection
+	conn2 := dialServer(c, srv)
+	defer conn2.Close()
+	roundTrip(c, conn2, &proto.MetadataReq{CorrelationID: 1})
+
+	// only the most recent IDs are tracked, so that counters can wrap
+	for id := int32(2); id <= duplicateCorrelationWindow+1; id++ {
+		roundTrip(c, conn2, &proto.MetadataReq{CorrelationID: id})
+	}
+	roundTrip(c, conn2, &proto.MetadataReq{CorrelationID: 1})
+}
+
+func (s *ServerSuite) TestLoadPartition(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("dropped")})
+	srv.LoadPartition("test", 0, 100, []*proto.Message{
+		{Value: []byte("a")},
+		{Value: []byte("b")},
+	})
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	offsets := func(timeMs int64) int64 {
+		b := roundTrip(c, conn, &proto.OffsetReq{
+			CorrelationID: 1,
+			Topics: []proto.OffsetReqTopic{
+				{
+					Name: "test",
+					Partitions: []proto.OffsetReqPartition{
+						{ID: 0, TimeMs: timeMs, MaxOffsets: 1},
+					},
+				},
+			},
+		})
+		resp, err := proto.ReadOffsetResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		return resp.Topics[0].Partitions[0].Offsets[0]
+	}
+	c.Assert(offsets(proto.OffsetReqTimeEarliest), Equals, int64(100))
+	c.Assert(offsets(proto.OffsetReqTimeLatest), Equals, int64(102))
+
+	b := roundTrip(c, conn, fetchReq("test", 0, 99))
+	resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, Equals, proto.ErrOffsetOutOfRange)
+
+	b = roundTrip(c, conn, fetchReq("test", 0, 100))
+	resp, err = proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	messages := resp.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 2)
+	c.Assert(messages[0].Offset, Equals, int64(100))
+	c.Assert(string(messages[1].Value), Equals, "b")
+	c.Assert(messages[1].Offset, Equals, int64(101))
+}
+
+func (s *ServerSuite) TestVersionedMetadata(c *C) {
+	srv := NewServer()
+	srv.SetNodeID(3)
+	srv.SetClusterID("test-cluster")
+	srv.AddMessages("test", 0)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, &proto.MetadataReq{Version: 2, CorrelationID: 1})
+	resp, err := proto.ReadVersionedMetadataResp(bytes.NewBuffer(b), 2)
+	c.Assert(err, IsNil)
+	c.Assert(resp.CorrelationID, Equals, int32(1))
+	c.Assert(resp.ClusterID, Equals, "test-cluster")
+	c.Assert(resp.ControllerID, Equals, int32(3))
+	c.Assert(resp.Topics, HasLen, 1)
+
+	b = roundTrip(c, conn, &proto.MetadataReq{Version: 1, CorrelationID: 2, Topics: []string{}})
+	resp, err = proto.ReadVersionedMetadataResp(bytes.NewBuffer(b), 1)
+	c.Assert(err, IsNil)
+	c.Assert(resp.ControllerID, Equals, int32(3))
+	c.Assert(resp.Topics, HasLen, 0)
+}
+
+func (s *ServerSuite) TestDescribeConfigs(c *C) {
+	srv := NewServer()
+	srv.SetTopicConfig("test", "retention.ms", "1000")
+	srv.SetTopicConfig("test", "cleanup.policy", "compact")
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, &proto.DescribeConfigsReq{
+		CorrelationID: 1,
+		Resources: []proto.DescribeConfigsReqResource{
+			{Type: proto.ConfigResourceTopic, Name: "test"},
+			{Type: proto.ConfigResourceTopic, Name: "test", ConfigNames: []string{"retention.ms"}},
+			{Type: proto.ConfigResourceTopic, Name: "missing"},
+		},
+	})
+	resp, err := proto.ReadDescribeConfigsResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.CorrelationID, Equals, int32(1))
+	c.Assert(resp.Resources, HasLen, 3)
+
+	c.Assert(resp.Resources[0].Err, IsNil)
+	c.Assert(resp.Resources[0].Configs, DeepEquals, []proto.DescribeConfigsRespConfig{
+		{Name: "cleanup.policy", Value: "compact"},
+		{Name: "retention.ms", Value: "1000"},
+	})
+	c.Assert(resp.Resources[1].Configs, DeepEquals, []proto.DescribeConfigsRespConfig{
+		{Name: "retention.ms", Value: "1000"},
+	})
+	c.Assert(resp.Resources[2].Err, Equals, proto.ErrUnknownTopicOrPartition)
+}
+
+func (s *ServerSuite) TestAlterConfigs(c *C) {
+	srv := NewServer()
+	srv.SetTopicConfig("test", "retention.ms", "1000")
+	srv.SetValidConfigKeys("retention.ms", "cleanup.policy")
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	alter := func(validateOnly bool, name, value string) error {
+		b := roundTrip(c, conn, &proto.AlterConfigsReq{
+			CorrelationID: 1,
+			Resources: []proto.AlterConfigsReqResource{
+				{
+					Type:    proto.ConfigResourceTopic,
+					Name:    "test",
+					Configs: []proto.AlterConfigsReqConfig{{Name: name, Value: value}},
+				},
+			},
+			ValidateOnly: validateOnly,
+		})
+		resp, err := proto.ReadAlterConfigsResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		return resp.Resources[0].Err
+	}
+	describe := func() []proto.DescribeConfigsRespConfig {
+		b := roundTrip(c, conn, &proto.DescribeConfigsReq{
+			CorrelationID: 2,
+			Resources: []proto.DescribeConfigsReqResource{
+				{Type: proto.ConfigResourceTopic, Name: "test"},
+			},
+		})
+		resp, err := proto.ReadDescribeConfigsResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		return resp.Resources[0].Configs
+	}
+
+	c.Assert(alter(false, "unknown.key", "x"), Equals, proto.ErrInvalidConfig)
+	c.Assert(alter(true, "cleanup.policy", "compact"), IsNil)
+	c.Assert(describe(), DeepEquals, []proto.DescribeConfigsRespConfig{
+		{Name: "retention.ms", Value: "1000"},
+	})
+
+	c.Assert(alter(false, "cleanup.policy", "compact"), IsNil)
+	c.Assert(describe(), DeepEquals, []proto.DescribeConfigsRespConfig{
+		{Name: "cleanup.policy", Value: "compact"},
+	})
+}
+
+func (s *ServerSuite) TestShrinkISR(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 1, &proto.Message{Value: []byte("a")})
+	srv.ShrinkISR("test", 1, 100)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1, Topics: []string{"test"}})
+	meta, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(meta.Topics[0].Partitions[0].Isrs, DeepEquals, []int32{100})
+	c.Assert(meta.Topics[0].Partitions[1].Isrs, HasLen, 0)
+
+	b = roundTrip(c, conn, fetchReq("test", 1, 0))
+	resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, Equals, proto.ErrReplicaNotAvailable)
+
+	srv.RestoreISR("test", 1)
+	b = roundTrip(c, conn, fetchReq("test", 1, 0))
+	resp, err = proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Messages, HasLen, 1)
+}
+
+func (s *ServerSuite) TestFindCoordinator(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	for _, ctype := range []int8{proto.CoordinatorGroup, proto.CoordinatorTransaction} {
+		b := roundTrip(c, conn, &proto.GroupCoordinatorReq{
+			Version:         1,
+			CorrelationID:   1,
+			ConsumerGroup:   "key",
+			CoordinatorType: ctype,
+		})
+		resp, err := proto.ReadVersionedGroupCoordinatorResp(bytes.NewBuffer(b), 1)
+		c.Assert(err, IsNil)
+		c.Assert(resp.Err, IsNil)
+		c.Assert(resp.CoordinatorID, Equals, int32(100))
+		c.Assert(resp.CoordinatorPort, Not(Equals), int32(0))
+	}
+
+	b := roundTrip(c, conn, &proto.GroupCoordinatorReq{
+		Version:         1,
+		CorrelationID:   2,
+		ConsumerGroup:   "key",
+		CoordinatorType: 7,
+	})
+	resp, err := proto.ReadVersionedGroupCoordinatorResp(bytes.NewBuffer(b), 1)
+	c.Assert(err, IsNil)
+	c.Assert(resp.Err, Equals, proto.ErrInvalidRequest)
+	c.Assert(resp.ErrMessage, Not(Equals), "")
+}
+
+func (s *ServerSuite) TestSetCoordinator(c *C) {
+	srv := NewServer()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	findCoordinator := func() *proto.GroupCoordinatorResp {
+		b := roundTrip(c, conn, &proto.GroupCoordinatorReq{CorrelationID: 1, ConsumerGroup: "g"})
+		resp, err := proto.ReadGroupCoordinatorResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		return resp
+	}
+	commit := func() error {
+		b := roundTrip(c, conn, commitReq("g", "test", 0, 1))
+		resp, err := proto.ReadOffsetCommitResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		return resp.Topics[0].Partitions[0].Err
+	}
+
+	srv.SetCoordinator(100)
+	resp := findCoordinator()
+	c.Assert(resp.Err, IsNil)
+	c.Assert(resp.CoordinatorID, Equals, int32(100))
+	c.Assert(commit(), IsNil)
+
+	// coordinator moved to a node that is not part of the cluster
+	srv.SetCoordinator(7)
+	c.Assert(findCoordinator().Err, Equals, proto.ErrNoCoordinator)
+	c.Assert(commit(), Equals, proto.ErrNotCoordinator)
+}
+
+func (s *ServerSuite) TestFeedMessages(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	value := []byte("message")
+	req := fetchReq("test", 0, 0)
+	req.MaxWaitTime = 5 * time.Second
+	req.MinBytes = 3 * messageSize(&proto.Message{Value: value}, proto.MessageFormatV0)
+
+	done := srv.FeedMessages("test", 0, 20*time.Millisecond,
+		&proto.Message{Value: value},
+		&proto.Message{Value: value},
+		&proto.Message{Value: value})
+
+	start := time.Now()
+	b := roundTrip(c, conn, req)
+	c.Assert(time.Since(start) >= 60*time.Millisecond, Equals, true)
+	resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Messages, HasLen, 3)
+	<-done
+}
+
+func (s *ServerSuite) TestMarkCorrupt(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0,
+		&proto.Message{Value: []byte("a")},
+		&proto.Message{Value: []byte("b")},
+		&proto.Message{Value: []byte("c")})
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	valid := roundTrip(c, conn, fetchReq("test", 0, 0))
+
+	srv.MarkCorrupt("test", 0, 1)
+	b := roundTrip(c, conn, fetchReq("test", 0, 0))
+
+	// all messages are sent, only the CRC of the marked one differs
+	c.Assert(b, HasLen, len(valid))
+	c.Assert(bytes.Equal(b, valid), Equals, false)
+
+	// decoding stops at the corrupted message
+	resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	messages := resp.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 1)
+	c.Assert(messages[0].Offset, Equals, int64(0))
+
+	// fetching past the corrupted message returns valid messages
+	b = roundTrip(c, conn, fetchReq("test", 0, 2))
+	resp, err = proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Messages, HasLen, 1)
+}
+
+func (s *ServerSuite) TestMarkCorruptVersioned(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0,
+		&proto.Message{Value: []byte("a")},
+		&proto.Message{Value: []byte("b")},
+		&proto.Message{Value: []byte("c")})
+	srv.MarkCorrupt("test", 0, 1)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	for _, version := range []int16{4, 7, 11} {
+		req := fetchReq("test", 0, 0)
+		req.Version = version
+		b := roundTrip(c, conn, req)
+
+		// decoding stops at the message with invalid CRC
+		resp, err := proto.ReadVersionedFetchResp(bytes.NewBuffer(b), version)
+		c.Assert(err, IsNil)
+		part := resp.Topics[0].Partitions[0]
+		c.Assert(part.Err, IsNil)
+		c.Assert(part.Messages, HasLen, 1, Commentf("version %d", version))
+		c.Assert(part.Messages[0].Offset, Equals, int64(0))
+	}
+
+	// the CRC is invalid in message format v1 as well
+	srv.SetMessageFormat(1)
+	b := roundTrip(c, conn, fetchReq("test", 0, 0))
+	resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Messages, HasLen, 1)
+
+	// stored message is left intact
+	c.Assert(srv.topics["test"][0].messages[1].InvalidCrc, Equals, false)
+}
+
+func (s *ServerSuite) TestMessageFormat(c *C) {
+	created := time.Unix(1500000000, 0)
+	srv := NewServer()
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("a"), Timestamp: created})
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	fetch := func() *proto.Message {
+		b := roundTrip(c, conn, fetchReq("test", 0, 0))
+		resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+		c.Assert(err, IsNil)
+		c.Assert(resp.Topics[0].Partitions[0].Messages, HasLen, 1)
+		return resp.Topics[0].Partitions[0].Messages[0]
+	}
+
+	// message format v0 has no timestamps
+	c.Assert(fetch().Timestamp.IsZero(), Equals, true)
+
+	srv.SetMessageFormat(proto.MessageFormatV1)
+	msg := fetch()
+	c.Assert(msg.Timestamp.Equal(created), Equals, true)
+	c.Assert(string(msg.Value), Equals, "a")
+
+	c.Assert(func() { srv.SetMessageFormat(2) }, PanicMatches, "unsupported message format 2")
+}
+
+func (s *ServerSuite) TestRetentionLimit(c *C) {
+	srv := NewServer()
+	srv.SetRetentionLimit(2)
+	srv.AddMessages("test", 0, &proto.Message{Value: []byte("a")})
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, produceReq("test", 0, "b", "c"))
+	presp, err := proto.ReadProduceResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(presp.Topics[0].Partitions[0].Offset, Equals, int64(1))
+
+	b = roundTrip(c, conn, fetchReq("test", 0, 0))
+	resp, err := proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Topics[0].Partitions[0].Err, Equals, proto.ErrOffsetOutOfRange)
+
+	b = roundTrip(c, conn, fetchReq("test", 0, 1))
+	resp, err = proto.ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	messages := resp.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 2)
+	c.Assert(string(messages[0].Value), Equals, "b")
+	c.Assert(messages[1].Offset, Equals, int64(2))
+}
+
+func (s *ServerSuite) TestRetentionLimitCompacts(c *C) {
+	srv := NewServer()
+	srv.SetRetentionLimit(2)
+	for i := 0; i < 1000; i++ {
+		srv.AddMessages("test", 0, &proto.Message{Value: []byte("a")})
+	}
+	plog := srv.topics["test"][0]
+	c.Assert(plog.startOffset, Equals, int64(998))
+	c.Assert(plog.messages, HasLen, 2)
+	c.Assert(cap(plog.messages) <= 8, Equals, true, Commentf("capacity %d", cap(plog.messages)))
+}
+
+func (s *ServerSuite) TestConcurrentClients(c *C) {
+	srv := NewServer()
+	srv.EnableRequestLog()
+	srv.MustSpawn()
+	defer srv.Close()
+
+	const workers = 50
+	const requests = 20
+
+	errc := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		go func(w int) {
+			conn, err := net.DialTimeout("tcp", srv.Addr(), time.Second)
+			if err != nil {
+				errc <- err
+				return
+			}
+			defer conn.Close()
+
+			topic := fmt.Sprintf("topic-%d", w%5)
+			for i := 0; i < requests; i++ {
+				var req proto.Request = produceReq(topic, int32(w%3), "message")
+				if i%2 == 1 {
+					req = fetchReq(topic, int32(w%3), 0)
+				}
+				if _, err := req.WriteTo(conn); err != nil {
+					errc <- err
+					return
+				}
+				if _, _, err := proto.ReadResp(conn); err != nil {
+					errc <- err
+					return
+				}
+				if i%5 == 0 {
+					srv.AddMessages(topic, int32(w%3), &proto.Message{Value: []byte("added")})
+				}
+			}
+			errc <- nil
+		}(w)
+	}
+
+	// mutate the state from outside while the clients are running
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			srv.ResetTopic("topic-0")
+			srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			_ = srv.DumpRequestLog(ioutil.Discard)
+		}
+	}()
+
+	for w := 0; w < workers; w++ {
+		c.Assert(<-errc, IsNil)
+	}
+	<-done
+}
+
+func (s *ServerSuite) TestAdvertiseBrokers(c *C) {
+	srv := NewServer()
+	srv.AddMessages("test", 0)
+	srv.SetAdvertiseBrokers(false)
+	srv.MustSpawn()
+	defer srv.Close()
+
+	conn := dialServer(c, srv)
+	defer conn.Close()
+
+	b := roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 1})
+	resp, err := proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Brokers, HasLen, 0)
+	c.Assert(resp.Topics, HasLen, 1)
+
+	srv.SetAdvertiseBrokers(true)
+	b = roundTrip(c, conn, &proto.MetadataReq{CorrelationID: 2})
+	resp, err = proto.ReadMetadataResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(resp.Brokers, HasLen, 1)
+}
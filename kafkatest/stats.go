@@ -0,0 +1,55 @@
+package kafkatest
+
+import (
+	"sync"
+)
+
+// Stats summarizes requests received by the server.
+type Stats struct {
+	// Requests is the number of requests received by request kind.
+	Requests map[int16]int
+	// ByClientID is the number of requests received by client ID set in
+	// the request header.
+	ByClientID map[string]int
+}
+
+// requestStats counts requests received by the server, see Server.Stats.
+type requestStats struct {
+	mu         sync.Mutex
+	requests   map[int16]int
+	byClientID map[string]int
+}
+
+func newRequestStats() *requestStats {
+	return &requestStats{
+		requests:   make(map[int16]int),
+		byClientID: make(map[string]int),
+	}
+}
+
+func (st *requestStats) add(kind int16, b []byte) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.requests[kind]++
+	st.byClientID[clientID(b)]++
+}
+
+// Stats returns a snapshot of counts of requests received by the server since
+// it was created, including requests that failed or were rejected.
+func (s *Server) Stats() Stats {
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+
+	stats := Stats{
+		Requests:   make(map[int16]int, len(s.stats.requests)),
+		ByClientID: make(map[string]int, len(s.stats.byClientID)),
+	}
+	for kind, n := range s.stats.requests {
+		stats.Requests[kind] = n
+	}
+	for id, n := range s.stats.byClientID {
+		stats.ByClientID[id] = n
+	}
+	return stats
+}
@@ -0,0 +1,64 @@
+package kafkatest
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// tracer writes hex dumps of request and response frames, see
+// SetTraceWriter.
+type tracer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (t *tracer) dump(nodeID int32, direction string, kind int16, b []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	fmt.Fprintf(t.w, "%s node %d %s kind %d, %d bytes\n",
+		time.Now().Format(time.RFC3339Nano), nodeID, direction, kind, len(b))
+	d := hex.Dumper(t.w)
+	_, _ = d.Write(b)
+	_ = d.Close()
+}
+
+// SetTraceWriter makes the server write a timestamped hex dump of every
+// request frame it receives and every response frame it sends to given
+// writer, which helps to debug wire level mismatches. Unlike the request log,
+// frames are written as they pass, including malformed ones. Frames that
+// exceed SetMaxRequestBytes or that the client did not send completely are
+// written as far as they were received, with kind -1. Nil writer disables
+// tracing, which is the default.
+func (s *Server) SetTraceWriter(w io.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if w == nil {
+		s.trace = nil
+		return
+	}
+	s.trace = &tracer{w: w}
+}
+
+// tracing returns true if tracing is enabled.
+func (s *Server) tracing() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.trace != nil
+}
+
+// traceFrame writes a hex dump of given frame, if tracing is enabled.
+func (s *Server) traceFrame(nodeID int32, direction string, kind int16, b []byte) {
+	s.mu.RLock()
+	t := s.trace
+	s.mu.RUnlock()
+
+	if t != nil {
+		t.dump(nodeID, direction, kind, b)
+	}
+}
@@ -35,6 +35,14 @@ var (
 	ErrInvalidCommitOffsetSize                 = &KafkaError{28, "offset data size is not valid"}
 	ErrAuthorizationFailed                     = &KafkaError{29, "not authorized"}
 	ErrRebalanceInProgress                     = &KafkaError{30, "group is rebalancing, rejoin is needed"}
+	ErrUnsupportedVersion                      = &KafkaError{35, "version of the API is not supported"}
+	ErrInvalidConfig                           = &KafkaError{40, "configuration is invalid"}
+	ErrInvalidRequest                          = &KafkaError{42, "request is malformed or not supported"}
+	ErrKafkaStorageError                       = &KafkaError{56, "[transient] disk error when trying to access log file on the disk"}
+	ErrNonEmptyGroup                           = &KafkaError{68, "group is not empty"}
+	ErrGroupIDNotFound                         = &KafkaError{69, "group id does not exist"}
+	ErrFencedLeaderEpoch                       = &KafkaError{74, "leader epoch is older than the current epoch of the broker"}
+	ErrUnknownLeaderEpoch                      = &KafkaError{75, "[transient] leader epoch is newer than the current epoch of the broker"}
 
 	errnoToErr = map[int16]error{
 		-1: ErrUnknown,
@@ -67,6 +75,14 @@ var (
 		28: ErrInvalidCommitOffsetSize,
 		29: ErrAuthorizationFailed,
 		30: ErrRebalanceInProgress,
+		35: ErrUnsupportedVersion,
+		40: ErrInvalidConfig,
+		42: ErrInvalidRequest,
+		56: ErrKafkaStorageError,
+		68: ErrNonEmptyGroup,
+		69: ErrGroupIDNotFound,
+		74: ErrFencedLeaderEpoch,
+		75: ErrUnknownLeaderEpoch,
 	}
 )
 
@@ -29,6 +29,9 @@ const (
 	OffsetCommitReqKind     = 8
 	OffsetFetchReqKind      = 9
 	GroupCoordinatorReqKind = 10
+	DescribeConfigsReqKind  = 32
+	AlterConfigsReqKind     = 33
+	DeleteGroupsReqKind     = 42
 
 	// receive the latest offset (i.e. the offset of the next coming message)
 	OffsetReqTimeLatest = -1
@@ -101,34 +104,121 @@ func ReadResp(r io.Reader) (correlationID int32, b []byte, err error) {
 	return correlationID, b, err
 }
 
+// ReadRespByKind reads a response to the request of given kind and returns
+// it decoded into the response structure, for example *MetadataResp for
+// MetadataReqKind. Responses do not carry their kind, so it must match the
+// request the response was sent for, and so must the version, which is the
+// version of that request. Only version 0 of unversioned responses exists.
+func ReadRespByKind(kind int16, r io.Reader, version int16) (interface{}, error) {
+	switch kind {
+	case ProduceReqKind:
+		return ReadVersionedProduceResp(r, version)
+	case FetchReqKind:
+		return ReadVersionedFetchResp(r, version)
+	case OffsetReqKind:
+		return ReadVersionedOffsetResp(r, version)
+	case MetadataReqKind:
+		return ReadVersionedMetadataResp(r, version)
+	case OffsetCommitReqKind:
+		return ReadVersionedOffsetCommitResp(r, version)
+	case OffsetFetchReqKind:
+		return ReadVersionedOffsetFetchResp(r, version)
+	case GroupCoordinatorReqKind:
+		return ReadVersionedGroupCoordinatorResp(r, version)
+	}
+
+	if version != 0 {
+		return nil, fmt.Errorf("unsupported version %d of request kind %d", version, kind)
+	}
+	switch kind {
+	case DescribeConfigsReqKind:
+		return ReadDescribeConfigsResp(r)
+	case AlterConfigsReqKind:
+		return ReadAlterConfigsResp(r)
+	case DeleteGroupsReqKind:
+		return ReadDeleteGroupsResp(r)
+	default:
+		return nil, fmt.Errorf("unknown request kind %d", kind)
+	}
+}
+
 // Message represents single entity of message set.
 type Message struct {
 	Key       []byte
 	Value     []byte
-	Offset    int64  // set when fetching and after successful producing
-	Crc       uint32 // set when fetching, ignored when producing
-	Topic     string // set when fetching, ignored when producing
-	Partition int32  // set when fetching, ignored when producing
-	TipOffset int64  // set when fetching, ignored when processing
+	Offset    int64     // set when fetching and after successful producing
+	Crc       uint32    // set when fetching, ignored when producing
+	Topic     string    // set when fetching, ignored when producing
+	Partition int32     // set when fetching, ignored when producing
+	TipOffset int64     // set when fetching, ignored when processing
+	Timestamp time.Time // since message format v1, zero if not set
+
+	// Attributes of the message. Compression codec bits are set by the
+	// message set compression, all other bits are sent as they are.
+	Attributes int8
+
+	// InvalidCrc makes the message serialized with invalid CRC, which is
+	// useful for testing how clients handle corrupted messages.
+	InvalidCrc bool
 }
 
-// ComputeCrc returns crc32 hash for given message content.
+// compressionMask selects compression codec bits of message attributes.
+const compressionMask = 3
+
+const (
+	// message formats, identified by the message magic byte
+	MessageFormatV0 = 0
+	MessageFormatV1 = 1
+)
+
+// ComputeCrc returns crc32 hash for given message content, serialized using
+// message format v0.
 func ComputeCrc(m *Message, compression Compression) uint32 {
+	return ComputeVersionedCrc(m, compression, MessageFormatV0)
+}
+
+// ComputeVersionedCrc returns crc32 hash for given message content, serialized
+// using given message format. Since message format v1, the hash covers the
+// message timestamp as well.
+func ComputeVersionedCrc(m *Message, compression Compression, magic int8) uint32 {
 	var buf bytes.Buffer
 	enc := NewEncoder(&buf)
-	enc.EncodeInt8(0) // magic byte is always 0
-	enc.EncodeInt8(int8(compression))
+	enc.EncodeInt8(magic)
+	enc.EncodeInt8(m.Attributes&^compressionMask | int8(compression))
+	if magic >= MessageFormatV1 {
+		enc.EncodeInt64(timestampMs(m.Timestamp))
+	}
 	enc.EncodeBytes(m.Key)
 	enc.EncodeBytes(m.Value)
 	return crc32.ChecksumIEEE(buf.Bytes())
 }
 
-// writeMessageSet writes a Message Set into w.
+// writeMessageSet writes a Message Set into w using message format v0.
 // It returns the number of bytes written and any error.
 func writeMessageSet(w io.Writer, messages []*Message, compression Compression) (int, error) {
+	return writeVersionedMessageSet(w, messages, compression, MessageFormatV0)
+}
+
+// writeVersionedMessageSet writes a Message Set into w using given message
+// format. Only uncompressed message sets can be written using message format
+// v1, because it requires relative offsets of compressed messages.
+// It returns the number of bytes written and any error.
+func writeVersionedMessageSet(w io.Writer, messages []*Message, compression Compression, magic int8) (int, error) {
 	if len(messages) == 0 {
 		return 0, nil
 	}
+	if magic != MessageFormatV0 && magic != MessageFormatV1 {
+		return 0, fmt.Errorf("unsupported message format %d", magic)
+	}
+	if magic == MessageFormatV1 && compression != CompressionNone {
+		return 0, errors.New("compression is not supported with message format v1")
+	}
+	// timestamp is written since message format v1
+	var tsize int
+	if magic >= MessageFormatV1 {
+		tsize = 8
+	}
+
 	// NOTE(caleb): it doesn't appear to be documented, but I observed that the
 	// Java client sets the offset of the synthesized message set for a group of
 	// compressed messages to be the offset of the last message in the set.
@@ -165,16 +255,19 @@ func writeMessageSet(w io.Writer, messages []*Message, compression Compression)
 	totalSize := 0
 	b := newSliceWriter(0)
 	for _, message := range messages {
-		bsize := 26 + len(message.Key) + len(message.Value)
+		bsize := 26 + tsize + len(message.Key) + len(message.Value)
 		b.Reset(bsize)
 
 		enc := NewEncoder(b)
 		enc.EncodeInt64(message.Offset)
-		msize := int32(14 + len(message.Key) + len(message.Value))
+		msize := int32(14 + tsize + len(message.Key) + len(message.Value))
 		enc.EncodeInt32(msize)
 		enc.EncodeUint32(0) // crc32 placeholder
-		enc.EncodeInt8(0)   // magic byte
-		enc.EncodeInt8(int8(compression))
+		enc.EncodeInt8(magic)
+		enc.EncodeInt8(message.Attributes&^compressionMask | int8(compression))
+		if magic >= MessageFormatV1 {
+			enc.EncodeInt64(timestampMs(message.Timestamp))
+		}
 		enc.EncodeBytes(message.Key)
 		enc.EncodeBytes(message.Value)
 
@@ -184,7 +277,11 @@ func writeMessageSet(w io.Writer, messages []*Message, compression Compression)
 
 		const hsize = 8 + 4 + 4 // offset + message size + crc32
 		const crcoff = 8 + 4    // offset + message size
-		binary.BigEndian.PutUint32(b.buf[crcoff:crcoff+4], crc32.ChecksumIEEE(b.buf[hsize:bsize]))
+		crc := crc32.ChecksumIEEE(b.buf[hsize:bsize])
+		if message.InvalidCrc {
+			crc = ^crc
+		}
+		binary.BigEndian.PutUint32(b.buf[crcoff:crcoff+4], crc)
 
 		if n, err := w.Write(b.Slice()); err != nil {
 			return totalSize, err
@@ -196,6 +293,24 @@ func writeMessageSet(w io.Writer, messages []*Message, compression Compression)
 	return totalSize, nil
 }
 
+// timestampMs returns given time as milliseconds since epoch, or -1 if the time
+// is not set.
+func timestampMs(t time.Time) int64 {
+	if t.IsZero() {
+		return -1
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// timestampTime returns time represented by given milliseconds since epoch.
+// Negative timestamp means the time is not set.
+func timestampTime(ms int64) time.Time {
+	if ms < 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
 type slicewriter struct {
 	buf  []byte
 	pos  int
@@ -285,12 +400,15 @@ func readMessageSet(r io.Reader, size int32) ([]*Message, error) {
 			return set, nil
 		}
 
-		// magic byte
-		_ = msgdec.DecodeInt8()
-
+		magic := msgdec.DecodeInt8()
 		attributes := msgdec.DecodeInt8()
-		switch compression := Compression(attributes & 3); compression {
+		if magic >= MessageFormatV1 {
+			msg.Timestamp = timestampTime(msgdec.DecodeInt64())
+		}
+
+		switch compression := Compression(attributes & compressionMask); compression {
 		case CompressionNone:
+			msg.Attributes = attributes
 			msg.Key = msgdec.DecodeBytes()
 			msg.Value = msgdec.DecodeBytes()
 			if err := msgdec.Err(); err != nil {
@@ -326,6 +444,14 @@ func readMessageSet(r io.Reader, size int32) ([]*Message, error) {
 			if err != nil {
 				return nil, err
 			}
+			// Since message format v1, offsets of compressed messages are
+			// relative and the wrapper carries offset of the last one.
+			if magic >= MessageFormatV1 && len(msgs) > 0 {
+				delta := offset - msgs[len(msgs)-1].Offset
+				for _, m := range msgs {
+					m.Offset += delta
+				}
+			}
 			set = append(set, msgs...)
 		default:
 			return nil, fmt.Errorf("cannot handle compression method: %d", compression)
@@ -334,9 +460,15 @@ func readMessageSet(r io.Reader, size int32) ([]*Message, error) {
 }
 
 type MetadataReq struct {
+	Version       int16
 	CorrelationID int32
 	ClientID      string
-	Topics        []string
+
+	// Topics to describe. Since v1, nil means all topics and empty list
+	// means no topics. Before v1, both mean all topics.
+	Topics []string
+
+	AllowAutoTopicCreation bool // since v4
 }
 
 func ReadMetadataReq(r io.Reader) (*MetadataReq, error) {
@@ -345,14 +477,21 @@ func ReadMetadataReq(r io.Reader) (*MetadataReq, error) {
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
-	req.Topics = make([]string, dec.DecodeArrayLen())
+	// null array is sent as -1 length
+	if n := dec.DecodeArrayLen(); n >= 0 {
+		req.Topics = make([]string, n)
+	}
 	for i := range req.Topics {
 		req.Topics[i] = dec.DecodeString()
 	}
+	if req.Version >= 4 {
+		req.AllowAutoTopicCreation = dec.DecodeInt8() != 0
+	}
 
 	if dec.Err() != nil {
 		return nil, dec.Err()
@@ -367,14 +506,21 @@ func (r *MetadataReq) Bytes() ([]byte, error) {
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(int16(MetadataReqKind))
-	enc.Encode(int16(0))
+	enc.Encode(r.Version)
 	enc.Encode(r.CorrelationID)
 	enc.Encode(r.ClientID)
 
-	enc.EncodeArrayLen(len(r.Topics))
+	if r.Version >= 1 && r.Topics == nil {
+		enc.EncodeArrayLen(-1)
+	} else {
+		enc.EncodeArrayLen(len(r.Topics))
+	}
 	for _, name := range r.Topics {
 		enc.Encode(name)
 	}
+	if r.Version >= 4 {
+		enc.Encode(r.AllowAutoTopicCreation)
+	}
 
 	if enc.Err() != nil {
 		return nil, enc.Err()
@@ -397,8 +543,12 @@ func (r *MetadataReq) WriteTo(w io.Writer) (int64, error) {
 }
 
 type MetadataResp struct {
+	Version       int16 // not sent over the wire, selects the encoding
 	CorrelationID int32
+	ThrottleTime  time.Duration // since v3
 	Brokers       []MetadataRespBroker
+	ClusterID     string // since v2
+	ControllerID  int32  // since v1
 	Topics        []MetadataRespTopic
 }
 
@@ -406,20 +556,24 @@ type MetadataRespBroker struct {
 	NodeID int32
 	Host   string
 	Port   int32
+	Rack   string // since v1
 }
 
 type MetadataRespTopic struct {
 	Name       string
 	Err        error
+	IsInternal bool // since v1
 	Partitions []MetadataRespPartition
 }
 
 type MetadataRespPartition struct {
-	ID       int32
-	Err      error
-	Leader   int32
-	Replicas []int32
-	Isrs     []int32
+	ID              int32
+	Err             error
+	Leader          int32
+	LeaderEpoch     int32 // since v7
+	Replicas        []int32
+	Isrs            []int32
+	OfflineReplicas []int32 // since v5
 }
 
 func (r *MetadataResp) Bytes() ([]byte, error) {
@@ -429,23 +583,44 @@ func (r *MetadataResp) Bytes() ([]byte, error) {
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(r.CorrelationID)
+	if r.Version >= 3 {
+		enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	}
 	enc.EncodeArrayLen(len(r.Brokers))
 	for _, broker := range r.Brokers {
 		enc.Encode(broker.NodeID)
 		enc.Encode(broker.Host)
 		enc.Encode(broker.Port)
+		if r.Version >= 1 {
+			enc.EncodeNullableString(broker.Rack)
+		}
+	}
+	if r.Version >= 2 {
+		enc.EncodeNullableString(r.ClusterID)
+	}
+	if r.Version >= 1 {
+		enc.Encode(r.ControllerID)
 	}
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
 		enc.EncodeError(topic.Err)
 		enc.Encode(topic.Name)
+		if r.Version >= 1 {
+			enc.Encode(topic.IsInternal)
+		}
 		enc.EncodeArrayLen(len(topic.Partitions))
 		for _, part := range topic.Partitions {
 			enc.EncodeError(part.Err)
 			enc.Encode(part.ID)
 			enc.Encode(part.Leader)
+			if r.Version >= 7 {
+				enc.Encode(part.LeaderEpoch)
+			}
 			enc.Encode(part.Replicas)
 			enc.Encode(part.Isrs)
+			if r.Version >= 5 {
+				enc.Encode(part.OfflineReplicas)
+			}
 		}
 	}
 
@@ -460,13 +635,26 @@ func (r *MetadataResp) Bytes() ([]byte, error) {
 	return b, nil
 }
 
+// ReadMetadataResp reads a version 0 metadata response.
 func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
+	return ReadVersionedMetadataResp(r, 0)
+}
+
+// ReadVersionedMetadataResp reads a metadata response encoded using given
+// protocol version. Responses do not carry their version, so it must match the
+// version of the request the response was sent for.
+func ReadVersionedMetadataResp(r io.Reader, version int16) (*MetadataResp, error) {
 	var resp MetadataResp
 	dec := NewDecoder(r)
 
+	resp.Version = version
+
 	// total message size
 	_ = dec.DecodeInt32()
 	resp.CorrelationID = dec.DecodeInt32()
+	if version >= 3 {
+		resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	}
 
 	resp.Brokers = make([]MetadataRespBroker, dec.DecodeArrayLen())
 	for i := range resp.Brokers {
@@ -474,6 +662,15 @@ func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
 		b.NodeID = dec.DecodeInt32()
 		b.Host = dec.DecodeString()
 		b.Port = dec.DecodeInt32()
+		if version >= 1 {
+			b.Rack = dec.DecodeString()
+		}
+	}
+	if version >= 2 {
+		resp.ClusterID = dec.DecodeString()
+	}
+	if version >= 1 {
+		resp.ControllerID = dec.DecodeInt32()
 	}
 
 	resp.Topics = make([]MetadataRespTopic, dec.DecodeArrayLen())
@@ -481,12 +678,18 @@ func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
 		var t = &resp.Topics[ti]
 		t.Err = errFromNo(dec.DecodeInt16())
 		t.Name = dec.DecodeString()
+		if version >= 1 {
+			t.IsInternal = dec.DecodeInt8() != 0
+		}
 		t.Partitions = make([]MetadataRespPartition, dec.DecodeArrayLen())
 		for pi := range t.Partitions {
 			var p = &t.Partitions[pi]
 			p.Err = errFromNo(dec.DecodeInt16())
 			p.ID = dec.DecodeInt32()
 			p.Leader = dec.DecodeInt32()
+			if version >= 7 {
+				p.LeaderEpoch = dec.DecodeInt32()
+			}
 
 			p.Replicas = make([]int32, dec.DecodeArrayLen())
 			for ri := range p.Replicas {
@@ -497,6 +700,13 @@ func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
 			for ii := range p.Isrs {
 				p.Isrs[ii] = dec.DecodeInt32()
 			}
+
+			if version >= 5 {
+				p.OfflineReplicas = make([]int32, dec.DecodeArrayLen())
+				for oi := range p.OfflineReplicas {
+					p.OfflineReplicas[oi] = dec.DecodeInt32()
+				}
+			}
 		}
 	}
 
@@ -507,12 +717,19 @@ func ReadMetadataResp(r io.Reader) (*MetadataResp, error) {
 }
 
 type FetchReq struct {
-	CorrelationID int32
-	ClientID      string
-	MaxWaitTime   time.Duration
-	MinBytes      int32
+	Version        int16
+	CorrelationID  int32
+	ClientID       string
+	MaxWaitTime    time.Duration
+	MinBytes       int32
+	MaxBytes       int32 // since v3
+	IsolationLevel int8  // since v4
+	SessionID      int32 // since v7
+	SessionEpoch   int32 // since v7
 
-	Topics []FetchReqTopic
+	Topics          []FetchReqTopic
+	ForgottenTopics []FetchReqForgottenTopic // since v7
+	RackID          string                   // since v11
 }
 
 type FetchReqTopic struct {
@@ -521,9 +738,17 @@ type FetchReqTopic struct {
 }
 
 type FetchReqPartition struct {
-	ID          int32
-	FetchOffset int64
-	MaxBytes    int32
+	ID                 int32
+	CurrentLeaderEpoch int32 // since v9
+	FetchOffset        int64
+	LogStartOffset     int64 // since v5
+	MaxBytes           int32
+}
+
+// FetchReqForgottenTopic lists partitions to remove from the fetch session.
+type FetchReqForgottenTopic struct {
+	Name       string
+	Partitions []int32
 }
 
 func ReadFetchReq(r io.Reader) (*FetchReq, error) {
@@ -532,14 +757,25 @@ func ReadFetchReq(r io.Reader) (*FetchReq, error) {
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
 	// replica id
 	_ = dec.DecodeInt32()
 	req.MaxWaitTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
 	req.MinBytes = dec.DecodeInt32()
+	if req.Version >= 3 {
+		req.MaxBytes = dec.DecodeInt32()
+	}
+	if req.Version >= 4 {
+		req.IsolationLevel = dec.DecodeInt8()
+	}
+	if req.Version >= 7 {
+		req.SessionID = dec.DecodeInt32()
+		req.SessionEpoch = dec.DecodeInt32()
+	}
 	req.Topics = make([]FetchReqTopic, dec.DecodeArrayLen())
 	for ti := range req.Topics {
 		var topic = &req.Topics[ti]
@@ -548,10 +784,32 @@ func ReadFetchReq(r io.Reader) (*FetchReq, error) {
 		for pi := range topic.Partitions {
 			var part = &topic.Partitions[pi]
 			part.ID = dec.DecodeInt32()
+			if req.Version >= 9 {
+				part.CurrentLeaderEpoch = dec.DecodeInt32()
+			}
 			part.FetchOffset = dec.DecodeInt64()
+			if req.Version >= 5 {
+				part.LogStartOffset = dec.DecodeInt64()
+			}
 			part.MaxBytes = dec.DecodeInt32()
 		}
 	}
+	if req.Version >= 7 {
+		if n := dec.DecodeArrayLen(); n > 0 {
+			req.ForgottenTopics = make([]FetchReqForgottenTopic, n)
+			for ti := range req.ForgottenTopics {
+				var topic = &req.ForgottenTopics[ti]
+				topic.Name = dec.DecodeString()
+				topic.Partitions = make([]int32, dec.DecodeArrayLen())
+				for pi := range topic.Partitions {
+					topic.Partitions[pi] = dec.DecodeInt32()
+				}
+			}
+		}
+	}
+	if req.Version >= 11 {
+		req.RackID = dec.DecodeString()
+	}
 
 	if dec.Err() != nil {
 		return nil, dec.Err()
@@ -566,7 +824,7 @@ func (r *FetchReq) Bytes() ([]byte, error) {
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(int16(FetchReqKind))
-	enc.Encode(int16(0))
+	enc.Encode(r.Version)
 	enc.Encode(r.CorrelationID)
 	enc.Encode(r.ClientID)
 
@@ -574,6 +832,16 @@ func (r *FetchReq) Bytes() ([]byte, error) {
 	enc.Encode(int32(-1))
 	enc.Encode(int32(r.MaxWaitTime / time.Millisecond))
 	enc.Encode(r.MinBytes)
+	if r.Version >= 3 {
+		enc.Encode(r.MaxBytes)
+	}
+	if r.Version >= 4 {
+		enc.Encode(r.IsolationLevel)
+	}
+	if r.Version >= 7 {
+		enc.Encode(r.SessionID)
+		enc.Encode(r.SessionEpoch)
+	}
 
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
@@ -581,10 +849,29 @@ func (r *FetchReq) Bytes() ([]byte, error) {
 		enc.EncodeArrayLen(len(topic.Partitions))
 		for _, part := range topic.Partitions {
 			enc.Encode(part.ID)
+			if r.Version >= 9 {
+				enc.Encode(part.CurrentLeaderEpoch)
+			}
 			enc.Encode(part.FetchOffset)
+			if r.Version >= 5 {
+				enc.Encode(part.LogStartOffset)
+			}
 			enc.Encode(part.MaxBytes)
 		}
 	}
+	if r.Version >= 7 {
+		enc.EncodeArrayLen(len(r.ForgottenTopics))
+		for _, topic := range r.ForgottenTopics {
+			enc.Encode(topic.Name)
+			enc.EncodeArrayLen(len(topic.Partitions))
+			for _, part := range topic.Partitions {
+				enc.Encode(part)
+			}
+		}
+	}
+	if r.Version >= 11 {
+		enc.Encode(r.RackID)
+	}
 
 	if enc.Err() != nil {
 		return nil, enc.Err()
@@ -607,8 +894,18 @@ func (r *FetchReq) WriteTo(w io.Writer) (int64, error) {
 }
 
 type FetchResp struct {
+	Version       int16 // not sent over the wire, selects the encoding
 	CorrelationID int32
-	Topics        []FetchRespTopic
+
+	// MessageFormat is the message format used to encode messages. It is
+	// not sent over the wire and is ignored when reading the response, as
+	// the format of every message is decoded from the message itself.
+	MessageFormat int8
+
+	ThrottleTime time.Duration // since v1
+	Err          error         // since v7, top level error of the fetch session
+	SessionID    int32         // since v7
+	Topics       []FetchRespTopic
 }
 
 type FetchRespTopic struct {
@@ -617,10 +914,23 @@ type FetchRespTopic struct {
 }
 
 type FetchRespPartition struct {
-	ID        int32
-	Err       error
-	TipOffset int64
-	Messages  []*Message
+	ID                  int32
+	Err                 error
+	TipOffset           int64
+	LastStableOffset    int64                         // since v4
+	LogStartOffset      int64                         // since v5
+	AbortedTransactions []FetchRespAbortedTransaction // since v4
+
+	// PreferredReadReplica is the node the client should fetch the
+	// partition from, or -1 to keep fetching from the leader. Since v11.
+	PreferredReadReplica int32
+
+	Messages []*Message
+}
+
+type FetchRespAbortedTransaction struct {
+	ProducerID  int64
+	FirstOffset int64
 }
 
 func (r *FetchResp) Bytes() ([]byte, error) {
@@ -629,6 +939,13 @@ func (r *FetchResp) Bytes() ([]byte, error) {
 
 	enc.Encode(int32(0)) // placeholder
 	enc.Encode(r.CorrelationID)
+	if r.Version >= 1 {
+		enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	}
+	if r.Version >= 7 {
+		enc.EncodeError(r.Err)
+		enc.Encode(r.SessionID)
+	}
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
 		enc.Encode(topic.Name)
@@ -637,11 +954,27 @@ func (r *FetchResp) Bytes() ([]byte, error) {
 			enc.Encode(part.ID)
 			enc.EncodeError(part.Err)
 			enc.Encode(part.TipOffset)
+			if r.Version >= 4 {
+				enc.Encode(part.LastStableOffset)
+			}
+			if r.Version >= 5 {
+				enc.Encode(part.LogStartOffset)
+			}
+			if r.Version >= 4 {
+				enc.EncodeArrayLen(len(part.AbortedTransactions))
+				for _, txn := range part.AbortedTransactions {
+					enc.Encode(txn.ProducerID)
+					enc.Encode(txn.FirstOffset)
+				}
+			}
+			if r.Version >= 11 {
+				enc.Encode(part.PreferredReadReplica)
+			}
 			i := len(buf)
 			enc.Encode(int32(0)) // placeholder
 			// NOTE(caleb): writing compressed fetch response isn't implemented
 			// for now, since that's not needed for clients.
-			n, err := writeMessageSet(&buf, part.Messages, CompressionNone)
+			n, err := writeVersionedMessageSet(&buf, part.Messages, CompressionNone, r.MessageFormat)
 			if err != nil {
 				return nil, err
 			}
@@ -657,15 +990,32 @@ func (r *FetchResp) Bytes() ([]byte, error) {
 	return []byte(buf), nil
 }
 
+// ReadFetchResp reads a version 0 fetch response.
 func ReadFetchResp(r io.Reader) (*FetchResp, error) {
+	return ReadVersionedFetchResp(r, 0)
+}
+
+// ReadVersionedFetchResp reads a fetch response encoded using given protocol
+// version. Responses do not carry their version, so it must match the version
+// of the request the response was sent for.
+func ReadVersionedFetchResp(r io.Reader, version int16) (*FetchResp, error) {
 	var err error
 	var resp FetchResp
 
 	dec := NewDecoder(r)
 
+	resp.Version = version
+
 	// total message size
 	_ = dec.DecodeInt32()
 	resp.CorrelationID = dec.DecodeInt32()
+	if version >= 1 {
+		resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	}
+	if version >= 7 {
+		resp.Err = errFromNo(dec.DecodeInt16())
+		resp.SessionID = dec.DecodeInt32()
+	}
 
 	resp.Topics = make([]FetchRespTopic, dec.DecodeArrayLen())
 	for ti := range resp.Topics {
@@ -677,6 +1027,26 @@ func ReadFetchResp(r io.Reader) (*FetchResp, error) {
 			part.ID = dec.DecodeInt32()
 			part.Err = errFromNo(dec.DecodeInt16())
 			part.TipOffset = dec.DecodeInt64()
+			if version >= 4 {
+				part.LastStableOffset = dec.DecodeInt64()
+			}
+			if version >= 5 {
+				part.LogStartOffset = dec.DecodeInt64()
+			}
+			if version >= 4 {
+				// null array is sent as -1 length, same as empty one
+				if n := dec.DecodeArrayLen(); n > 0 {
+					part.AbortedTransactions = make([]FetchRespAbortedTransaction, n)
+					for ai := range part.AbortedTransactions {
+						var txn = &part.AbortedTransactions[ai]
+						txn.ProducerID = dec.DecodeInt64()
+						txn.FirstOffset = dec.DecodeInt64()
+					}
+				}
+			}
+			if version >= 11 {
+				part.PreferredReadReplica = dec.DecodeInt32()
+			}
 			if dec.Err() != nil {
 				return nil, dec.Err()
 			}
@@ -701,10 +1071,23 @@ func ReadFetchResp(r io.Reader) (*FetchResp, error) {
 	return &resp, nil
 }
 
+const (
+	// coordinator types of FindCoordinator requests, since v1
+	CoordinatorGroup       = 0
+	CoordinatorTransaction = 1
+)
+
+// GroupCoordinatorReq is the FindCoordinator request. Before v1 only group
+// coordinators can be looked up.
 type GroupCoordinatorReq struct {
+	Version       int16
 	CorrelationID int32
 	ClientID      string
-	ConsumerGroup string
+
+	// ConsumerGroup is the coordinator key, which is the transactional ID
+	// when looking up transaction coordinator.
+	ConsumerGroup   string
+	CoordinatorType int8 // since v1
 }
 
 func ReadGroupCoordinatorReq(r io.Reader) (*GroupCoordinatorReq, error) {
@@ -713,11 +1096,15 @@ func ReadGroupCoordinatorReq(r io.Reader) (*GroupCoordinatorReq, error) {
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
 	req.ConsumerGroup = dec.DecodeString()
+	if req.Version >= 1 {
+		req.CoordinatorType = dec.DecodeInt8()
+	}
 
 	if dec.Err() != nil {
 		return nil, dec.Err()
@@ -732,11 +1119,14 @@ func (r *GroupCoordinatorReq) Bytes() ([]byte, error) {
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(int16(GroupCoordinatorReqKind))
-	enc.Encode(int16(0))
+	enc.Encode(r.Version)
 	enc.Encode(r.CorrelationID)
 	enc.Encode(r.ClientID)
 
 	enc.Encode(r.ConsumerGroup)
+	if r.Version >= 1 {
+		enc.Encode(r.CoordinatorType)
+	}
 
 	if enc.Err() != nil {
 		return nil, enc.Err()
@@ -759,21 +1149,39 @@ func (r *GroupCoordinatorReq) WriteTo(w io.Writer) (int64, error) {
 }
 
 type GroupCoordinatorResp struct {
+	Version         int16 // not sent over the wire, selects the encoding
 	CorrelationID   int32
+	ThrottleTime    time.Duration // since v1
 	Err             error
+	ErrMessage      string // since v1
 	CoordinatorID   int32
 	CoordinatorHost string
 	CoordinatorPort int32
 }
 
+// ReadGroupCoordinatorResp reads a version 0 FindCoordinator response.
 func ReadGroupCoordinatorResp(r io.Reader) (*GroupCoordinatorResp, error) {
+	return ReadVersionedGroupCoordinatorResp(r, 0)
+}
+
+// ReadVersionedGroupCoordinatorResp reads a FindCoordinator response encoded
+// using given protocol version.
+func ReadVersionedGroupCoordinatorResp(r io.Reader, version int16) (*GroupCoordinatorResp, error) {
 	var resp GroupCoordinatorResp
 	dec := NewDecoder(r)
 
+	resp.Version = version
+
 	// total message size
 	_ = dec.DecodeInt32()
 	resp.CorrelationID = dec.DecodeInt32()
+	if version >= 1 {
+		resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	}
 	resp.Err = errFromNo(dec.DecodeInt16())
+	if version >= 1 {
+		resp.ErrMessage = dec.DecodeString()
+	}
 	resp.CoordinatorID = dec.DecodeInt32()
 	resp.CoordinatorHost = dec.DecodeString()
 	resp.CoordinatorPort = dec.DecodeInt32()
@@ -791,7 +1199,13 @@ func (r *GroupCoordinatorResp) Bytes() ([]byte, error) {
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(r.CorrelationID)
+	if r.Version >= 1 {
+		enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	}
 	enc.EncodeError(r.Err)
+	if r.Version >= 1 {
+		enc.EncodeNullableString(r.ErrMessage)
+	}
 	enc.Encode(r.CoordinatorID)
 	enc.Encode(r.CoordinatorHost)
 	enc.Encode(r.CoordinatorPort)
@@ -807,10 +1221,15 @@ func (r *GroupCoordinatorResp) Bytes() ([]byte, error) {
 	return b, nil
 }
 
+// OffsetCommitReq commits offsets of a consumer group. Versions 1 to 3 are
+// supported. Version 0 stores offsets in ZooKeeper, so it is sent as version
+// 1 instead.
 type OffsetCommitReq struct {
+	Version       int16
 	CorrelationID int32
 	ClientID      string
 	ConsumerGroup string
+	RetentionTime time.Duration // since v2, zero means the broker default
 	Topics        []OffsetCommitReqTopic
 }
 
@@ -822,7 +1241,7 @@ type OffsetCommitReqTopic struct {
 type OffsetCommitReqPartition struct {
 	ID        int32
 	Offset    int64
-	TimeStamp time.Time
+	TimeStamp time.Time // only in v1
 	Metadata  string
 }
 
@@ -834,14 +1253,20 @@ func ReadOffsetCommitReq(r io.Reader) (*OffsetCommitReq, error) {
 	_ = dec.DecodeInt32()
 	// api key
 	_ = dec.DecodeInt16()
-	apiVersion := dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
 	req.ConsumerGroup = dec.DecodeString()
-	if apiVersion == 1 {
+	if req.Version >= 1 {
+		// generation ID + member ID
 		_ = dec.DecodeInt32()
 		_ = dec.DecodeString()
 	}
+	if req.Version >= 2 {
+		if ms := dec.DecodeInt64(); ms != -1 {
+			req.RetentionTime = time.Duration(ms) * time.Millisecond
+		}
+	}
 	req.Topics = make([]OffsetCommitReqTopic, dec.DecodeArrayLen())
 	for ti := range req.Topics {
 		var topic = &req.Topics[ti]
@@ -851,7 +1276,9 @@ func ReadOffsetCommitReq(r io.Reader) (*OffsetCommitReq, error) {
 			var part = &topic.Partitions[pi]
 			part.ID = dec.DecodeInt32()
 			part.Offset = dec.DecodeInt64()
-			part.TimeStamp = time.Unix(0, dec.DecodeInt64()*int64(time.Millisecond))
+			if req.Version == 1 {
+				part.TimeStamp = time.Unix(0, dec.DecodeInt64()*int64(time.Millisecond))
+			}
 			part.Metadata = dec.DecodeString()
 		}
 	}
@@ -869,13 +1296,25 @@ func (r *OffsetCommitReq) Bytes() ([]byte, error) {
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(int16(OffsetCommitReqKind))
-	enc.Encode(int16(1)) // version - must be 1 to use Kafka committed offsets instead of ZK
+	// version must be at least 1 to use Kafka committed offsets instead of ZK
+	version := r.Version
+	if version < 1 {
+		version = 1
+	}
+	enc.Encode(version)
 	enc.Encode(r.CorrelationID)
 	enc.Encode(r.ClientID)
 
 	enc.Encode(r.ConsumerGroup)
 	enc.Encode(int32(-1)) // ConsumerGroupGenerationId
 	enc.Encode("")        // ConsumerId
+	if version >= 2 {
+		retention := int64(-1) // -1 is "use broker default"
+		if r.RetentionTime > 0 {
+			retention = int64(r.RetentionTime / time.Millisecond)
+		}
+		enc.Encode(retention)
+	}
 
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
@@ -884,7 +1323,9 @@ func (r *OffsetCommitReq) Bytes() ([]byte, error) {
 		for _, part := range topic.Partitions {
 			enc.Encode(part.ID)
 			enc.Encode(part.Offset)
-			enc.Encode(int64(-1)) // -1 is "use current time"
+			if version == 1 {
+				enc.Encode(int64(-1)) // -1 is "use current time"
+			}
 			enc.Encode(part.Metadata)
 		}
 	}
@@ -910,7 +1351,9 @@ func (r *OffsetCommitReq) WriteTo(w io.Writer) (int64, error) {
 }
 
 type OffsetCommitResp struct {
+	Version       int16 // not sent over the wire, selects the encoding
 	CorrelationID int32
+	ThrottleTime  time.Duration // since v3
 	Topics        []OffsetCommitRespTopic
 }
 
@@ -924,13 +1367,26 @@ type OffsetCommitRespPartition struct {
 	Err error
 }
 
+// ReadOffsetCommitResp reads a version 0 offset commit response.
 func ReadOffsetCommitResp(r io.Reader) (*OffsetCommitResp, error) {
+	return ReadVersionedOffsetCommitResp(r, 0)
+}
+
+// ReadVersionedOffsetCommitResp reads an offset commit response encoded using
+// given protocol version. Responses do not carry their version, so it must
+// match the version of the request the response was sent for.
+func ReadVersionedOffsetCommitResp(r io.Reader, version int16) (*OffsetCommitResp, error) {
 	var resp OffsetCommitResp
 	dec := NewDecoder(r)
 
+	resp.Version = version
+
 	// total message size
 	_ = dec.DecodeInt32()
 	resp.CorrelationID = dec.DecodeInt32()
+	if version >= 3 {
+		resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	}
 	resp.Topics = make([]OffsetCommitRespTopic, dec.DecodeArrayLen())
 	for ti := range resp.Topics {
 		var t = &resp.Topics[ti]
@@ -956,6 +1412,9 @@ func (r *OffsetCommitResp) Bytes() ([]byte, error) {
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(r.CorrelationID)
+	if r.Version >= 3 {
+		enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	}
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, t := range r.Topics {
 		enc.Encode(t.Name)
@@ -978,7 +1437,11 @@ func (r *OffsetCommitResp) Bytes() ([]byte, error) {
 
 }
 
+// OffsetFetchReq fetches committed offsets of a consumer group. Versions 1
+// to 3 are supported. Version 0 reads offsets from ZooKeeper, so it is sent
+// as version 1 instead.
 type OffsetFetchReq struct {
+	Version       int16
 	CorrelationID int32
 	ClientID      string
 	ConsumerGroup string
@@ -996,8 +1459,9 @@ func ReadOffsetFetchReq(r io.Reader) (*OffsetFetchReq, error) {
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
 	req.ConsumerGroup = dec.DecodeString()
@@ -1024,7 +1488,12 @@ func (r *OffsetFetchReq) Bytes() ([]byte, error) {
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(int16(OffsetFetchReqKind))
-	enc.Encode(int16(1)) // version - must be 1 to use Kafka committed offsets instead of ZK
+	// version must be at least 1 to use Kafka committed offsets instead of ZK
+	version := r.Version
+	if version < 1 {
+		version = 1
+	}
+	enc.Encode(version)
 	enc.Encode(r.CorrelationID)
 	enc.Encode(r.ClientID)
 
@@ -1059,8 +1528,11 @@ func (r *OffsetFetchReq) WriteTo(w io.Writer) (int64, error) {
 }
 
 type OffsetFetchResp struct {
+	Version       int16 // not sent over the wire, selects the encoding
 	CorrelationID int32
+	ThrottleTime  time.Duration // since v3
 	Topics        []OffsetFetchRespTopic
+	Err           error // since v2
 }
 
 type OffsetFetchRespTopic struct {
@@ -1075,13 +1547,26 @@ type OffsetFetchRespPartition struct {
 	Err      error
 }
 
+// ReadOffsetFetchResp reads a version 0 offset fetch response.
 func ReadOffsetFetchResp(r io.Reader) (*OffsetFetchResp, error) {
+	return ReadVersionedOffsetFetchResp(r, 0)
+}
+
+// ReadVersionedOffsetFetchResp reads an offset fetch response encoded using
+// given protocol version. Responses do not carry their version, so it must
+// match the version of the request the response was sent for.
+func ReadVersionedOffsetFetchResp(r io.Reader, version int16) (*OffsetFetchResp, error) {
 	var resp OffsetFetchResp
 	dec := NewDecoder(r)
 
+	resp.Version = version
+
 	// total message size
 	_ = dec.DecodeInt32()
 	resp.CorrelationID = dec.DecodeInt32()
+	if version >= 3 {
+		resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	}
 	resp.Topics = make([]OffsetFetchRespTopic, dec.DecodeArrayLen())
 	for ti := range resp.Topics {
 		var t = &resp.Topics[ti]
@@ -1095,6 +1580,9 @@ func ReadOffsetFetchResp(r io.Reader) (*OffsetFetchResp, error) {
 			p.Err = errFromNo(dec.DecodeInt16())
 		}
 	}
+	if version >= 2 {
+		resp.Err = errFromNo(dec.DecodeInt16())
+	}
 
 	if err := dec.Err(); err != nil {
 		return nil, err
@@ -1109,6 +1597,9 @@ func (r *OffsetFetchResp) Bytes() ([]byte, error) {
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(r.CorrelationID)
+	if r.Version >= 3 {
+		enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	}
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
 		enc.Encode(topic.Name)
@@ -1120,6 +1611,9 @@ func (r *OffsetFetchResp) Bytes() ([]byte, error) {
 			enc.EncodeError(part.Err)
 		}
 	}
+	if r.Version >= 2 {
+		enc.EncodeError(r.Err)
+	}
 
 	if enc.Err() != nil {
 		return nil, enc.Err()
@@ -1133,6 +1627,7 @@ func (r *OffsetFetchResp) Bytes() ([]byte, error) {
 }
 
 type ProduceReq struct {
+	Version       int16
 	CorrelationID int32
 	ClientID      string
 	Compression   Compression // only used when sending ProduceReqs
@@ -1157,8 +1652,9 @@ func ReadProduceReq(r io.Reader) (*ProduceReq, error) {
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
 	req.RequiredAcks = dec.DecodeInt16()
@@ -1197,7 +1693,7 @@ func (r *ProduceReq) Bytes() ([]byte, error) {
 
 	enc.EncodeInt32(0) // placeholder
 	enc.EncodeInt16(ProduceReqKind)
-	enc.EncodeInt16(0)
+	enc.EncodeInt16(r.Version)
 	enc.EncodeInt32(r.CorrelationID)
 	enc.EncodeString(r.ClientID)
 
@@ -1211,7 +1707,12 @@ func (r *ProduceReq) Bytes() ([]byte, error) {
 			enc.EncodeInt32(p.ID)
 			i := len(buf)
 			enc.EncodeInt32(0) // placeholder
-			n, err := writeMessageSet(&buf, p.Messages, r.Compression)
+			// messages with timestamps can be sent since v2
+			format := int8(MessageFormatV0)
+			if r.Version >= 2 {
+				format = MessageFormatV1
+			}
+			n, err := writeVersionedMessageSet(&buf, p.Messages, r.Compression, format)
 			if err != nil {
 				return nil, err
 			}
@@ -1237,8 +1738,10 @@ func (r *ProduceReq) WriteTo(w io.Writer) (int64, error) {
 }
 
 type ProduceResp struct {
+	Version       int16 // not sent over the wire, selects the encoding
 	CorrelationID int32
 	Topics        []ProduceRespTopic
+	ThrottleTime  time.Duration // since v1
 }
 
 type ProduceRespTopic struct {
@@ -1250,6 +1753,11 @@ type ProduceRespPartition struct {
 	ID     int32
 	Err    error
 	Offset int64
+
+	// LogAppendTime is the time the messages were appended to the log, if
+	// the topic uses log append time. Zero time, sent as -1, means the
+	// create time of messages is used. Since v2.
+	LogAppendTime time.Time
 }
 
 func (r *ProduceResp) Bytes() ([]byte, error) {
@@ -1267,8 +1775,14 @@ func (r *ProduceResp) Bytes() ([]byte, error) {
 			enc.Encode(part.ID)
 			enc.EncodeError(part.Err)
 			enc.Encode(part.Offset)
+			if r.Version >= 2 {
+				enc.Encode(timestampMs(part.LogAppendTime))
+			}
 		}
 	}
+	if r.Version >= 1 {
+		enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	}
 
 	if enc.Err() != nil {
 		return nil, enc.Err()
@@ -1281,10 +1795,20 @@ func (r *ProduceResp) Bytes() ([]byte, error) {
 	return b, nil
 }
 
+// ReadProduceResp reads a version 0 produce response.
 func ReadProduceResp(r io.Reader) (*ProduceResp, error) {
+	return ReadVersionedProduceResp(r, 0)
+}
+
+// ReadVersionedProduceResp reads a produce response encoded using given
+// protocol version. Responses do not carry their version, so it must match
+// the version of the request the response was sent for.
+func ReadVersionedProduceResp(r io.Reader, version int16) (*ProduceResp, error) {
 	var resp ProduceResp
 	dec := NewDecoder(r)
 
+	resp.Version = version
+
 	// total message size
 	_ = dec.DecodeInt32()
 	resp.CorrelationID = dec.DecodeInt32()
@@ -1298,8 +1822,14 @@ func ReadProduceResp(r io.Reader) (*ProduceResp, error) {
 			p.ID = dec.DecodeInt32()
 			p.Err = errFromNo(dec.DecodeInt16())
 			p.Offset = dec.DecodeInt64()
+			if version >= 2 {
+				p.LogAppendTime = timestampTime(dec.DecodeInt64())
+			}
 		}
 	}
+	if version >= 1 {
+		resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	}
 
 	if err := dec.Err(); err != nil {
 		return nil, err
@@ -1307,11 +1837,14 @@ func ReadProduceResp(r io.Reader) (*ProduceResp, error) {
 	return &resp, nil
 }
 
+// OffsetReq is the ListOffsets request. Versions 0 to 2 are supported.
 type OffsetReq struct {
-	CorrelationID int32
-	ClientID      string
-	ReplicaID     int32
-	Topics        []OffsetReqTopic
+	Version        int16
+	CorrelationID  int32
+	ClientID       string
+	ReplicaID      int32
+	IsolationLevel int8 // since v2
+	Topics         []OffsetReqTopic
 }
 
 type OffsetReqTopic struct {
@@ -1322,7 +1855,7 @@ type OffsetReqTopic struct {
 type OffsetReqPartition struct {
 	ID         int32
 	TimeMs     int64 // cannot be time.Time because of negative values
-	MaxOffsets int32
+	MaxOffsets int32 // only in v0
 }
 
 func ReadOffsetReq(r io.Reader) (*OffsetReq, error) {
@@ -1331,11 +1864,15 @@ func ReadOffsetReq(r io.Reader) (*OffsetReq, error) {
 
 	// total message size
 	_ = dec.DecodeInt32()
-	// api key + api version
-	_ = dec.DecodeInt32()
+	// api key
+	_ = dec.DecodeInt16()
+	req.Version = dec.DecodeInt16()
 	req.CorrelationID = dec.DecodeInt32()
 	req.ClientID = dec.DecodeString()
 	req.ReplicaID = dec.DecodeInt32()
+	if req.Version >= 2 {
+		req.IsolationLevel = dec.DecodeInt8()
+	}
 	req.Topics = make([]OffsetReqTopic, dec.DecodeArrayLen())
 	for ti := range req.Topics {
 		var topic = &req.Topics[ti]
@@ -1345,7 +1882,9 @@ func ReadOffsetReq(r io.Reader) (*OffsetReq, error) {
 			var part = &topic.Partitions[pi]
 			part.ID = dec.DecodeInt32()
 			part.TimeMs = dec.DecodeInt64()
-			part.MaxOffsets = dec.DecodeInt32()
+			if req.Version == 0 {
+				part.MaxOffsets = dec.DecodeInt32()
+			}
 		}
 	}
 
@@ -1362,11 +1901,14 @@ func (r *OffsetReq) Bytes() ([]byte, error) {
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(int16(OffsetReqKind))
-	enc.Encode(int16(0))
+	enc.Encode(r.Version)
 	enc.Encode(r.CorrelationID)
 	enc.Encode(r.ClientID)
 
 	enc.Encode(r.ReplicaID)
+	if r.Version >= 2 {
+		enc.Encode(r.IsolationLevel)
+	}
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
 		enc.Encode(topic.Name)
@@ -1374,7 +1916,9 @@ func (r *OffsetReq) Bytes() ([]byte, error) {
 		for _, part := range topic.Partitions {
 			enc.Encode(part.ID)
 			enc.Encode(part.TimeMs)
-			enc.Encode(part.MaxOffsets)
+			if r.Version == 0 {
+				enc.Encode(part.MaxOffsets)
+			}
 		}
 	}
 
@@ -1399,7 +1943,9 @@ func (r *OffsetReq) WriteTo(w io.Writer) (int64, error) {
 }
 
 type OffsetResp struct {
+	Version       int16 // not sent over the wire, selects the encoding
 	CorrelationID int32
+	ThrottleTime  time.Duration // since v2
 	Topics        []OffsetRespTopic
 }
 
@@ -1409,18 +1955,37 @@ type OffsetRespTopic struct {
 }
 
 type OffsetRespPartition struct {
-	ID      int32
-	Err     error
+	ID  int32
+	Err error
+
+	// TimeMs is the timestamp of the returned offset, or -1. Since v1.
+	TimeMs int64
+
+	// Offsets lists offsets found for the requested time. Since v1 only a
+	// single offset is sent, the first one.
 	Offsets []int64
 }
 
+// ReadOffsetResp reads a version 0 offset response.
 func ReadOffsetResp(r io.Reader) (*OffsetResp, error) {
+	return ReadVersionedOffsetResp(r, 0)
+}
+
+// ReadVersionedOffsetResp reads an offset response encoded using given
+// protocol version. Responses do not carry their version, so it must match
+// the version of the request the response was sent for.
+func ReadVersionedOffsetResp(r io.Reader, version int16) (*OffsetResp, error) {
 	var resp OffsetResp
 	dec := NewDecoder(r)
 
+	resp.Version = version
+
 	// total message size
 	_ = dec.DecodeInt32()
 	resp.CorrelationID = dec.DecodeInt32()
+	if version >= 2 {
+		resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+	}
 	resp.Topics = make([]OffsetRespTopic, dec.DecodeArrayLen())
 	for ti := range resp.Topics {
 		var t = &resp.Topics[ti]
@@ -1430,6 +1995,11 @@ func ReadOffsetResp(r io.Reader) (*OffsetResp, error) {
 			var p = &t.Partitions[pi]
 			p.ID = dec.DecodeInt32()
 			p.Err = errFromNo(dec.DecodeInt16())
+			if version >= 1 {
+				p.TimeMs = dec.DecodeInt64()
+				p.Offsets = []int64{dec.DecodeInt64()}
+				continue
+			}
 			p.Offsets = make([]int64, dec.DecodeArrayLen())
 			for oi := range p.Offsets {
 				p.Offsets[oi] = dec.DecodeInt64()
@@ -1450,6 +2020,9 @@ func (r *OffsetResp) Bytes() ([]byte, error) {
 	// message size - for now just placeholder
 	enc.Encode(int32(0))
 	enc.Encode(r.CorrelationID)
+	if r.Version >= 2 {
+		enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	}
 	enc.EncodeArrayLen(len(r.Topics))
 	for _, topic := range r.Topics {
 		enc.Encode(topic.Name)
@@ -1457,6 +2030,15 @@ func (r *OffsetResp) Bytes() ([]byte, error) {
 		for _, part := range topic.Partitions {
 			enc.Encode(part.ID)
 			enc.EncodeError(part.Err)
+			if r.Version >= 1 {
+				offset := int64(-1)
+				if len(part.Offsets) > 0 {
+					offset = part.Offsets[0]
+				}
+				enc.Encode(part.TimeMs)
+				enc.Encode(offset)
+				continue
+			}
 			enc.EncodeArrayLen(len(part.Offsets))
 			for _, off := range part.Offsets {
 				enc.Encode(off)
@@ -1475,6 +2057,468 @@ func (r *OffsetResp) Bytes() ([]byte, error) {
 	return b, nil
 }
 
+const (
+	// resource types of config requests
+	ConfigResourceTopic  = 2
+	ConfigResourceBroker = 4
+)
+
+type DescribeConfigsReq struct {
+	CorrelationID int32
+	ClientID      string
+	Resources     []DescribeConfigsReqResource
+}
+
+type DescribeConfigsReqResource struct {
+	Type int8
+	Name string
+
+	// ConfigNames limits the described configs. Nil means all configs.
+	ConfigNames []string
+}
+
+func ReadDescribeConfigsReq(r io.Reader) (*DescribeConfigsReq, error) {
+	var req DescribeConfigsReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+
+	req.Resources = make([]DescribeConfigsReqResource, dec.DecodeArrayLen())
+	for i := range req.Resources {
+		var res = &req.Resources[i]
+		res.Type = dec.DecodeInt8()
+		res.Name = dec.DecodeString()
+		// null array is sent as -1 length
+		if n := dec.DecodeArrayLen(); n >= 0 {
+			res.ConfigNames = make([]string, n)
+		}
+		for ni := range res.ConfigNames {
+			res.ConfigNames[ni] = dec.DecodeString()
+		}
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *DescribeConfigsReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(DescribeConfigsReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	enc.EncodeArrayLen(len(r.Resources))
+	for _, res := range r.Resources {
+		enc.Encode(res.Type)
+		enc.Encode(res.Name)
+		if res.ConfigNames == nil {
+			enc.EncodeArrayLen(-1)
+		} else {
+			enc.EncodeArrayLen(len(res.ConfigNames))
+		}
+		for _, name := range res.ConfigNames {
+			enc.Encode(name)
+		}
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *DescribeConfigsReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+type DescribeConfigsResp struct {
+	CorrelationID int32
+	ThrottleTime  time.Duration
+	Resources     []DescribeConfigsRespResource
+}
+
+type DescribeConfigsRespResource struct {
+	Err        error
+	ErrMessage string
+	Type       int8
+	Name       string
+	Configs    []DescribeConfigsRespConfig
+}
+
+type DescribeConfigsRespConfig struct {
+	Name        string
+	Value       string
+	ReadOnly    bool
+	IsDefault   bool
+	IsSensitive bool
+}
+
+func ReadDescribeConfigsResp(r io.Reader) (*DescribeConfigsResp, error) {
+	var resp DescribeConfigsResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+
+	resp.Resources = make([]DescribeConfigsRespResource, dec.DecodeArrayLen())
+	for i := range resp.Resources {
+		var res = &resp.Resources[i]
+		res.Err = errFromNo(dec.DecodeInt16())
+		res.ErrMessage = dec.DecodeString()
+		res.Type = dec.DecodeInt8()
+		res.Name = dec.DecodeString()
+		res.Configs = make([]DescribeConfigsRespConfig, dec.DecodeArrayLen())
+		for ci := range res.Configs {
+			var conf = &res.Configs[ci]
+			conf.Name = dec.DecodeString()
+			conf.Value = dec.DecodeString()
+			conf.ReadOnly = dec.DecodeInt8() != 0
+			conf.IsDefault = dec.DecodeInt8() != 0
+			conf.IsSensitive = dec.DecodeInt8() != 0
+		}
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *DescribeConfigsResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	enc.EncodeArrayLen(len(r.Resources))
+	for _, res := range r.Resources {
+		enc.EncodeError(res.Err)
+		enc.EncodeNullableString(res.ErrMessage)
+		enc.Encode(res.Type)
+		enc.Encode(res.Name)
+		enc.EncodeArrayLen(len(res.Configs))
+		for _, conf := range res.Configs {
+			enc.Encode(conf.Name)
+			enc.Encode(conf.Value)
+			enc.Encode(conf.ReadOnly)
+			enc.Encode(conf.IsDefault)
+			enc.Encode(conf.IsSensitive)
+		}
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+type AlterConfigsReq struct {
+	CorrelationID int32
+	ClientID      string
+	Resources     []AlterConfigsReqResource
+	ValidateOnly  bool
+}
+
+type AlterConfigsReqResource struct {
+	Type    int8
+	Name    string
+	Configs []AlterConfigsReqConfig
+}
+
+type AlterConfigsReqConfig struct {
+	Name  string
+	Value string
+}
+
+func ReadAlterConfigsReq(r io.Reader) (*AlterConfigsReq, error) {
+	var req AlterConfigsReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+
+	req.Resources = make([]AlterConfigsReqResource, dec.DecodeArrayLen())
+	for i := range req.Resources {
+		var res = &req.Resources[i]
+		res.Type = dec.DecodeInt8()
+		res.Name = dec.DecodeString()
+		res.Configs = make([]AlterConfigsReqConfig, dec.DecodeArrayLen())
+		for ci := range res.Configs {
+			res.Configs[ci].Name = dec.DecodeString()
+			res.Configs[ci].Value = dec.DecodeString()
+		}
+	}
+	req.ValidateOnly = dec.DecodeInt8() != 0
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *AlterConfigsReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(AlterConfigsReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	enc.EncodeArrayLen(len(r.Resources))
+	for _, res := range r.Resources {
+		enc.Encode(res.Type)
+		enc.Encode(res.Name)
+		enc.EncodeArrayLen(len(res.Configs))
+		for _, conf := range res.Configs {
+			enc.Encode(conf.Name)
+			enc.Encode(conf.Value)
+		}
+	}
+	enc.Encode(r.ValidateOnly)
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *AlterConfigsReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+type AlterConfigsResp struct {
+	CorrelationID int32
+	ThrottleTime  time.Duration
+	Resources     []AlterConfigsRespResource
+}
+
+type AlterConfigsRespResource struct {
+	Err        error
+	ErrMessage string
+	Type       int8
+	Name       string
+}
+
+func ReadAlterConfigsResp(r io.Reader) (*AlterConfigsResp, error) {
+	var resp AlterConfigsResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+
+	resp.Resources = make([]AlterConfigsRespResource, dec.DecodeArrayLen())
+	for i := range resp.Resources {
+		var res = &resp.Resources[i]
+		res.Err = errFromNo(dec.DecodeInt16())
+		res.ErrMessage = dec.DecodeString()
+		res.Type = dec.DecodeInt8()
+		res.Name = dec.DecodeString()
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *AlterConfigsResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	enc.EncodeArrayLen(len(r.Resources))
+	for _, res := range r.Resources {
+		enc.EncodeError(res.Err)
+		enc.EncodeNullableString(res.ErrMessage)
+		enc.Encode(res.Type)
+		enc.Encode(res.Name)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+type DeleteGroupsReq struct {
+	CorrelationID int32
+	ClientID      string
+	Groups        []string
+}
+
+func ReadDeleteGroupsReq(r io.Reader) (*DeleteGroupsReq, error) {
+	var req DeleteGroupsReq
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	// api key + api version
+	_ = dec.DecodeInt32()
+	req.CorrelationID = dec.DecodeInt32()
+	req.ClientID = dec.DecodeString()
+
+	req.Groups = make([]string, dec.DecodeArrayLen())
+	for i := range req.Groups {
+		req.Groups[i] = dec.DecodeString()
+	}
+
+	if dec.Err() != nil {
+		return nil, dec.Err()
+	}
+	return &req, nil
+}
+
+func (r *DeleteGroupsReq) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(int16(DeleteGroupsReqKind))
+	enc.Encode(int16(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(r.ClientID)
+
+	enc.EncodeArrayLen(len(r.Groups))
+	for _, group := range r.Groups {
+		enc.Encode(group)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
+func (r *DeleteGroupsReq) WriteTo(w io.Writer) (int64, error) {
+	b, err := r.Bytes()
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+type DeleteGroupsResp struct {
+	CorrelationID int32
+	ThrottleTime  time.Duration
+	Groups        []DeleteGroupsRespGroup
+}
+
+type DeleteGroupsRespGroup struct {
+	Name string
+	Err  error
+}
+
+func ReadDeleteGroupsResp(r io.Reader) (*DeleteGroupsResp, error) {
+	var resp DeleteGroupsResp
+	dec := NewDecoder(r)
+
+	// total message size
+	_ = dec.DecodeInt32()
+	resp.CorrelationID = dec.DecodeInt32()
+	resp.ThrottleTime = time.Duration(dec.DecodeInt32()) * time.Millisecond
+
+	resp.Groups = make([]DeleteGroupsRespGroup, dec.DecodeArrayLen())
+	for i := range resp.Groups {
+		resp.Groups[i].Name = dec.DecodeString()
+		resp.Groups[i].Err = errFromNo(dec.DecodeInt16())
+	}
+
+	if err := dec.Err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *DeleteGroupsResp) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	// message size - for now just placeholder
+	enc.Encode(int32(0))
+	enc.Encode(r.CorrelationID)
+	enc.Encode(int32(r.ThrottleTime / time.Millisecond))
+	enc.EncodeArrayLen(len(r.Groups))
+	for _, group := range r.Groups {
+		enc.Encode(group.Name)
+		enc.EncodeError(group.Err)
+	}
+
+	if enc.Err() != nil {
+		return nil, enc.Err()
+	}
+
+	// update the message size information
+	b := buf.Bytes()
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b, nil
+}
+
 type buffer []byte
 
 func (b *buffer) Write(p []byte) (int, error) {
@@ -132,6 +132,62 @@ func (s *MessagesSuite) TestMetadataResponse(c *C) {
 	}
 }
 
+func (s *MessagesSuite) TestVersionedMetadataRoundTrip(c *C) {
+	req := &MetadataReq{Version: 1, CorrelationID: 3, ClientID: "test"}
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	decReq, err := ReadMetadataReq(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(decReq, DeepEquals, req)
+
+	req = &MetadataReq{Version: 4, CorrelationID: 3, Topics: []string{"foo"}, AllowAutoTopicCreation: true}
+	b, err = req.Bytes()
+	c.Assert(err, IsNil)
+	decReq, err = ReadMetadataReq(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(decReq, DeepEquals, req)
+
+	for version := int16(0); version <= 7; version++ {
+		resp := &MetadataResp{
+			Version:       version,
+			CorrelationID: 3,
+			Brokers: []MetadataRespBroker{
+				{NodeID: 1, Host: "localhost", Port: 9092},
+			},
+			Topics: []MetadataRespTopic{
+				{
+					Name: "foo",
+					Partitions: []MetadataRespPartition{
+						{ID: 0, Leader: 1, Replicas: []int32{1}, Isrs: []int32{1}},
+					},
+				},
+			},
+		}
+		if version >= 1 {
+			resp.Brokers[0].Rack = "rack-1"
+			resp.ControllerID = 1
+			resp.Topics[0].IsInternal = true
+		}
+		if version >= 2 {
+			resp.ClusterID = "cluster"
+		}
+		if version >= 3 {
+			resp.ThrottleTime = 20 * time.Millisecond
+		}
+		if version >= 5 {
+			resp.Topics[0].Partitions[0].OfflineReplicas = []int32{2}
+		}
+		if version >= 7 {
+			resp.Topics[0].Partitions[0].LeaderEpoch = 4
+		}
+		b, err := resp.Bytes()
+		c.Assert(err, IsNil)
+		decResp, err := ReadVersionedMetadataResp(bytes.NewBuffer(b), version)
+		c.Assert(err, IsNil)
+		c.Assert(decResp, DeepEquals, resp)
+	}
+}
+
 func (s *MessagesSuite) TestProduceRequest(c *C) {
 	req := &ProduceReq{
 		CorrelationID: 241,
@@ -266,6 +322,66 @@ func (s *MessagesSuite) TestProduceResponse(c *C) {
 	}
 }
 
+func (s *MessagesSuite) TestVersionedProduceRoundTrip(c *C) {
+	created := time.Unix(1500000000, 123000000)
+	req := &ProduceReq{
+		Version:       2,
+		CorrelationID: 3,
+		ClientID:      "test",
+		RequiredAcks:  RequiredAcksAll,
+		Timeout:       time.Second,
+		Topics: []ProduceReqTopic{
+			{
+				Name: "foo",
+				Partitions: []ProduceReqPartition{
+					{
+						ID: 1,
+						Messages: []*Message{
+							{Value: []byte("a"), Timestamp: created},
+						},
+					},
+				},
+			},
+		},
+	}
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	decReq, err := ReadProduceReq(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(decReq.Version, Equals, int16(2))
+	messages := decReq.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 1)
+	c.Assert(messages[0].Timestamp.Equal(created), Equals, true)
+
+	appended := time.Unix(1500000001, 456000000)
+	for _, version := range []int16{0, 1, 2} {
+		resp := &ProduceResp{
+			Version:       version,
+			CorrelationID: 3,
+			Topics: []ProduceRespTopic{
+				{
+					Name: "foo",
+					Partitions: []ProduceRespPartition{
+						{ID: 1, Offset: 5},
+						{ID: 2, Err: ErrNotLeaderForPartition, Offset: -1},
+					},
+				},
+			},
+		}
+		if version >= 1 {
+			resp.ThrottleTime = time.Second
+		}
+		if version >= 2 {
+			resp.Topics[0].Partitions[0].LogAppendTime = appended
+		}
+		b, err := resp.Bytes()
+		c.Assert(err, IsNil)
+		decResp, err := ReadVersionedProduceResp(bytes.NewBuffer(b), version)
+		c.Assert(err, IsNil)
+		c.Assert(decResp, DeepEquals, resp)
+	}
+}
+
 func (s *MessagesSuite) TestFetchRequest(c *C) {
 	req := &FetchReq{
 		CorrelationID: 241,
@@ -397,6 +513,403 @@ func (s *MessagesSuite) TestFetchResponse(c *C) {
 	}
 }
 
+func (s *MessagesSuite) TestVersionedFetchRoundTrip(c *C) {
+	req := &FetchReq{
+		Version:        5,
+		CorrelationID:  241,
+		ClientID:       "test",
+		MaxWaitTime:    time.Second,
+		MinBytes:       1,
+		MaxBytes:       4096,
+		IsolationLevel: 1,
+		Topics: []FetchReqTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchReqPartition{
+					{ID: 3, FetchOffset: 529, LogStartOffset: 500, MaxBytes: 4921},
+				},
+			},
+		},
+	}
+	testRequestSerialization(c, req)
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	r, err := ReadFetchReq(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	if !reflect.DeepEqual(r, req) {
+		c.Fatalf("malformed request: %#v", r)
+	}
+
+	resp := &FetchResp{
+		Version:       5,
+		CorrelationID: 241,
+		ThrottleTime:  10 * time.Millisecond,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{
+						ID:               3,
+						TipOffset:        531,
+						LastStableOffset: 531,
+						LogStartOffset:   500,
+						AbortedTransactions: []FetchRespAbortedTransaction{
+							{ProducerID: 7, FirstOffset: 529},
+						},
+						Messages: []*Message{
+							{Offset: 529, Crc: 0xb8ba5f57, Key: []byte("foo"), Value: []byte("bar"), Topic: "foo", Partition: 3, TipOffset: 531},
+							{Offset: 530, Crc: 0xb8ba5f57, Key: []byte("foo"), Value: []byte("bar"), Topic: "foo", Partition: 3, TipOffset: 531},
+						},
+					},
+				},
+			},
+		},
+	}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	got, err := ReadVersionedFetchResp(bytes.NewBuffer(b), 5)
+	c.Assert(err, IsNil)
+	if !reflect.DeepEqual(got, resp) {
+		c.Fatalf("expected different message: %#v", got)
+	}
+}
+
+func (s *MessagesSuite) TestFetchV11RoundTrip(c *C) {
+	req := &FetchReq{
+		Version:        11,
+		CorrelationID:  242,
+		ClientID:       "test",
+		MaxWaitTime:    time.Second,
+		MinBytes:       1,
+		MaxBytes:       4096,
+		IsolationLevel: 1,
+		SessionID:      12,
+		SessionEpoch:   3,
+		Topics: []FetchReqTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchReqPartition{
+					{ID: 3, CurrentLeaderEpoch: 5, FetchOffset: 529, LogStartOffset: 500, MaxBytes: 4921},
+				},
+			},
+		},
+		ForgottenTopics: []FetchReqForgottenTopic{
+			{Name: "bar", Partitions: []int32{1, 2}},
+		},
+		RackID: "rack-a",
+	}
+	testRequestSerialization(c, req)
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	r, err := ReadFetchReq(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(r, DeepEquals, req)
+
+	resp := &FetchResp{
+		Version:       11,
+		CorrelationID: 242,
+		ThrottleTime:  10 * time.Millisecond,
+		SessionID:     12,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{
+						ID:                   3,
+						TipOffset:            531,
+						LastStableOffset:     531,
+						LogStartOffset:       500,
+						PreferredReadReplica: 2,
+						Messages: []*Message{
+							{Offset: 529, Crc: 0xb8ba5f57, Key: []byte("foo"), Value: []byte("bar"), Topic: "foo", Partition: 3, TipOffset: 531},
+						},
+					},
+				},
+			},
+		},
+	}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	got, err := ReadVersionedFetchResp(bytes.NewBuffer(b), 11)
+	c.Assert(err, IsNil)
+	c.Assert(got, DeepEquals, resp)
+}
+
+func (s *MessagesSuite) TestVersionedOffsetRoundTrips(c *C) {
+	offReq := &OffsetReq{
+		Version:        2,
+		CorrelationID:  3,
+		ClientID:       "test",
+		ReplicaID:      -1,
+		IsolationLevel: 1,
+		Topics: []OffsetReqTopic{
+			{Name: "foo", Partitions: []OffsetReqPartition{{ID: 1, TimeMs: -2}}},
+		},
+	}
+	b, err := offReq.Bytes()
+	c.Assert(err, IsNil)
+	decOffReq, err := ReadOffsetReq(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(decOffReq, DeepEquals, offReq)
+
+	offResp := &OffsetResp{
+		Version:       2,
+		CorrelationID: 3,
+		ThrottleTime:  time.Second,
+		Topics: []OffsetRespTopic{
+			{Name: "foo", Partitions: []OffsetRespPartition{{ID: 1, TimeMs: -1, Offsets: []int64{42}}}},
+		},
+	}
+	b, err = offResp.Bytes()
+	c.Assert(err, IsNil)
+	decOffResp, err := ReadVersionedOffsetResp(bytes.NewBuffer(b), 2)
+	c.Assert(err, IsNil)
+	c.Assert(decOffResp, DeepEquals, offResp)
+
+	commitReq := &OffsetCommitReq{
+		Version:       2,
+		CorrelationID: 4,
+		ClientID:      "test",
+		ConsumerGroup: "group",
+		RetentionTime: time.Hour,
+		Topics: []OffsetCommitReqTopic{
+			{Name: "foo", Partitions: []OffsetCommitReqPartition{{ID: 1, Offset: 42, Metadata: "meta"}}},
+		},
+	}
+	b, err = commitReq.Bytes()
+	c.Assert(err, IsNil)
+	decCommitReq, err := ReadOffsetCommitReq(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(decCommitReq, DeepEquals, commitReq)
+
+	commitResp := &OffsetCommitResp{
+		Version:       3,
+		CorrelationID: 4,
+		ThrottleTime:  time.Second,
+		Topics: []OffsetCommitRespTopic{
+			{Name: "foo", Partitions: []OffsetCommitRespPartition{{ID: 1, Err: ErrOffsetMetadataTooLarge}}},
+		},
+	}
+	b, err = commitResp.Bytes()
+	c.Assert(err, IsNil)
+	decCommitResp, err := ReadVersionedOffsetCommitResp(bytes.NewBuffer(b), 3)
+	c.Assert(err, IsNil)
+	c.Assert(decCommitResp, DeepEquals, commitResp)
+
+	fetchReq := &OffsetFetchReq{
+		Version:       3,
+		CorrelationID: 5,
+		ClientID:      "test",
+		ConsumerGroup: "group",
+		Topics:        []OffsetFetchReqTopic{{Name: "foo", Partitions: []int32{1}}},
+	}
+	b, err = fetchReq.Bytes()
+	c.Assert(err, IsNil)
+	decFetchReq, err := ReadOffsetFetchReq(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(decFetchReq, DeepEquals, fetchReq)
+
+	fetchResp := &OffsetFetchResp{
+		Version:       3,
+		CorrelationID: 5,
+		ThrottleTime:  time.Second,
+		Topics: []OffsetFetchRespTopic{
+			{Name: "foo", Partitions: []OffsetFetchRespPartition{{ID: 1, Offset: 42, Metadata: "meta"}}},
+		},
+		Err: ErrNotCoordinator,
+	}
+	b, err = fetchResp.Bytes()
+	c.Assert(err, IsNil)
+	decFetchResp, err := ReadVersionedOffsetFetchResp(bytes.NewBuffer(b), 3)
+	c.Assert(err, IsNil)
+	c.Assert(decFetchResp, DeepEquals, fetchResp)
+
+	// version 0 commits are sent as version 1, storing offsets in kafka
+	commitReq.Version = 0
+	b, err = commitReq.Bytes()
+	c.Assert(err, IsNil)
+	decCommitReq, err = ReadOffsetCommitReq(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(decCommitReq.Version, Equals, int16(1))
+}
+
+func (s *MessagesSuite) TestVersionedGroupCoordinatorRoundTrip(c *C) {
+	req := &GroupCoordinatorReq{
+		Version:         1,
+		CorrelationID:   4,
+		ClientID:        "test",
+		ConsumerGroup:   "txn-id",
+		CoordinatorType: CoordinatorTransaction,
+	}
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	decReq, err := ReadGroupCoordinatorReq(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(decReq, DeepEquals, req)
+
+	resp := &GroupCoordinatorResp{
+		Version:         1,
+		CorrelationID:   4,
+		ThrottleTime:    time.Second,
+		Err:             ErrNoCoordinator,
+		ErrMessage:      "loading",
+		CoordinatorID:   -1,
+		CoordinatorPort: -1,
+	}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	decResp, err := ReadVersionedGroupCoordinatorResp(bytes.NewBuffer(b), 1)
+	c.Assert(err, IsNil)
+	c.Assert(decResp, DeepEquals, resp)
+}
+
+func (s *MessagesSuite) TestDescribeConfigsRoundTrip(c *C) {
+	req := &DescribeConfigsReq{
+		CorrelationID: 5,
+		ClientID:      "test",
+		Resources: []DescribeConfigsReqResource{
+			{Type: ConfigResourceTopic, Name: "foo"},
+			{Type: ConfigResourceTopic, Name: "bar", ConfigNames: []string{"retention.ms"}},
+		},
+	}
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	decReq, err := ReadDescribeConfigsReq(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(decReq, DeepEquals, req)
+
+	resp := &DescribeConfigsResp{
+		CorrelationID: 5,
+		ThrottleTime:  time.Second,
+		Resources: []DescribeConfigsRespResource{
+			{
+				Type: ConfigResourceTopic,
+				Name: "foo",
+				Configs: []DescribeConfigsRespConfig{
+					{Name: "retention.ms", Value: "1000", IsDefault: true},
+				},
+			},
+			{
+				Err:        ErrUnknownTopicOrPartition,
+				ErrMessage: "no such topic",
+				Type:       ConfigResourceTopic,
+				Name:       "bar",
+				Configs:    []DescribeConfigsRespConfig{},
+			},
+		},
+	}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	decResp, err := ReadDescribeConfigsResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(decResp, DeepEquals, resp)
+}
+
+func (s *MessagesSuite) TestAlterConfigsRoundTrip(c *C) {
+	req := &AlterConfigsReq{
+		CorrelationID: 6,
+		ClientID:      "test",
+		Resources: []AlterConfigsReqResource{
+			{
+				Type: ConfigResourceTopic,
+				Name: "foo",
+				Configs: []AlterConfigsReqConfig{
+					{Name: "retention.ms", Value: "1000"},
+				},
+			},
+		},
+		ValidateOnly: true,
+	}
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	decReq, err := ReadAlterConfigsReq(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(decReq, DeepEquals, req)
+
+	resp := &AlterConfigsResp{
+		CorrelationID: 6,
+		Resources: []AlterConfigsRespResource{
+			{Type: ConfigResourceTopic, Name: "foo"},
+			{Err: ErrInvalidConfig, ErrMessage: "unknown", Type: ConfigResourceTopic, Name: "bar"},
+		},
+	}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	decResp, err := ReadAlterConfigsResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(decResp, DeepEquals, resp)
+}
+
+func (s *MessagesSuite) TestDeleteGroupsRoundTrip(c *C) {
+	req := &DeleteGroupsReq{
+		CorrelationID: 7,
+		ClientID:      "test",
+		Groups:        []string{"a", "b"},
+	}
+	b, err := req.Bytes()
+	c.Assert(err, IsNil)
+	decReq, err := ReadDeleteGroupsReq(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(decReq, DeepEquals, req)
+
+	resp := &DeleteGroupsResp{
+		CorrelationID: 7,
+		ThrottleTime:  time.Second,
+		Groups: []DeleteGroupsRespGroup{
+			{Name: "a"},
+			{Name: "b", Err: ErrGroupIDNotFound},
+		},
+	}
+	b, err = resp.Bytes()
+	c.Assert(err, IsNil)
+	decResp, err := ReadDeleteGroupsResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	c.Assert(decResp, DeepEquals, resp)
+}
+
+func (s *MessagesSuite) TestReadRespByKind(c *C) {
+	b, err := (&MetadataResp{CorrelationID: 9}).Bytes()
+	c.Assert(err, IsNil)
+	resp, err := ReadRespByKind(MetadataReqKind, bytes.NewBuffer(b), 0)
+	c.Assert(err, IsNil)
+	c.Assert(resp.(*MetadataResp).CorrelationID, Equals, int32(9))
+
+	b, err = (&GroupCoordinatorResp{CorrelationID: 10, CoordinatorID: 1}).Bytes()
+	c.Assert(err, IsNil)
+	resp, err = ReadRespByKind(GroupCoordinatorReqKind, bytes.NewBuffer(b), 0)
+	c.Assert(err, IsNil)
+	c.Assert(resp.(*GroupCoordinatorResp).CoordinatorID, Equals, int32(1))
+
+	// versioned responses are decoded using given version
+	fetch := &FetchResp{
+		Version:       11,
+		CorrelationID: 11,
+		ThrottleTime:  time.Second,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{ID: 0, TipOffset: 4, LastStableOffset: 4, LogStartOffset: 0, PreferredReadReplica: 2},
+				},
+			},
+		},
+	}
+	b, err = fetch.Bytes()
+	c.Assert(err, IsNil)
+	resp, err = ReadRespByKind(FetchReqKind, bytes.NewBuffer(b), 11)
+	c.Assert(err, IsNil)
+	c.Assert(resp.(*FetchResp).Version, Equals, int16(11))
+	c.Assert(resp.(*FetchResp).Topics[0].Partitions[0].PreferredReadReplica, Equals, int32(2))
+
+	b, err = (&DeleteGroupsResp{CorrelationID: 12}).Bytes()
+	c.Assert(err, IsNil)
+	_, err = ReadRespByKind(DeleteGroupsReqKind, bytes.NewBuffer(b), 1)
+	c.Assert(err, NotNil)
+
+	_, err = ReadRespByKind(-1, bytes.NewBuffer(b), 0)
+	c.Assert(err, NotNil)
+}
+
 func (s *MessagesSuite) TestSerializeEmptyMessageSet(c *C) {
 	var buf bytes.Buffer
 	messages := []*Message{}
@@ -438,6 +951,66 @@ func (s *MessagesSuite) TestReadIncompleteMessage(c *C) {
 	}
 }
 
+func (s *MessagesSuite) TestMessageFormatV1RoundTrip(c *C) {
+	created := time.Unix(1500000000, 123000000)
+	resp := &FetchResp{
+		CorrelationID: 1,
+		MessageFormat: MessageFormatV1,
+		Topics: []FetchRespTopic{
+			{
+				Name: "foo",
+				Partitions: []FetchRespPartition{
+					{
+						ID:        0,
+						TipOffset: 2,
+						Messages: []*Message{
+							{Offset: 0, Key: []byte("k"), Value: []byte("a"), Timestamp: created},
+							{Offset: 1, Value: []byte("b")},
+						},
+					},
+				},
+			},
+		},
+	}
+	b, err := resp.Bytes()
+	c.Assert(err, IsNil)
+
+	decResp, err := ReadFetchResp(bytes.NewBuffer(b))
+	c.Assert(err, IsNil)
+	messages := decResp.Topics[0].Partitions[0].Messages
+	c.Assert(messages, HasLen, 2)
+	c.Assert(messages[0].Timestamp.Equal(created), Equals, true)
+	c.Assert(string(messages[0].Key), Equals, "k")
+	c.Assert(string(messages[0].Value), Equals, "a")
+	c.Assert(messages[1].Timestamp.IsZero(), Equals, true)
+	c.Assert(messages[1].Offset, Equals, int64(1))
+}
+
+func (s *MessagesSuite) TestComputeVersionedCrc(c *C) {
+	created := time.Unix(1500000000, 0)
+	for _, magic := range []int8{MessageFormatV0, MessageFormatV1} {
+		var buf bytes.Buffer
+		messages := []*Message{
+			{Key: []byte("k"), Value: []byte("a"), Timestamp: created},
+			{Value: []byte("b")},
+		}
+		_, err := writeVersionedMessageSet(&buf, messages, CompressionNone, magic)
+		c.Assert(err, IsNil)
+
+		decoded, err := readMessageSet(&buf, int32(buf.Len()))
+		c.Assert(err, IsNil)
+		c.Assert(decoded, HasLen, 2)
+		for i, msg := range messages {
+			c.Assert(ComputeVersionedCrc(msg, CompressionNone, magic), Equals, decoded[i].Crc,
+				Commentf("format %d, message %d", magic, i))
+		}
+	}
+
+	msg := &Message{Value: []byte("a")}
+	c.Assert(ComputeCrc(msg, CompressionNone), Equals, ComputeVersionedCrc(msg, CompressionNone, MessageFormatV0))
+	c.Assert(ComputeCrc(msg, CompressionNone), Not(Equals), ComputeVersionedCrc(msg, CompressionNone, MessageFormatV1))
+}
+
 func BenchmarkProduceRequestMarshal(b *testing.B) {
 	messages := make([]*Message, 100)
 	for i := range messages {
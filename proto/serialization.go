@@ -149,9 +149,14 @@ func (d *decoder) DecodeBytes() []byte {
 	if d.err != nil {
 		return nil
 	}
-	if slen < 1 {
+	// null bytes are encoded with negative length and must be distinguished
+	// from empty bytes, for example to tell tombstone messages apart
+	if slen < 0 {
 		return nil
 	}
+	if slen == 0 {
+		return []byte{}
+	}
 
 	b := make([]byte, slen)
 	n, err := io.ReadFull(d.r, b)
@@ -229,6 +234,12 @@ func (e *encoder) Encode(value interface{}) {
 		if e.err == nil {
 			e.err = writeAll(e.w, val)
 		}
+	case bool:
+		if val {
+			_, e.err = e.w.Write([]byte{1})
+		} else {
+			_, e.err = e.w.Write([]byte{0})
+		}
 	case []int32:
 		e.EncodeArrayLen(len(val))
 		for _, v := range val {
@@ -327,6 +338,15 @@ func (e *encoder) EncodeString(val string) {
 	}
 }
 
+// EncodeNullableString writes given string, encoding empty string as null.
+func (e *encoder) EncodeNullableString(val string) {
+	if val == "" {
+		e.EncodeInt16(-1)
+		return
+	}
+	e.EncodeString(val)
+}
+
 func (e *encoder) EncodeError(err error) {
 	b := e.buf[:2]
 
@@ -74,3 +74,19 @@ func (s *SerializationSuite) TestDecoder(c *C) {
 		c.Fatalf("bytes are not the same")
 	}
 }
+
+func (s *SerializationSuite) TestDecodeNullBytes(c *C) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.EncodeBytes(nil)
+	enc.EncodeBytes([]byte{})
+	c.Assert(enc.Err(), IsNil)
+
+	d := NewDecoder(&buf)
+	null := d.DecodeBytes()
+	empty := d.DecodeBytes()
+	c.Assert(d.Err(), IsNil)
+	c.Assert(null == nil, Equals, true)
+	c.Assert(empty == nil, Equals, false)
+	c.Assert(empty, HasLen, 0)
+}